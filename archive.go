@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/google/uuid"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveConfig keeps a gzipped copy of the points written, or of the raw
+// consumed messages when Content is messages, in files under Directory
+// partitioned by the hour they were opened in. A file is closed once MaxSize
+// bytes or MaxAge old, and described by a manifest next to it. Closed files
+// are uploaded to S3 in the background, when configured, and removed
+// locally.
+type ArchiveConfig struct {
+	Directory string
+	Content   string
+	MaxSize   int64
+	MaxAge    time.Duration
+	S3        *S3Config
+}
+
+func NewArchiveConfig(entry map[string]interface{}) *ArchiveConfig {
+	conf := &ArchiveConfig{Content: "points", MaxSize: 64 * 1024 * 1024, MaxAge: time.Hour}
+	if value, ok := entry["directory"].(string); ok {
+		conf.Directory = value
+	}
+	if value, ok := entry["content"].(string); ok {
+		conf.Content = strings.ToLower(value)
+	}
+	if value, ok := entry["maxsize"].(int); ok {
+		conf.MaxSize = int64(value)
+	}
+	if value, ok := entry["maxage"].(int); ok {
+		conf.MaxAge = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["s3"]; ok {
+		conf.S3 = NewS3Config(lowerKeys(value))
+	}
+	return conf
+}
+
+type archiveOffsets struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	First     int64  `json:"first"`
+	Last      int64  `json:"last"`
+}
+
+// archiveManifest describes a closed file. Recovered files were left open by
+// a previous run and are described from their content alone.
+type archiveManifest struct {
+	File      string           `json:"file"`
+	Content   string           `json:"content"`
+	Lines     int64            `json:"lines"`
+	Bytes     int64            `json:"bytes"`
+	Sha256    string           `json:"sha256"`
+	Opened    time.Time        `json:"opened"`
+	Closed    time.Time        `json:"closed"`
+	MinTime   *time.Time       `json:"minTime,omitempty"`
+	MaxTime   *time.Time       `json:"maxTime,omitempty"`
+	Offsets   []archiveOffsets `json:"offsets,omitempty"`
+	Recovered bool             `json:"recovered,omitempty"`
+}
+
+// Archive appends every write to the open file as a gzip member of its own,
+// synced before returning, so that offsets are only committed once their
+// lines are on disk and an interrupted file stays readable up to its last
+// complete write. Uploads never hold up writes.
+type Archive struct {
+	config   *ArchiveConfig
+	store    *S3Store
+	lock     sync.Mutex
+	file     *os.File
+	manifest *archiveManifest
+	// unsaved are the manifests of closed files that failed to save.
+	unsaved []*archiveManifest
+	offsets map[topicPartition]*archiveOffsets
+	hash    hash.Hash
+	now     func() time.Time
+	uploads chan bool
+	closing chan bool
+	done    sync.WaitGroup
+}
+
+func NewArchive(config *ArchiveConfig) (*Archive, error) {
+	if config.Content != "points" && config.Content != "messages" {
+		return nil, fmt.Errorf("unknown archive content %s", config.Content)
+	}
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+	archive := &Archive{config: config, now: time.Now, uploads: make(chan bool, 1), closing: make(chan bool)}
+	if config.S3 != nil && config.S3.Bucket != "" {
+		archive.store = NewS3Store(config.S3)
+	}
+	if err := archive.recover(); err != nil {
+		return nil, err
+	}
+	archive.done.Add(1)
+	go archive.run()
+	archive.notify()
+	return archive, nil
+}
+
+// Write archives the points of the batches, or the values of the messages,
+// rotating the open file first when it is due.
+func (a *Archive) Write(batches []influx.BatchPoints, messages []*sarama.ConsumerMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := a.now().UTC()
+	if err := a.saveClosed(); err != nil {
+		log.WithError(err).Error("Unable to save archive manifest")
+	}
+	if a.file != nil && a.due(now) {
+		if err := a.rotate(now); err != nil {
+			MetricsArchiveWriteFailure.Add(1)
+			return err
+		}
+	}
+
+	lines := &bytes.Buffer{}
+	var count int64
+	var minTime, maxTime time.Time
+	if a.config.Content == "points" {
+		for _, batch := range batches {
+			for _, point := range batch.Points() {
+				lines.WriteString(point.String())
+				lines.WriteByte('\n')
+				count++
+				if minTime.IsZero() || point.Time().Before(minTime) {
+					minTime = point.Time()
+				}
+				if point.Time().After(maxTime) {
+					maxTime = point.Time()
+				}
+			}
+		}
+	} else {
+		for _, message := range messages {
+			if message == nil || len(message.Value) == 0 {
+				continue
+			}
+			value := bytes.TrimRight(message.Value, "\n")
+			lines.Write(value)
+			lines.WriteByte('\n')
+			count += int64(bytes.Count(value, []byte("\n")) + 1)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if a.file == nil {
+		if err := a.open(now); err != nil {
+			MetricsArchiveWriteFailure.Add(1)
+			return err
+		}
+	}
+	member := &bytes.Buffer{}
+	writer := gzip.NewWriter(member)
+	writer.Write(lines.Bytes())
+	writer.Close()
+	if _, err := a.file.Write(member.Bytes()); err != nil {
+		a.file.Truncate(a.manifest.Bytes)
+		MetricsArchiveWriteFailure.Add(1)
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Truncate(a.manifest.Bytes)
+		MetricsArchiveWriteFailure.Add(1)
+		return err
+	}
+
+	a.hash.Write(member.Bytes())
+	a.manifest.Bytes += int64(member.Len())
+	a.manifest.Lines += count
+	if !minTime.IsZero() {
+		if a.manifest.MinTime == nil || minTime.Before(*a.manifest.MinTime) {
+			a.manifest.MinTime = &minTime
+		}
+		if a.manifest.MaxTime == nil || maxTime.After(*a.manifest.MaxTime) {
+			a.manifest.MaxTime = &maxTime
+		}
+	}
+	for _, message := range messages {
+		if message == nil {
+			continue
+		}
+		key := topicPartition{message.Topic, message.Partition}
+		offsets, ok := a.offsets[key]
+		if !ok {
+			offsets = &archiveOffsets{message.Topic, message.Partition, message.Offset, message.Offset}
+			a.offsets[key] = offsets
+		}
+		if message.Offset < offsets.First {
+			offsets.First = message.Offset
+		}
+		if message.Offset > offsets.Last {
+			offsets.Last = message.Offset
+		}
+	}
+	MetricsArchiveLinesWritten.Add(count)
+	return nil
+}
+
+// due tells whether the open file is full, old, or from a past hour.
+func (a *Archive) due(now time.Time) bool {
+	return a.manifest.Bytes >= a.config.MaxSize || now.Sub(a.manifest.Opened) >= a.config.MaxAge || !now.Truncate(time.Hour).Equal(a.manifest.Opened.Truncate(time.Hour))
+}
+
+func (a *Archive) open(now time.Time) error {
+	name := filepath.Join(now.Format("2006/01/02/15"), now.Format("20060102T150405Z")+"-"+uuid.New().String()[:8]+".lp.gz")
+	path := filepath.Join(a.config.Directory, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	a.manifest = &archiveManifest{File: filepath.ToSlash(name), Content: a.config.Content, Opened: now}
+	a.offsets = make(map[topicPartition]*archiveOffsets)
+	a.hash = sha256.New()
+	return nil
+}
+
+// rotate closes the open file and writes its manifest, which hands it to the
+// uploads. Once the file is closed, only its manifest is retried.
+func (a *Archive) rotate(now time.Time) error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+	a.manifest.Closed = now
+	a.manifest.Sha256 = hex.EncodeToString(a.hash.Sum(nil))
+	for _, offsets := range a.offsets {
+		a.manifest.Offsets = append(a.manifest.Offsets, *offsets)
+	}
+	sort.Slice(a.manifest.Offsets, func(i, j int) bool {
+		if a.manifest.Offsets[i].Topic != a.manifest.Offsets[j].Topic {
+			return a.manifest.Offsets[i].Topic < a.manifest.Offsets[j].Topic
+		}
+		return a.manifest.Offsets[i].Partition < a.manifest.Offsets[j].Partition
+	})
+	a.unsaved = append(a.unsaved, a.manifest)
+	return a.saveClosed()
+}
+
+// saveClosed writes the manifests of closed files still unsaved, keeping
+// those that fail for the next write or rotation.
+func (a *Archive) saveClosed() error {
+	var failed error
+	unsaved := []*archiveManifest{}
+	for _, manifest := range a.unsaved {
+		if err := saveJson(filepath.Join(a.config.Directory, manifest.File)+".manifest.json", manifest); err != nil {
+			unsaved = append(unsaved, manifest)
+			failed = err
+			continue
+		}
+		MetricsArchiveFilesClosed.Add(1)
+		a.notify()
+	}
+	a.unsaved = unsaved
+	return failed
+}
+
+// run rotates the open file once due, even while nothing is written, and
+// uploads closed files until the archive is closed. Uploads failing are
+// retried on the next tick, the files being safe on disk meanwhile.
+func (a *Archive) run() {
+	defer a.done.Done()
+	ticker := time.NewTicker(a.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.rotateDue()
+			a.upload()
+		case <-a.uploads:
+			a.upload()
+		case <-a.closing:
+			a.upload()
+			return
+		}
+	}
+}
+
+// interval is how often the open file is checked for rotation, so that it is
+// closed at most a minute past the end of its hour.
+func (a *Archive) interval() time.Duration {
+	if a.config.MaxAge > 0 && a.config.MaxAge < time.Minute {
+		return a.config.MaxAge
+	}
+	return time.Minute
+}
+
+func (a *Archive) rotateDue() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.now().UTC()
+	if err := a.saveClosed(); err != nil {
+		log.WithError(err).Error("Unable to save archive manifest")
+	}
+	if a.file != nil && a.due(now) {
+		if err := a.rotate(now); err != nil {
+			log.WithError(err).Error("Unable to rotate archive")
+			MetricsArchiveWriteFailure.Add(1)
+		}
+	}
+}
+
+// notify wakes the uploads up unless they are due already.
+func (a *Archive) notify() {
+	select {
+	case a.uploads <- true:
+	default:
+	}
+}
+
+// upload puts every closed file and its manifest, in that order, and removes
+// them once both are stored.
+func (a *Archive) upload() {
+	if a.store == nil {
+		return
+	}
+	for _, manifest := range a.closedFiles() {
+		path := strings.TrimSuffix(manifest, ".manifest.json")
+		name, _ := filepath.Rel(a.config.Directory, path)
+		err := a.put(filepath.ToSlash(name), path)
+		if err == nil {
+			err = a.put(filepath.ToSlash(name)+".manifest.json", manifest)
+		}
+		if err != nil {
+			log.WithError(err).WithField("file", name).Error("Unable to upload archive")
+			MetricsArchiveUploadFailure.Add(1)
+			continue
+		}
+		os.Remove(path)
+		os.Remove(manifest)
+	}
+}
+
+func (a *Archive) put(key string, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return a.store.Put(key, content)
+}
+
+func (a *Archive) closedFiles() []string {
+	manifests := []string{}
+	filepath.Walk(a.config.Directory, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".lp.gz.manifest.json") {
+			manifests = append(manifests, path)
+		}
+		return nil
+	})
+	return manifests
+}
+
+// recover closes the files a previous run left open, to be uploaded along
+// with whatever it did not upload.
+func (a *Archive) recover() error {
+	open := []string{}
+	err := filepath.Walk(a.config.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".lp.gz") {
+			if _, err := os.Stat(path + ".manifest.json"); os.IsNotExist(err) {
+				open = append(open, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range open {
+		manifest, err := describeArchive(a.config.Directory, path, a.config.Content)
+		if err != nil {
+			return err
+		}
+		if err = saveJson(path+".manifest.json", manifest); err != nil {
+			return err
+		}
+		log.WithField("file", manifest.File).Info("Recovered archive left open")
+	}
+	return nil
+}
+
+// describeArchive reads a file back to describe it, counting the lines of its
+// complete gzip members.
+func describeArchive(directory string, path string, content string) (*archiveManifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := filepath.Rel(directory, path)
+	hash := sha256.Sum256(raw)
+	manifest := &archiveManifest{File: filepath.ToSlash(name), Content: content, Bytes: int64(len(raw)), Sha256: hex.EncodeToString(hash[:]), Opened: info.ModTime().UTC(), Closed: info.ModTime().UTC(), Recovered: true}
+	if reader, err := gzip.NewReader(bytes.NewReader(raw)); err == nil {
+		lines := bufio.NewReader(reader)
+		for {
+			if _, err := lines.ReadBytes('\n'); err != nil {
+				if err != io.EOF {
+					log.WithError(err).WithField("file", manifest.File).Warn("Archive is truncated")
+				}
+				break
+			}
+			manifest.Lines++
+		}
+	}
+	return manifest, nil
+}
+
+// Close closes the open file, if any, and waits for a last round of uploads.
+func (a *Archive) Close() {
+	a.lock.Lock()
+	if a.file != nil {
+		if err := a.rotate(a.now().UTC()); err != nil {
+			log.WithError(err).Error("Unable to close archive")
+		}
+	} else if err := a.saveClosed(); err != nil {
+		log.WithError(err).Error("Unable to save archive manifest")
+	}
+	a.lock.Unlock()
+	close(a.closing)
+	a.done.Wait()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func archiveBatch(t *testing.T, lines ...string) []influx.BatchPoints {
+	parser, err := NewParser(&TopicConfig{Format: "line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Database: "testdb"})
+	for _, line := range lines {
+		points, err := parser.Parse(&sarama.ConsumerMessage{Value: []byte(line)}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.AddPoints(points)
+	}
+	return []influx.BatchPoints{batch}
+}
+
+func readArchive(t *testing.T, path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(reader)
+	return string(content)
+}
+
+func archiveFiles(directory string, suffix string) []string {
+	files := []string{}
+	filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && len(path) > len(suffix) && path[len(path)-len(suffix):] == suffix {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func newTestArchive(t *testing.T, config *ArchiveConfig, now *time.Time) *Archive {
+	archive, err := NewArchive(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.now = func() time.Time { return *now }
+	return archive
+}
+
+func Test_Archive_Rotates_By_Size_And_Writes_Manifests(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	now := time.Date(2018, 6, 1, 10, 15, 0, 0, time.UTC)
+	sut := newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "points", MaxSize: 1, MaxAge: time.Hour}, &now)
+
+	err := sut.Write(archiveBatch(t, "cpu value=1 1527847200000000000", "cpu value=2 1527847260000000000"), []*sarama.ConsumerMessage{{Topic: "metrics", Partition: 0, Offset: 4}, {Topic: "metrics", Partition: 0, Offset: 5}, nil})
+	if err == nil {
+		err = sut.Write(archiveBatch(t, "mem value=3 1527847200000000000"), []*sarama.ConsumerMessage{{Topic: "metrics", Partition: 1, Offset: 9}})
+	}
+	sut.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := archiveFiles(dir, ".lp.gz")
+	manifests := archiveFiles(dir, ".manifest.json")
+	if len(files) != 2 || len(manifests) != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 files and manifests but found %v %v", files, manifests))
+	}
+	if filepath.Dir(files[0]) != filepath.Join(dir, "2018", "06", "01", "10") {
+		t.Error(fmt.Sprintf("Expected file to be partitioned by hour but found %s", files[0]))
+	}
+	content := readArchive(t, files[0]) + readArchive(t, files[1])
+	if content != "cpu value=1 1527847200000000000\ncpu value=2 1527847260000000000\nmem value=3 1527847200000000000\n" && content != "mem value=3 1527847200000000000\ncpu value=1 1527847200000000000\ncpu value=2 1527847260000000000\n" {
+		t.Error(fmt.Sprintf("Unexpected archive content %q", content))
+	}
+	raw, _ := ioutil.ReadFile(manifests[0])
+	manifest := &archiveManifest{}
+	json.Unmarshal(raw, manifest)
+	if manifest.Lines == 1 {
+		raw, _ = ioutil.ReadFile(manifests[1])
+		json.Unmarshal(raw, manifest)
+	}
+	if manifest.Lines != 2 || manifest.MinTime.Unix() != 1527847200 || manifest.MaxTime.Unix() != 1527847260 || fmt.Sprint(manifest.Offsets) != "[{metrics 0 4 5}]" || len(manifest.Sha256) != 64 {
+		t.Error(fmt.Sprintf("Unexpected manifest %s", raw))
+	}
+}
+
+func Test_Archive_Rotates_By_Hour(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	now := time.Date(2018, 6, 1, 10, 59, 0, 0, time.UTC)
+	sut := newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "messages", MaxSize: 1024 * 1024, MaxAge: time.Hour}, &now)
+
+	sut.Write(nil, []*sarama.ConsumerMessage{{Topic: "metrics", Value: []byte("cpu value=1\ncpu value=2\n")}})
+	now = now.Add(2 * time.Minute)
+	sut.Write(nil, []*sarama.ConsumerMessage{{Topic: "metrics", Value: []byte("cpu value=3")}, {Topic: "metrics"}})
+	sut.Close()
+
+	files := archiveFiles(dir, ".lp.gz")
+	if len(files) != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 files but found %v", files))
+	}
+	if actual := readArchive(t, files[0]); actual != "cpu value=1\ncpu value=2\n" {
+		t.Error(fmt.Sprintf("Unexpected archive content %q", actual))
+	}
+	if actual := readArchive(t, files[1]); actual != "cpu value=3\n" {
+		t.Error(fmt.Sprintf("Unexpected archive content %q", actual))
+	}
+	for i, expected := range []int64{2, 1} {
+		raw, _ := ioutil.ReadFile(files[i] + ".manifest.json")
+		manifest := &archiveManifest{}
+		json.Unmarshal(raw, manifest)
+		if manifest.Lines != expected {
+			t.Error(fmt.Sprintf("Expected %d lines but found manifest %s", expected, raw))
+		}
+	}
+}
+
+func Test_Archive_Retries_Only_The_Manifest_Of_A_Closed_File(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	now := time.Date(2018, 6, 1, 10, 15, 0, 0, time.UTC)
+	sut := newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "messages", MaxSize: 1, MaxAge: time.Hour}, &now)
+
+	if err := sut.Write(nil, []*sarama.ConsumerMessage{{Topic: "metrics", Value: []byte("cpu value=1")}}); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the manifest makes its save fail.
+	blocked := filepath.Join(dir, sut.manifest.File) + ".manifest.json"
+	os.MkdirAll(filepath.Join(blocked, "blocked"), 0755)
+	if err := sut.Write(nil, []*sarama.ConsumerMessage{{Topic: "metrics", Value: []byte("cpu value=2")}}); err == nil {
+		t.Error("Expected an error when the manifest fails to save")
+	}
+	if sut.file != nil {
+		t.Error("Expected the closed file to be released")
+	}
+	os.RemoveAll(blocked)
+	err := sut.Write(nil, []*sarama.ConsumerMessage{{Topic: "metrics", Value: []byte("cpu value=2")}})
+	sut.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := archiveFiles(dir, ".lp.gz")
+	manifests := archiveFiles(dir, ".manifest.json")
+	if len(files) != 2 || len(manifests) != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 files and manifests but found %v %v", files, manifests))
+	}
+	if content := readArchive(t, files[0]) + readArchive(t, files[1]); content != "cpu value=1\ncpu value=2\n" && content != "cpu value=2\ncpu value=1\n" {
+		t.Error(fmt.Sprintf("Unexpected archive content %q", content))
+	}
+}
+
+func Test_Archive_Uploads_Closed_Files(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	mock := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	now := time.Date(2018, 6, 1, 10, 15, 0, 0, time.UTC)
+	sut := newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "points", MaxSize: 1024 * 1024, MaxAge: time.Hour, S3: &S3Config{Endpoint: server.URL, Bucket: "archive", Prefix: "kandi", AccessKey: "key", SecretKey: "secret"}}, &now)
+
+	sut.Write(archiveBatch(t, "cpu value=1 1527847200000000000"), nil)
+	sut.Close()
+
+	if len(mock.objects) != 2 {
+		t.Error(fmt.Sprintf("Expected the file and its manifest to be uploaded but found %d objects", len(mock.objects)))
+	}
+	if files := archiveFiles(dir, ".gz"); len(files) != 0 {
+		t.Error(fmt.Sprintf("Expected uploaded files to be removed but found %v", files))
+	}
+}
+
+func Test_Archive_Rotates_And_Uploads_Without_Writes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	mock := &mockS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	sut, err := NewArchive(&ArchiveConfig{Directory: dir, Content: "points", MaxSize: 1024 * 1024, MaxAge: 10 * time.Millisecond, S3: &S3Config{Endpoint: server.URL, Bucket: "archive", AccessKey: "key", SecretKey: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sut.Write(archiveBatch(t, "cpu value=1 1527847200000000000"), nil)
+	for deadline := time.Now().Add(5 * time.Second); len(archiveFiles(dir, ".gz")) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	files := archiveFiles(dir, ".gz")
+	sut.Close()
+
+	if len(files) != 0 || len(mock.objects) != 2 {
+		t.Error(fmt.Sprintf("Expected the file to be closed and uploaded in the background but found %v and %d objects", files, len(mock.objects)))
+	}
+}
+
+func Test_Archive_Recovers_Files_Left_Open(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kandi")
+	defer os.RemoveAll(dir)
+	log.SetLevel(log.PanicLevel)
+	now := time.Date(2018, 6, 1, 10, 15, 0, 0, time.UTC)
+	first := newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "points", MaxSize: 1024 * 1024, MaxAge: time.Hour}, &now)
+	first.Write(archiveBatch(t, "cpu value=1 1527847200000000000", "cpu value=2 1527847200000000000"), nil)
+	first.file.Write([]byte{0x1f, 0x8b, 0x08})
+
+	newTestArchive(t, &ArchiveConfig{Directory: dir, Content: "points", MaxSize: 1024 * 1024, MaxAge: time.Hour}, &now)
+
+	manifests := archiveFiles(dir, ".manifest.json")
+	if len(manifests) != 1 {
+		t.Fatal(fmt.Sprintf("Expected a manifest for the file left open but found %v", manifests))
+	}
+	raw, _ := ioutil.ReadFile(manifests[0])
+	manifest := &archiveManifest{}
+	json.Unmarshal(raw, manifest)
+	if !manifest.Recovered || manifest.Lines != 2 {
+		t.Error(fmt.Sprintf("Unexpected manifest %s", raw))
+	}
+}
+
+func Test_Archive_Of_Unknown_Content(t *testing.T) {
+	if _, err := NewArchive(&ArchiveConfig{Directory: os.TempDir(), Content: "json"}); err == nil {
+		t.Error("Expected an error for unknown archive content")
+	}
+}
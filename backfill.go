@@ -0,0 +1,340 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressConfig throttles a backfill or replay to MaxRate points written per
+// second, unless 0, and logs its progress every ReportInterval.
+type ProgressConfig struct {
+	MaxRate        float64
+	ReportInterval time.Duration
+	MaxRetries     int
+}
+
+func progressFlags(flags *flag.FlagSet, conf *ProgressConfig) {
+	flags.Float64Var(&conf.MaxRate, "max-rate", 0, "maximum number of points written per second, 0 for no limit")
+	flags.DurationVar(&conf.ReportInterval, "report-interval", 30*time.Second, "interval progress is logged at")
+	flags.IntVar(&conf.MaxRetries, "max-retries", 10, "failed attempts in a row to write a batch before giving up, 0 to retry forever")
+}
+
+type partitionProgress struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Target    int64  `json:"target"`
+	Finished  bool   `json:"finished"`
+	ETA       string `json:"eta,omitempty"`
+	first     int64
+	started   time.Time
+	eta       time.Duration
+}
+
+type backfillReport struct {
+	Partitions    []partitionProgress `json:"partitions"`
+	Finished      int                 `json:"finished"`
+	PointsWritten int64               `json:"pointsWritten"`
+	ETA           string              `json:"eta,omitempty"`
+}
+
+// backfillProgress tracks a backfill through the partitions whose ends were
+// snapshot when it started. Partitions are consumed in parallel, so the
+// backfill is expected to end with its slowest partition.
+type backfillProgress struct {
+	lock       sync.Mutex
+	config     ProgressConfig
+	partitions map[topicPartition]*partitionProgress
+	started    time.Time
+	reported   time.Time
+	baseline   int64
+	written    func() int64
+	now        func() time.Time
+	sleep      func(time.Duration)
+}
+
+func newBackfillProgress(offsets map[topicPartition]Offset) *backfillProgress {
+	p := &backfillProgress{partitions: make(map[topicPartition]*partitionProgress), written: MetricsPointsWritten, now: time.Now, sleep: time.Sleep}
+	for key, offset := range offsets {
+		p.partitions[key] = &partitionProgress{Topic: key.topic, Partition: key.partition, Offset: -1, Target: offset.mark - 1, Finished: offset.finished}
+	}
+	p.start(ProgressConfig{})
+	return p
+}
+
+// start resets the clock, rate and points written to the beginning of the run.
+func (p *backfillProgress) start(config ProgressConfig) {
+	p.config = config
+	p.started = p.now()
+	p.reported = p.started
+	p.baseline = p.written()
+}
+
+// Observe records the processed messages, throttles the writes and returns
+// true once every partition has been caught up. Its signature matches
+// Kandi.PostProcessors.
+func (p *backfillProgress) Observe(processedMessages []*sarama.ConsumerMessage) bool {
+	p.lock.Lock()
+	now := p.now()
+	for _, message := range processedMessages {
+		if message == nil {
+			continue
+		}
+		partition, ok := p.partitions[topicPartition{message.Topic, message.Partition}]
+		if !ok || partition.Finished {
+			continue
+		}
+		if partition.started.IsZero() {
+			partition.first = message.Offset
+			partition.started = now
+		}
+		if message.Offset > partition.Offset {
+			partition.Offset = message.Offset
+		}
+		partition.Finished = partition.Offset >= partition.Target
+	}
+	done := p.done()
+	if done || p.config.ReportInterval > 0 && now.Sub(p.reported) >= p.config.ReportInterval {
+		p.reported = now
+		p.log(done)
+	}
+	wait := p.throttle(now)
+	p.lock.Unlock()
+
+	if wait > 0 && !done {
+		p.sleep(wait)
+	}
+	return done
+}
+
+// throttle returns how long to wait for the points written so far to fit
+// the maximum rate.
+func (p *backfillProgress) throttle(now time.Time) time.Duration {
+	if p.config.MaxRate <= 0 {
+		return 0
+	}
+	due := p.started.Add(time.Duration(float64(p.written()-p.baseline) / p.config.MaxRate * float64(time.Second)))
+	return due.Sub(now)
+}
+
+// exhaust finishes a partition at the last offset of it that was read, for
+// ranges that end before their target.
+func (p *backfillProgress) exhaust(key topicPartition, last int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	partition, ok := p.partitions[key]
+	if !ok || partition.Finished || last >= partition.Target {
+		return
+	}
+	log.WithFields(log.Fields{"topic": key.topic, "partition": key.partition, "offset": last, "target": partition.Target}).Info("Partition ended before its target offset")
+	partition.Target = last
+	partition.Finished = partition.Offset >= partition.Target
+}
+
+func (p *backfillProgress) Done() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.done()
+}
+
+func (p *backfillProgress) done() bool {
+	for _, partition := range p.partitions {
+		if !partition.Finished {
+			return false
+		}
+	}
+	return true
+}
+
+// report estimates the time left per partition from the rate it was read at
+// so far. Partitions not read from yet have no estimate.
+func (p *backfillProgress) report(now time.Time) *backfillReport {
+	report := &backfillReport{Partitions: []partitionProgress{}, PointsWritten: p.written() - p.baseline}
+	var eta time.Duration
+	for _, partition := range p.partitions {
+		progress := *partition
+		progress.eta = 0
+		if progress.Finished {
+			report.Finished++
+		} else if !progress.started.IsZero() && progress.Offset > progress.first {
+			elapsed := now.Sub(progress.started)
+			progress.eta = time.Duration(float64(elapsed) * float64(progress.Target-progress.Offset) / float64(progress.Offset-progress.first))
+			progress.ETA = progress.eta.Truncate(time.Second).String()
+		}
+		if progress.eta > eta {
+			eta = progress.eta
+		}
+		report.Partitions = append(report.Partitions, progress)
+	}
+	if eta > 0 {
+		report.ETA = eta.Truncate(time.Second).String()
+	}
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		if report.Partitions[i].Topic != report.Partitions[j].Topic {
+			return report.Partitions[i].Topic < report.Partitions[j].Topic
+		}
+		return report.Partitions[i].Partition < report.Partitions[j].Partition
+	})
+	return report
+}
+
+func (p *backfillProgress) log(done bool) {
+	report := p.report(p.now())
+	for _, partition := range report.Partitions {
+		log.WithFields(log.Fields{"topic": partition.Topic, "partition": partition.Partition, "offset": partition.Offset, "target": partition.Target, "finished": partition.Finished, "eta": partition.ETA}).Debug("Backfill partition progress")
+	}
+	entry := log.WithFields(log.Fields{"finished": report.Finished, "partitions": len(report.Partitions), "pointsWritten": report.PointsWritten, "eta": report.ETA})
+	if done {
+		entry.Info("Backfill completed")
+	} else {
+		entry.Info("Backfill progress")
+	}
+}
+
+// runningProgress is the progress of the backfill or replay this process runs.
+var runningProgress struct {
+	lock     sync.Mutex
+	progress *backfillProgress
+}
+
+func init() {
+	expvar.Publish("backfillProgress", expvar.Func(func() interface{} {
+		runningProgress.lock.Lock()
+		progress := runningProgress.progress
+		runningProgress.lock.Unlock()
+		if progress == nil {
+			return nil
+		}
+		progress.lock.Lock()
+		defer progress.lock.Unlock()
+		return progress.report(progress.now())
+	}))
+}
+
+func publishProgress(progress *backfillProgress) {
+	runningProgress.lock.Lock()
+	defer runningProgress.lock.Unlock()
+	runningProgress.progress = progress
+}
+
+// BackfillConfig names a resumable backfill by ID. Its target offsets and
+// progress are checkpointed to a file in CheckpointDir, and a backfill
+// restarted with the same ID picks up where the checkpoint left off.
+type BackfillConfig struct {
+	ID            string
+	CheckpointDir string
+	Progress      ProgressConfig
+}
+
+func parseBackfillArgs(args []string, output io.Writer) (*BackfillConfig, error) {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	flags.SetOutput(output)
+	conf := &BackfillConfig{}
+	flags.StringVar(&conf.ID, "id", "", "identifier of a resumable backfill")
+	flags.StringVar(&conf.CheckpointDir, "checkpoint-dir", ".", "directory the checkpoint of a resumable backfill is kept in")
+	progressFlags(flags, &conf.Progress)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(conf.ID, `/\`) || conf.ID == "." || conf.ID == ".." {
+		return nil, fmt.Errorf("invalid backfill id %s", conf.ID)
+	}
+	if conf.Progress.MaxRate < 0 {
+		return nil, fmt.Errorf("-max-rate must not be negative")
+	}
+	if conf.Progress.MaxRetries < 0 {
+		return nil, fmt.Errorf("-max-retries must not be negative")
+	}
+	return conf, nil
+}
+
+func (b *BackfillConfig) checkpointPath() string {
+	return filepath.Join(b.CheckpointDir, "backfill-"+b.ID+".json")
+}
+
+// backfill consumes the configured topics from their oldest offsets and
+// returns once it caught up with the offsets they had when it started. The
+// partitions are read directly, outside of any consumer group, so that
+// partitions whose last offsets are never delivered still end. A backfill with
+// an ID checkpoints its progress and resumes from the checkpoint.
+func backfill(args []string) error {
+	backfillConf, err := parseBackfillArgs(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	kandi := NewKandi(NewConfig())
+	client, err := sarama.NewClient(strings.Split(kandi.conf.Kafka.Brokers, ","), &kandi.conf.Kafka.Cluster.Config)
+	if err != nil {
+		return err
+	}
+	var checkpoint *backfillCheckpoint
+	var ranges map[topicPartition]replayRange
+	if backfillConf.ID != "" {
+		checkpoint, err = openCheckpoint(client, kandi.conf.Kafka, backfillConf)
+		if err == nil {
+			ranges = checkpoint.ranges()
+		}
+	} else if ranges, err = offsetRanges(client, kandi.conf.Kafka); err != nil {
+		err = fmt.Errorf("unable to read the offsets to backfill to: %s", err.Error())
+	}
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	progress := newBackfillProgress(rangeOffsets(ranges))
+	if progress.Done() {
+		client.Close()
+		log.WithFields(log.Fields{"id": backfillConf.ID, "partitions": len(ranges)}).Info("Nothing to backfill")
+		return nil
+	}
+	consumer, err := NewReplayConsumer(client, ranges, progress)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	consumer.checkpoint = checkpoint
+	kandi.Consumer = consumer
+	kandi.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{progress.Observe}
+	kandi.MaxRetries = backfillConf.Progress.MaxRetries
+
+	log.WithField("id", backfillConf.ID).Debug("Starting Kandi Backfill")
+	progress.start(backfillConf.Progress)
+	publishProgress(progress)
+	kandi.Start()
+	log.WithField("id", backfillConf.ID).Info("Stopping Kandi Backfill")
+	return kandi.Err()
+}
+
+// openCheckpoint loads the checkpoint of the backfill, or creates it from the
+// current offsets when the backfill starts.
+func openCheckpoint(client offsetClient, userConfig *KafkaConfig, backfillConf *BackfillConfig) (*backfillCheckpoint, error) {
+	checkpoint, err := loadCheckpoint(backfillConf.checkpointPath())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backfill checkpoint: %s", err.Error())
+	}
+	if checkpoint != nil {
+		log.WithFields(log.Fields{"id": backfillConf.ID, "path": checkpoint.path}).Info("Resuming backfill from checkpoint")
+		return checkpoint, nil
+	}
+	ranges, err := offsetRanges(client, userConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the offsets to backfill to: %s", err.Error())
+	}
+	checkpoint = newCheckpoint(backfillConf.ID, backfillConf.checkpointPath(), ranges)
+	if err = checkpoint.save(); err != nil {
+		return nil, fmt.Errorf("unable to save backfill checkpoint: %s", err.Error())
+	}
+	log.WithFields(log.Fields{"id": backfillConf.ID, "path": checkpoint.path}).Info("Starting backfill")
+	return checkpoint, nil
+}
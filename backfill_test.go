@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type mockOffsetClient struct {
+	topics  []string
+	offsets map[topicPartition][2]int64
+	byTime  map[topicPartition]map[int64]int64
+}
+
+func (c *mockOffsetClient) Topics() ([]string, error) {
+	return c.topics, nil
+}
+
+func (c *mockOffsetClient) Partitions(topic string) ([]int32, error) {
+	partitions := []int32{}
+	for key := range c.offsets {
+		if key.topic == topic {
+			partitions = append(partitions, key.partition)
+		}
+	}
+	if len(partitions) == 0 {
+		return nil, errors.New("unknown topic " + topic)
+	}
+	return partitions, nil
+}
+
+func (c *mockOffsetClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	offsets := c.offsets[topicPartition{topic, partition}]
+	if time == sarama.OffsetOldest {
+		return offsets[0], nil
+	}
+	if time >= 0 {
+		if offset, ok := c.byTime[topicPartition{topic, partition}][time]; ok {
+			return offset, nil
+		}
+		return -1, nil
+	}
+	return offsets[1], nil
+}
+
+func Test_Current_Offsets_Are_Kept_Per_Topic_And_Partition(t *testing.T) {
+	client := &mockOffsetClient{
+		topics: []string{"metrics", "events", "metrics-web", "logs"},
+		offsets: map[topicPartition][2]int64{
+			{"metrics", 0}:     {0, 10},
+			{"metrics", 1}:     {5, 5},
+			{"events", 0}:      {0, 3},
+			{"metrics-web", 0}: {0, 1},
+			{"logs", 0}:        {0, 100},
+		},
+	}
+	conf := &KafkaConfig{Topics: "metrics, events", Cluster: cluster.NewConfig()}
+	conf.Cluster.Group.Topics.Whitelist = regexp.MustCompile("^metrics-")
+
+	ranges, err := offsetRanges(client, conf)
+
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+		return
+	}
+	actual := rangeOffsets(ranges)
+	expected := map[topicPartition]Offset{
+		{"metrics", 0}:     {false, 10},
+		{"metrics", 1}:     {true, 5},
+		{"events", 0}:      {false, 3},
+		{"metrics-web", 0}: {false, 1},
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected offsets.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
+
+func Test_Backfill_Finishes_Once_Every_Partition_Is_Caught_Up(t *testing.T) {
+	sut := newBackfillProgress(map[topicPartition]Offset{
+		{"metrics", 0}: {false, 10},
+		{"events", 0}:  {false, 3},
+		{"events", 1}:  {true, 0},
+	})
+
+	if sut.Observe([]*sarama.ConsumerMessage{{Topic: "metrics", Partition: 0, Offset: 9}, {Topic: "metrics", Partition: 1, Offset: 2}}) {
+		t.Error("Expected backfill to wait for partition 0 of events")
+	}
+	if sut.Observe([]*sarama.ConsumerMessage{{Topic: "events", Partition: 0, Offset: 1}}) {
+		t.Error("Expected backfill to wait for the last message of partition 0 of events")
+	}
+	if !sut.Observe([]*sarama.ConsumerMessage{nil, {Topic: "events", Partition: 0, Offset: 2}}) {
+		t.Error("Expected backfill to finish")
+	}
+}
+
+func Test_Backfill_Of_Empty_Partitions_Is_Done(t *testing.T) {
+	if !newBackfillProgress(map[topicPartition]Offset{{"metrics", 0}: {true, 0}}).Done() {
+		t.Error("Expected backfill of empty partitions to be done")
+	}
+}
+
+func Test_Backfill_Reports_Progress_Per_Partition(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	sut := newBackfillProgress(map[topicPartition]Offset{
+		{"metrics", 0}: {false, 201},
+		{"metrics", 1}: {false, 11},
+		{"events", 0}:  {true, 0},
+	})
+	sut.now = func() time.Time { return now }
+	sut.written = func() int64 { return 500 }
+	sut.start(ProgressConfig{})
+
+	sut.Observe([]*sarama.ConsumerMessage{{Topic: "metrics", Partition: 0, Offset: 0}, {Topic: "metrics", Partition: 1, Offset: 0}})
+	now = now.Add(10 * time.Second)
+	sut.written = func() int64 { return 800 }
+	sut.Observe([]*sarama.ConsumerMessage{{Topic: "metrics", Partition: 0, Offset: 50}, {Topic: "metrics", Partition: 1, Offset: 10}})
+
+	actual := sut.report(now)
+	expected := &backfillReport{
+		Partitions: []partitionProgress{
+			{Topic: "events", Partition: 0, Offset: -1, Target: -1, Finished: true},
+			{Topic: "metrics", Partition: 0, Offset: 50, Target: 200, ETA: "30s"},
+			{Topic: "metrics", Partition: 1, Offset: 10, Target: 10, Finished: true},
+		},
+		Finished:      2,
+		PointsWritten: 300,
+		ETA:           "30s",
+	}
+	actualJson, _ := json.Marshal(actual)
+	expectedJson, _ := json.Marshal(expected)
+	if string(actualJson) != string(expectedJson) {
+		t.Error(fmt.Sprintf("Unexpected report.\n\texpected: %s\n\tactual: %s", expectedJson, actualJson))
+	}
+}
+
+var BackfillThrottleTestCases = []struct {
+	label    string
+	maxRate  float64
+	written  int64
+	elapsed  time.Duration
+	expected time.Duration
+}{
+	{"unlimited", 0, 1000, time.Second, 0},
+	{"below rate", 1000, 500, time.Second, 0},
+	{"above rate", 1000, 3000, time.Second, 2 * time.Second},
+}
+
+func Test_Backfill_Throttles_Points_Written(t *testing.T) {
+	for _, testCase := range BackfillThrottleTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+			var written int64 = 100
+			var slept time.Duration
+			sut := newBackfillProgress(map[topicPartition]Offset{{"metrics", 0}: {false, 100000}})
+			sut.now = func() time.Time { return now }
+			sut.written = func() int64 { return written }
+			sut.sleep = func(duration time.Duration) { slept += duration }
+			sut.start(ProgressConfig{MaxRate: testCase.maxRate})
+
+			now = now.Add(testCase.elapsed)
+			written += testCase.written
+			sut.Observe([]*sarama.ConsumerMessage{{Topic: "metrics", Partition: 0, Offset: 0}})
+
+			if slept != testCase.expected {
+				t.Error(fmt.Sprintf("Expected to wait %s but waited %s", testCase.expected, slept))
+			}
+		})
+	}
+}
+
+var BackfillArgsTestCases = []struct {
+	label    string
+	args     []string
+	expected *BackfillConfig
+}{
+	{"defaults", []string{}, &BackfillConfig{CheckpointDir: ".", Progress: ProgressConfig{ReportInterval: 30 * time.Second, MaxRetries: 10}}},
+	{"throttled", []string{"--max-rate", "2500", "--report-interval", "5s", "-max-retries", "3"}, &BackfillConfig{CheckpointDir: ".", Progress: ProgressConfig{MaxRate: 2500, ReportInterval: 5 * time.Second, MaxRetries: 3}}},
+	{"resumable", []string{"-id", "restore-2018-06", "-checkpoint-dir", "/var/lib/kandi"}, &BackfillConfig{ID: "restore-2018-06", CheckpointDir: "/var/lib/kandi", Progress: ProgressConfig{ReportInterval: 30 * time.Second, MaxRetries: 10}}},
+	{"negative rate", []string{"-max-rate", "-1"}, nil},
+	{"id escaping the checkpoint directory", []string{"-id", "../restore"}, nil},
+}
+
+func Test_Backfill_Args(t *testing.T) {
+	for _, testCase := range BackfillArgsTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := parseBackfillArgs(testCase.args, &bytes.Buffer{})
+
+			if testCase.expected == nil {
+				if err == nil {
+					t.Error(fmt.Sprintf("Expected an error but got %+v", actual))
+				}
+			} else if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if *actual != *testCase.expected {
+				t.Error(fmt.Sprintf("Unexpected configuration.\n\texpected: %+v\n\tactual: %+v", testCase.expected, actual))
+			}
+		})
+	}
+}
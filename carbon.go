@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CarbonConfig writes to the Graphite plaintext protocol listener at Address.
+// Format tagged (default) writes tags as Graphite 1.1 series tags, path puts
+// the sorted tag values in the path ahead of the measurement and field.
+// Prefix, when set, starts every path.
+type CarbonConfig struct {
+	Address string
+	Prefix  string
+	Format  string
+	Timeout time.Duration
+}
+
+func NewCarbonConfig(entry map[string]interface{}) *CarbonConfig {
+	conf := &CarbonConfig{Format: "tagged", Timeout: 5 * time.Second}
+	if value, ok := entry["address"].(string); ok {
+		conf.Address = value
+	}
+	if value, ok := entry["prefix"].(string); ok {
+		conf.Prefix = strings.Trim(value, ".")
+	}
+	if value, ok := entry["format"].(string); ok {
+		conf.Format = strings.ToLower(value)
+	}
+	if value, ok := entry["timeout"].(int); ok {
+		conf.Timeout = time.Duration(value) * time.Millisecond
+	}
+	return conf
+}
+
+// CarbonSink keeps a connection open to the listener and reconnects on the
+// next write once it failed.
+type CarbonSink struct {
+	config *CarbonConfig
+	lock   sync.Mutex
+	conn   net.Conn
+}
+
+func NewCarbonSink(config *CarbonConfig) (*CarbonSink, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("graphite sink requires an address")
+	}
+	if config.Format != "tagged" && config.Format != "path" {
+		return nil, fmt.Errorf("unknown graphite format %s", config.Format)
+	}
+	return &CarbonSink{config: config}, nil
+}
+
+func carbonElement(value string) string {
+	return sanitize(value, func(c rune) bool {
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+	})
+}
+
+func carbonTag(value string) string {
+	return sanitize(value, func(c rune) bool {
+		return c > ' ' && c != ';' && c != '~' && c != '=' && c != '!' && c != '^'
+	})
+}
+
+// lines returns the plaintext lines of the metrics.
+func (s *CarbonSink) lines(metrics []sinkMetric) []byte {
+	lines := &bytes.Buffer{}
+	for _, metric := range metrics {
+		elements := []string{}
+		if s.config.Prefix != "" {
+			elements = append(elements, s.config.Prefix)
+		}
+		if s.config.Format == "path" {
+			for _, key := range metric.sortedTagKeys() {
+				elements = append(elements, carbonElement(metric.tags[key]))
+			}
+		}
+		elements = append(elements, carbonElement(metric.name))
+		if metric.field != "value" {
+			elements = append(elements, carbonElement(metric.field))
+		}
+		lines.WriteString(strings.Join(elements, "."))
+		if s.config.Format == "tagged" {
+			for _, key := range metric.sortedTagKeys() {
+				lines.WriteString(";" + carbonTag(key) + "=" + carbonTag(metric.tags[key]))
+			}
+		}
+		fmt.Fprintf(lines, " %s %d\n", strconv.FormatFloat(metric.value, 'f', -1, 64), metric.time.Unix())
+	}
+	return lines.Bytes()
+}
+
+func (s *CarbonSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.config.Address, s.config.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *CarbonSink) Write(batch influx.BatchPoints) error {
+	metrics := sinkMetrics(batch.Points())
+	if len(metrics) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.connect(); err != nil {
+		MetricsSinkWriteFailure.Add("graphite", 1)
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	if _, err := s.conn.Write(s.lines(metrics)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		MetricsSinkWriteFailure.Add("graphite", 1)
+		return err
+	}
+	MetricsSinkValuesWritten.Add("graphite", int64(len(metrics)))
+	return nil
+}
+
+// Health connects to the listener unless connected already.
+func (s *CarbonSink) Health() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connect()
+}
+
+func (s *CarbonSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CardinalityConfig bounds the number of series a measurement may write in a
+// window. Past the limit, points of new series are dropped, or with the
+// rewrite action have their most diverse tag set to OverflowValue so they
+// collapse into a single series.
+type CardinalityConfig struct {
+	Limit         int
+	Window        time.Duration
+	Action        string
+	OverflowValue string
+}
+
+func NewCardinalityConfig(entry map[string]interface{}) *CardinalityConfig {
+	conf := &CardinalityConfig{Window: time.Hour, Action: "drop", OverflowValue: "overflow"}
+	if value, ok := entry["limit"].(int); ok {
+		conf.Limit = value
+	}
+	if value, ok := entry["window"].(int); ok {
+		conf.Window = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["action"].(string); ok {
+		conf.Action = strings.ToLower(value)
+	}
+	if value, ok := entry["overflowvalue"].(string); ok {
+		conf.OverflowValue = value
+	}
+	return conf
+}
+
+// cardinalityBucket holds the series and tag values seen for one measurement
+// in half a window. Every set stops growing at the limit so memory stays
+// bounded whatever producers send.
+type cardinalityBucket struct {
+	series    map[string]struct{}
+	tagValues map[string]map[string]struct{}
+}
+
+func newCardinalityBucket() *cardinalityBucket {
+	return &cardinalityBucket{series: make(map[string]struct{}), tagValues: make(map[string]map[string]struct{})}
+}
+
+// measurementCardinality slides over the window with two buckets, counting
+// the series seen in either. A series counts against the limit until between
+// half a window and a window after it was last seen.
+type measurementCardinality struct {
+	current  *cardinalityBucket
+	previous *cardinalityBucket
+	count    int
+	exceeded bool
+}
+
+func (m *measurementCardinality) observe(tags map[string]string, limit int) {
+	for key, value := range tags {
+		values, ok := m.current.tagValues[key]
+		if !ok {
+			if len(m.current.tagValues) > limit {
+				continue
+			}
+			values = make(map[string]struct{})
+			m.current.tagValues[key] = values
+		}
+		if len(values) <= limit {
+			values[value] = struct{}{}
+		}
+	}
+}
+
+// admit records the series and reports whether it is within the limit.
+func (m *measurementCardinality) admit(key string, limit int) bool {
+	if _, ok := m.current.series[key]; ok {
+		return true
+	}
+	if _, ok := m.previous.series[key]; !ok {
+		if m.count >= limit {
+			return false
+		}
+		m.count++
+	}
+	m.current.series[key] = struct{}{}
+	return true
+}
+
+// distinctValues returns the number of values of the tag key in the window.
+func (m *measurementCardinality) distinctValues(key string) int {
+	count := len(m.current.tagValues[key])
+	for value := range m.previous.tagValues[key] {
+		if _, ok := m.current.tagValues[key][value]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// topTagKeys returns the tag keys with the most distinct values, most diverse
+// first.
+func (m *measurementCardinality) topTagKeys(count int) []string {
+	distinct := make(map[string]int)
+	for _, bucket := range []*cardinalityBucket{m.current, m.previous} {
+		for key := range bucket.tagValues {
+			distinct[key] = m.distinctValues(key)
+		}
+	}
+	keys := make([]string, 0, len(distinct))
+	for key := range distinct {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if distinct[keys[i]] != distinct[keys[j]] {
+			return distinct[keys[i]] > distinct[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// CardinalityLimiter tracks series per measurement over a sliding window and
+// limits the points of measurements exceeding the configured limit.
+// Measurements unseen for a window are forgotten.
+type CardinalityLimiter struct {
+	config       *CardinalityConfig
+	bucketStart  time.Time
+	measurements map[string]*measurementCardinality
+	now          func() time.Time
+}
+
+func NewCardinalityLimiter(config *CardinalityConfig) *CardinalityLimiter {
+	return &CardinalityLimiter{config: config, measurements: make(map[string]*measurementCardinality), now: time.Now}
+}
+
+func (l *CardinalityLimiter) measurement(name string) *measurementCardinality {
+	m, ok := l.measurements[name]
+	if !ok {
+		m = &measurementCardinality{current: newCardinalityBucket(), previous: newCardinalityBucket()}
+		l.measurements[name] = m
+	}
+	return m
+}
+
+// slide starts a new bucket every half window, dropping the measurements
+// that have nothing left to count.
+func (l *CardinalityLimiter) slide(now time.Time) {
+	elapsed := now.Sub(l.bucketStart)
+	if elapsed < l.config.Window/2 {
+		return
+	}
+	l.bucketStart = now
+	for name, m := range l.measurements {
+		if elapsed >= l.config.Window || len(m.current.series) == 0 && len(m.current.tagValues) == 0 {
+			delete(l.measurements, name)
+			continue
+		}
+		m.previous, m.current = m.current, newCardinalityBucket()
+		m.count = len(m.previous.series)
+		m.exceeded = false
+	}
+}
+
+func (l *CardinalityLimiter) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	l.slide(l.now())
+	limited := points[:0]
+	for _, point := range points {
+		name, tags := point.Name(), point.Tags()
+		m := l.measurement(name)
+		m.observe(tags, l.config.Limit)
+		if m.admit(SeriesKey(name, tags), l.config.Limit) {
+			limited = append(limited, point)
+			continue
+		}
+		if !m.exceeded {
+			m.exceeded = true
+			MetricsCardinalityExceeded.Add(name, 1)
+			log.WithFields(log.Fields{"measurement": name, "limit": l.config.Limit, "topTagKeys": m.topTagKeys(3)}).Warn("Series cardinality limit exceeded")
+		}
+		MetricsCardinalityLimited.Add(name, 1)
+		if l.config.Action == "rewrite" {
+			if rewritten := l.rewrite(point, m, tags); rewritten != nil {
+				limited = append(limited, rewritten)
+			}
+		}
+	}
+	return limited
+}
+
+// rewrite sets the most diverse tag of the point to the overflow value, or
+// returns nil when the point has no tag to rewrite.
+func (l *CardinalityLimiter) rewrite(point *influx.Point, m *measurementCardinality, tags map[string]string) *influx.Point {
+	for _, key := range m.topTagKeys(len(m.current.tagValues) + len(m.previous.tagValues)) {
+		if _, ok := tags[key]; !ok {
+			continue
+		}
+		tags[key] = l.config.OverflowValue
+		fields, err := point.Fields()
+		if err != nil {
+			return nil
+		}
+		rewritten, err := influx.NewPoint(point.Name(), tags, fields, point.Time())
+		if err != nil {
+			return nil
+		}
+		return rewritten
+	}
+	return nil
+}
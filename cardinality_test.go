@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+func cardinalityPoints(measurement string, requests int) []*influx.Point {
+	points := []*influx.Point{}
+	for i := 0; i < requests; i++ {
+		point, _ := influx.NewPoint(measurement, map[string]string{"host": "web01", "request_id": fmt.Sprint(i)}, map[string]interface{}{"value": 1.0}, time.Unix(1501096898, 0))
+		points = append(points, point)
+	}
+	return points
+}
+
+func Test_Cardinality_Limiter_Drops_New_Series_Over_Limit(t *testing.T) {
+	sut := NewCardinalityLimiter(&CardinalityConfig{Limit: 2, Window: time.Hour, Action: "drop"})
+	actual := pointStrings(sut.Apply(cardinalityPoints("drop_requests", 4), &sarama.ConsumerMessage{}))
+	expected := []string{
+		"drop_requests,host=web01,request_id=0 value=1 1501096898000000000",
+		"drop_requests,host=web01,request_id=1 value=1 1501096898000000000",
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+	if exceeded := MetricsCardinalityExceeded.Get("drop_requests").String(); exceeded != "1" {
+		t.Error(fmt.Sprintf("Expected a single alert but found %s", exceeded))
+	}
+	if limited := MetricsCardinalityLimited.Get("drop_requests").String(); limited != "2" {
+		t.Error(fmt.Sprintf("Expected 2 limited points but found %s", limited))
+	}
+
+	known := pointStrings(sut.Apply(cardinalityPoints("drop_requests", 1), &sarama.ConsumerMessage{}))
+	if len(known) != 1 {
+		t.Error(fmt.Sprintf("Expected points of known series to be kept but found %v", known))
+	}
+}
+
+func Test_Cardinality_Limiter_Rewrites_Most_Diverse_Tag(t *testing.T) {
+	sut := NewCardinalityLimiter(&CardinalityConfig{Limit: 2, Window: time.Hour, Action: "rewrite", OverflowValue: "overflow"})
+	actual := pointStrings(sut.Apply(cardinalityPoints("rewrite_requests", 4), &sarama.ConsumerMessage{}))
+	expected := []string{
+		"rewrite_requests,host=web01,request_id=0 value=1 1501096898000000000",
+		"rewrite_requests,host=web01,request_id=1 value=1 1501096898000000000",
+		"rewrite_requests,host=web01,request_id=overflow value=1 1501096898000000000",
+		"rewrite_requests,host=web01,request_id=overflow value=1 1501096898000000000",
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
+
+func Test_Cardinality_Limiter_Resets_With_Window(t *testing.T) {
+	now := time.Unix(1501096898, 0)
+	sut := NewCardinalityLimiter(&CardinalityConfig{Limit: 1, Window: time.Minute, Action: "drop"})
+	sut.now = func() time.Time { return now }
+	if actual := sut.Apply(cardinalityPoints("window_requests", 2), &sarama.ConsumerMessage{}); len(actual) != 1 {
+		t.Error(fmt.Sprintf("Expected 1 point in the first window but found %d", len(actual)))
+	}
+	now = now.Add(time.Minute)
+	if actual := sut.Apply(cardinalityPoints("window_requests", 2)[1:], &sarama.ConsumerMessage{}); len(actual) != 1 {
+		t.Error(fmt.Sprintf("Expected new series to be accepted in the next window but found %d points", len(actual)))
+	}
+}
+
+func Test_Cardinality_Limiter_Slides_With_Window(t *testing.T) {
+	now := time.Unix(1501096898, 0)
+	sut := NewCardinalityLimiter(&CardinalityConfig{Limit: 1, Window: time.Minute, Action: "drop"})
+	sut.now = func() time.Time { return now }
+	requests := cardinalityPoints("sliding_requests", 2)
+	steps := []struct {
+		elapsed  time.Duration
+		point    *influx.Point
+		accepted bool
+	}{
+		{0, requests[0], true},
+		{40 * time.Second, requests[1], false},
+		{40 * time.Second, requests[0], true},
+		{80 * time.Second, requests[1], false},
+		{150 * time.Second, requests[1], true},
+	}
+	for _, step := range steps {
+		now = time.Unix(1501096898, 0).Add(step.elapsed)
+		if actual := sut.Apply([]*influx.Point{step.point}, &sarama.ConsumerMessage{}); (len(actual) == 1) != step.accepted {
+			t.Error(fmt.Sprintf("Expected %s at %v to be accepted: %v", step.point, step.elapsed, step.accepted))
+		}
+	}
+}
+
+func Test_Cardinality_Limiter_Forgets_Idle_Measurements(t *testing.T) {
+	now := time.Unix(1501096898, 0)
+	sut := NewCardinalityLimiter(&CardinalityConfig{Limit: 10, Window: time.Minute, Action: "drop"})
+	sut.now = func() time.Time { return now }
+	sut.Apply(cardinalityPoints("idle_requests", 3), &sarama.ConsumerMessage{})
+	now = now.Add(40 * time.Second)
+	sut.Apply(cardinalityPoints("busy_requests", 3), &sarama.ConsumerMessage{})
+	now = now.Add(40 * time.Second)
+	sut.Apply(cardinalityPoints("busy_requests", 1), &sarama.ConsumerMessage{})
+
+	if _, ok := sut.measurements["idle_requests"]; ok || len(sut.measurements) != 1 {
+		t.Error(fmt.Sprintf("Expected only the busy measurement to be tracked but found %v", sut.measurements))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+type checkpointPartition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Next      int64  `json:"next"`
+	End       int64  `json:"end"`
+}
+
+// backfillCheckpoint records, per partition, the offset a backfill stops
+// before and the next offset it has yet to write. The ends are fixed when the
+// backfill is first started so a resumed backfill keeps its original target.
+type backfillCheckpoint struct {
+	lock       sync.Mutex
+	path       string
+	ID         string                `json:"id"`
+	Partitions []checkpointPartition `json:"partitions"`
+}
+
+func newCheckpoint(id string, path string, ranges map[topicPartition]replayRange) *backfillCheckpoint {
+	checkpoint := &backfillCheckpoint{path: path, ID: id, Partitions: []checkpointPartition{}}
+	for key, offsetRange := range ranges {
+		checkpoint.Partitions = append(checkpoint.Partitions, checkpointPartition{key.topic, key.partition, offsetRange.start, offsetRange.end})
+	}
+	sort.Slice(checkpoint.Partitions, func(i, j int) bool {
+		if checkpoint.Partitions[i].Topic != checkpoint.Partitions[j].Topic {
+			return checkpoint.Partitions[i].Topic < checkpoint.Partitions[j].Topic
+		}
+		return checkpoint.Partitions[i].Partition < checkpoint.Partitions[j].Partition
+	})
+	return checkpoint
+}
+
+// loadCheckpoint reads the checkpoint at path, or returns nil when there is
+// none yet.
+func loadCheckpoint(path string) (*backfillCheckpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &backfillCheckpoint{path: path}
+	if err = json.Unmarshal(content, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// ranges returns the offsets left to backfill.
+func (c *backfillCheckpoint) ranges() map[topicPartition]replayRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ranges := make(map[topicPartition]replayRange)
+	for _, partition := range c.Partitions {
+		ranges[topicPartition{partition.Topic, partition.Partition}] = replayRange{partition.Next, partition.End}
+	}
+	return ranges
+}
+
+// mark advances the partitions past the written messages and saves the
+// checkpoint.
+func (c *backfillCheckpoint) mark(messages []*sarama.ConsumerMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, message := range messages {
+		if message == nil {
+			continue
+		}
+		for i := range c.Partitions {
+			partition := &c.Partitions[i]
+			if partition.Topic == message.Topic && partition.Partition == message.Partition && message.Offset >= partition.Next {
+				partition.Next = message.Offset + 1
+			}
+		}
+	}
+	return c.save()
+}
+
+func (c *backfillCheckpoint) save() error {
+	return saveJson(c.path, c)
+}
+
+// saveJson replaces the file at once so a process dying while saving leaves
+// the previous content intact.
+func saveJson(path string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
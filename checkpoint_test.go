@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Checkpoint_Resumes_From_Marked_Offsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kandi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backfill-restore.json")
+
+	checkpoint := newCheckpoint("restore", path, map[topicPartition]replayRange{
+		{"metrics", 0}: {0, 100},
+		{"metrics", 1}: {20, 50},
+		{"events", 0}:  {5, 5},
+	})
+	if err = checkpoint.save(); err != nil {
+		t.Fatal(err)
+	}
+	err = checkpoint.mark([]*sarama.ConsumerMessage{nil, {Topic: "metrics", Partition: 0, Offset: 41}, {Topic: "metrics", Partition: 0, Offset: 40}, {Topic: "events", Partition: 1, Offset: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := loadCheckpoint(path)
+
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+		return
+	}
+	if actual.ID != "restore" {
+		t.Error(fmt.Sprintf("Expected checkpoint restore but got %s", actual.ID))
+	}
+	expected := map[topicPartition]replayRange{
+		{"metrics", 0}: {42, 100},
+		{"metrics", 1}: {20, 50},
+		{"events", 0}:  {5, 5},
+	}
+	if fmt.Sprint(actual.ranges()) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected ranges.\n\texpected: %v\n\tactual: %v", expected, actual.ranges()))
+	}
+}
+
+func Test_Missing_Checkpoint_Is_Not_An_Error(t *testing.T) {
+	actual, err := loadCheckpoint(filepath.Join(os.TempDir(), "kandi-missing-checkpoint.json"))
+
+	if actual != nil || err != nil {
+		t.Error(fmt.Sprintf("Expected no checkpoint but got %v, %v", actual, err))
+	}
+}
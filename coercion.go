@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FieldType declares the type a field of a measurement is written with. Type
+// is one of float, integer, string or boolean, as reported by SHOW FIELD KEYS.
+type FieldType struct {
+	Measurement string
+	Field       string
+	Type        string
+}
+
+// CoercionConfig declares field types and whether to learn the types already
+// stored in the target databases at startup. Declared types win over learned
+// ones.
+type CoercionConfig struct {
+	Learn  bool
+	Fields []*FieldType
+}
+
+func NewCoercionConfig(entry map[string]interface{}) *CoercionConfig {
+	conf := &CoercionConfig{}
+	if value, ok := entry["learn"].(bool); ok {
+		conf.Learn = value
+	}
+	if value, ok := entry["fields"].([]interface{}); ok {
+		for _, field := range value {
+			declared := lowerKeys(field)
+			fieldType := &FieldType{}
+			if value, ok := declared["measurement"].(string); ok {
+				fieldType.Measurement = value
+			}
+			if value, ok := declared["field"].(string); ok {
+				fieldType.Field = value
+			}
+			if value, ok := declared["type"].(string); ok {
+				fieldType.Type = strings.ToLower(value)
+			}
+			conf.Fields = append(conf.Fields, fieldType)
+		}
+	}
+	return conf
+}
+
+// Coercion converts field values to the type their field is known with.
+// Fields missing from the schema are learned from the first value seen, the
+// same way Influx fixes the type of a field on its first write. Values that
+// cannot be converted drop their field, and points left without fields are
+// dropped.
+type Coercion struct {
+	schema map[string]map[string]string
+}
+
+func NewCoercion() *Coercion {
+	return &Coercion{schema: make(map[string]map[string]string)}
+}
+
+// Learn records the type of a field, replacing any type already known.
+func (c *Coercion) Learn(measurement string, field string, fieldType string) {
+	fields, ok := c.schema[measurement]
+	if !ok {
+		fields = make(map[string]string)
+		c.schema[measurement] = fields
+	}
+	fields[field] = fieldType
+}
+
+func (c *Coercion) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	coerced := points[:0]
+	for _, point := range points {
+		if point = c.coerce(point); point != nil {
+			coerced = append(coerced, point)
+		}
+	}
+	return coerced
+}
+
+func (c *Coercion) coerce(point *influx.Point) *influx.Point {
+	fields, err := point.Fields()
+	if err != nil {
+		return point
+	}
+	name := point.Name()
+	changed := false
+	for field, value := range fields {
+		expected, ok := c.schema[name][field]
+		if !ok {
+			if actual := fieldTypeOf(value); actual != "" {
+				c.Learn(name, field, actual)
+			}
+			continue
+		}
+		if fieldTypeOf(value) == expected {
+			continue
+		}
+		changed = true
+		converted, err := coerceValue(value, expected)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"measurement": name, "field": field}).Debug("Dropping field that cannot be coerced")
+			MetricsFieldUnconvertible.Add(name, 1)
+			delete(fields, field)
+			continue
+		}
+		MetricsFieldCoerced.Add(name, 1)
+		fields[field] = converted
+	}
+	if !changed {
+		return point
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	rewritten, err := influx.NewPoint(name, point.Tags(), fields, point.Time())
+	if err != nil {
+		return nil
+	}
+	return rewritten
+}
+
+func fieldTypeOf(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "float"
+	case int64:
+		return "integer"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	return ""
+}
+
+func coerceValue(value interface{}, expected string) (interface{}, error) {
+	switch expected {
+	case "float":
+		switch typed := value.(type) {
+		case int64:
+			return float64(typed), nil
+		case string:
+			return strconv.ParseFloat(typed, 64)
+		case bool:
+			if typed {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+	case "integer":
+		switch typed := value.(type) {
+		case float64:
+			if typed != math.Trunc(typed) || typed >= 1<<63 || typed < math.MinInt64 {
+				return nil, fmt.Errorf("%v is not a whole number", typed)
+			}
+			return int64(typed), nil
+		case string:
+			return strconv.ParseInt(typed, 10, 64)
+		case bool:
+			if typed {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case "string":
+		return fmt.Sprint(value), nil
+	case "boolean":
+		switch typed := value.(type) {
+		case float64:
+			if typed == 0 || typed == 1 {
+				return typed == 1, nil
+			}
+		case int64:
+			if typed == 0 || typed == 1 {
+				return typed == 1, nil
+			}
+		case string:
+			return strconv.ParseBool(typed)
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %v to %s", value, expected)
+}
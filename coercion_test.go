@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+var CoercionTestCases = []struct {
+	label    string
+	fields   map[string]interface{}
+	expected []string
+}{
+	{
+		"Should Keep Values Of The Expected Type",
+		map[string]interface{}{"value": 1.5, "count": int64(2), "state": "up", "ok": true},
+		[]string{`coerce count=2i,ok=true,state="up",value=1.5 1501096898000000000`},
+	},
+	{
+		"Should Convert Integer To Float And Float To Integer",
+		map[string]interface{}{"value": int64(1), "count": 2.0},
+		[]string{"coerce count=2i,value=1 1501096898000000000"},
+	},
+	{
+		"Should Convert Strings And Numbers",
+		map[string]interface{}{"value": "1.5", "count": "3", "state": int64(4), "ok": int64(0)},
+		[]string{`coerce count=3i,ok=false,state="4",value=1.5 1501096898000000000`},
+	},
+	{
+		"Should Drop Unconvertible Field",
+		map[string]interface{}{"value": 1.5, "count": 2.5},
+		[]string{"coerce value=1.5 1501096898000000000"},
+	},
+	{
+		"Should Drop Float Outside The Integer Range",
+		map[string]interface{}{"value": 1.5, "count": 9223372036854775808.0},
+		[]string{"coerce value=1.5 1501096898000000000"},
+	},
+	{
+		"Should Convert Float At The Integer Minimum",
+		map[string]interface{}{"count": -9223372036854775808.0},
+		[]string{"coerce count=-9223372036854775808i 1501096898000000000"},
+	},
+	{
+		"Should Drop Point Without Convertible Fields",
+		map[string]interface{}{"count": "many"},
+		[]string{},
+	},
+}
+
+func newTestCoercion() *Coercion {
+	sut := NewCoercion()
+	sut.Learn("coerce", "value", "float")
+	sut.Learn("coerce", "count", "integer")
+	sut.Learn("coerce", "state", "string")
+	sut.Learn("coerce", "ok", "boolean")
+	return sut
+}
+
+func Test_Coercion(t *testing.T) {
+	for _, testCase := range CoercionTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			point, _ := influx.NewPoint("coerce", nil, testCase.fields, time.Unix(1501096898, 0))
+			actual := pointStrings(newTestCoercion().Apply([]*influx.Point{point}, &sarama.ConsumerMessage{}))
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Coercion_Learns_Unknown_Fields_From_First_Value(t *testing.T) {
+	sut := NewCoercion()
+	first, _ := influx.NewPoint("learned", nil, map[string]interface{}{"value": 1.5}, time.Unix(1501096898, 0))
+	second, _ := influx.NewPoint("learned", nil, map[string]interface{}{"value": int64(2)}, time.Unix(1501096899, 0))
+
+	actual := pointStrings(sut.Apply([]*influx.Point{first, second}, &sarama.ConsumerMessage{}))
+
+	expected := []string{"learned value=1.5 1501096898000000000", "learned value=2 1501096899000000000"}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
@@ -2,19 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
 	"github.com/google/uuid"
+	influx "github.com/influxdata/influxdb/client/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"io/ioutil"
 	saramaLog "log"
 	"os"
+	"regexp"
 	"strings"
 	"time"
-	"crypto/x509"
-	"crypto/tls"
 )
 
 type Batch struct {
@@ -29,14 +31,30 @@ type Backoff struct {
 }
 
 type KandiConfig struct {
-	Backoff *Backoff
-	Batch   *Batch
+	Backoff     *Backoff
+	Batch       *Batch
+	Statsd      *StatsdConfig
+	Otlp        *OtlpConfig
+	Json        *JsonConfig
+	Graphite    *GraphiteConfig
+	Timestamp   *TimestampConfig
+	Validation  *ValidationConfig
+	Filters     []*FilterConfig
+	Transforms  []*TransformConfig
+	Cardinality *CardinalityConfig
+	Coercion    *CoercionConfig
+	Downsample  *DownsampleConfig
+	Dedup       *DedupConfig
+	Scripts     []*ScriptConfig
+	Enrich      []*EnrichConfig
+	Archive     *ArchiveConfig
 }
 
 type Config struct {
 	Kandi  *KandiConfig
 	Kafka  *KafkaConfig
 	Influx *InfluxConfig
+	Sink   *SinkConfig
 }
 
 func load(input []byte) *Config {
@@ -47,7 +65,7 @@ func load(input []byte) *Config {
 	if err != nil {
 		log.WithError(err).Error("Unable to read configuration at provided path.")
 	}
-	return &Config{NewKandiConfig(), NewKafkaConfig(), NewInfluxConfig()}
+	return &Config{NewKandiConfig(), NewKafkaConfig(), NewInfluxConfig(), NewSinkConfig(lowerKeys(viper.Get("sink")))}
 }
 
 func NewConfig() *Config {
@@ -66,7 +84,7 @@ func NewConfig() *Config {
 }
 
 func NewKandiConfig() *KandiConfig {
-	conf := &KandiConfig{&Backoff{}, &Batch{}}
+	conf := &KandiConfig{Backoff: &Backoff{}, Batch: &Batch{}, Statsd: &StatsdConfig{FlushInterval: 10 * time.Second, Percentiles: []float64{90}, GaugeExpiry: 6}}
 	if value, ok := viper.Get("kandi.backoff.max").(int); ok {
 		conf.Backoff.Max = time.Duration(value) * time.Millisecond
 	}
@@ -82,6 +100,62 @@ func NewKandiConfig() *KandiConfig {
 	if value, ok := viper.Get("kandi.batch.duration").(int); ok {
 		conf.Batch.Duration = time.Duration(value) * time.Millisecond
 	}
+	if value, ok := viper.Get("kandi.statsd.flushInterval").(int); ok {
+		conf.Statsd.FlushInterval = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := viper.Get("kandi.statsd.gaugeExpiry").(int); ok {
+		conf.Statsd.GaugeExpiry = value
+	}
+	if value, ok := viper.Get("kandi.statsd.percentiles").([]interface{}); ok {
+		conf.Statsd.Percentiles = []float64{}
+		for _, percentile := range value {
+			switch percentile := percentile.(type) {
+			case int:
+				conf.Statsd.Percentiles = append(conf.Statsd.Percentiles, float64(percentile))
+			case float64:
+				conf.Statsd.Percentiles = append(conf.Statsd.Percentiles, percentile)
+			}
+		}
+	}
+	conf.Otlp = NewOtlpConfig(lowerKeys(viper.Get("kandi.otlp")))
+	conf.Json = NewJsonConfig(lowerKeys(viper.Get("kandi.json")))
+	conf.Graphite = NewGraphiteConfig(lowerKeys(viper.Get("kandi.graphite")))
+	conf.Timestamp = NewTimestampConfig(lowerKeys(viper.Get("kandi.timestamp")))
+	conf.Validation = &ValidationConfig{}
+	if value, ok := viper.Get("kandi.validation.maxPast").(int); ok {
+		conf.Validation.MaxPast = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := viper.Get("kandi.validation.maxFuture").(int); ok {
+		conf.Validation.MaxFuture = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := viper.Get("kandi.validation.correctPrecision").(bool); ok {
+		conf.Validation.CorrectPrecision = value
+	}
+	conf.Cardinality = NewCardinalityConfig(lowerKeys(viper.Get("kandi.cardinality")))
+	conf.Dedup = NewDedupConfig(lowerKeys(viper.Get("kandi.dedup")))
+	conf.Downsample = NewDownsampleConfig(lowerKeys(viper.Get("kandi.downsample")))
+	conf.Coercion = NewCoercionConfig(lowerKeys(viper.Get("kandi.coercion")))
+	conf.Archive = NewArchiveConfig(lowerKeys(viper.Get("kandi.archive")))
+	if value, ok := viper.Get("kandi.enrich").([]interface{}); ok {
+		for _, entry := range value {
+			conf.Enrich = append(conf.Enrich, NewEnrichConfig(lowerKeys(entry)))
+		}
+	}
+	if value, ok := viper.Get("kandi.filters").([]interface{}); ok {
+		for _, entry := range value {
+			conf.Filters = append(conf.Filters, NewFilterConfig(lowerKeys(entry)))
+		}
+	}
+	if value, ok := viper.Get("kandi.scripts").([]interface{}); ok {
+		for _, entry := range value {
+			conf.Scripts = append(conf.Scripts, NewScriptConfig(lowerKeys(entry)))
+		}
+	}
+	if value, ok := viper.Get("kandi.transforms").([]interface{}); ok {
+		for _, entry := range value {
+			conf.Transforms = append(conf.Transforms, NewTransformConfig(lowerKeys(entry)))
+		}
+	}
 	if value, ok := viper.Get("kandi.loglevel").(string); ok {
 		switch strings.ToLower(value) {
 		case "debug":
@@ -109,7 +183,7 @@ func NewKandiConfig() *KandiConfig {
 }
 
 func NewInfluxConfig() *InfluxConfig {
-	conf := &InfluxConfig{}
+	conf := &InfluxConfig{Protocol: "http", PayloadSize: influx.UDPPayloadSize}
 	if value, ok := viper.Get("influx.url").(string); ok {
 		conf.Url = value
 	}
@@ -137,6 +211,12 @@ func NewInfluxConfig() *InfluxConfig {
 	if value, ok := viper.Get("influx.retentionPolicy").(string); ok {
 		conf.RetentionPolicy = value
 	}
+	if value, ok := viper.Get("influx.protocol").(string); ok {
+		conf.Protocol = strings.ToLower(value)
+	}
+	if value, ok := viper.Get("influx.payloadSize").(int); ok && value > 0 {
+		conf.PayloadSize = value
+	}
 	return conf
 }
 
@@ -152,8 +232,46 @@ func NewKafkaConfig() *KafkaConfig {
 			sarama.Logger = saramaLog.New(os.Stdout, "[Sarama] ", saramaLog.LstdFlags)
 		}
 	}
-	if value, ok := viper.Get("kafka.topics").(string); ok {
+	switch value := viper.Get("kafka.topics").(type) {
+	case string:
 		conf.Topics = value
+	case []interface{}:
+		names := []string{}
+		for _, entry := range value {
+			topic := NewTopicConfig(entry)
+			if topic.Name == "" {
+				log.WithField("topic", entry).Error("Ignoring topic configured without a name")
+				continue
+			}
+			conf.TopicConfigs = append(conf.TopicConfigs, topic)
+			names = append(names, topic.Name)
+		}
+		conf.Topics = strings.Join(names, ",")
+	}
+	if value, ok := viper.Get("kafka.topicPattern").(string); ok && value != "" {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			log.WithError(err).WithField("topicPattern", value).Error("Invalid topic pattern")
+			panic(fmt.Sprintf("Invalid topic pattern %s: %s", value, err.Error()))
+		}
+		conf.TopicPattern = value
+		conf.Cluster.Group.Topics.Whitelist = pattern
+		conf.Cluster.Metadata.Full = true
+	}
+	if value, ok := viper.Get("kafka.format").(string); ok {
+		conf.Format = strings.ToLower(value)
+	} else {
+		conf.Format = "line"
+	}
+	if value, ok := viper.Get("kafka.payloadCompression").(string); ok {
+		conf.PayloadCompression = strings.ToLower(value)
+	}
+	conf.MaxPayloadSize = defaultMaxPayloadSize
+	if value, ok := viper.Get("kafka.maxPayloadSize").(int); ok {
+		conf.MaxPayloadSize = int64(value)
+	}
+	if value, ok := viper.Get("kafka.deadLetter.topic").(string); ok {
+		conf.DeadLetterTopic = value
 	}
 	if value, ok := viper.Get("kafka.consumerGroup").(string); ok {
 		conf.ConsumerGroup = value
@@ -277,7 +395,7 @@ func NewKafkaConfig() *KafkaConfig {
 				caCertPool := x509.NewCertPool()
 				caCertPool.AppendCertsFromPEM([]byte(caCert))
 				tlsConfig := &tls.Config{
-					RootCAs:      caCertPool,
+					RootCAs:            caCertPool,
 					InsecureSkipVerify: true,
 				}
 				conf.Cluster.Net.TLS.Config = tlsConfig
@@ -290,4 +408,4 @@ func NewKafkaConfig() *KafkaConfig {
 	conf.Cluster.Consumer.Return.Errors = true
 	conf.Cluster.Group.Return.Notifications = true
 	return &conf
-}
\ No newline at end of file
+}
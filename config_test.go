@@ -6,6 +6,7 @@ import (
 	"github.com/bsm/sarama-cluster"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,6 +27,8 @@ influx:
   Precision: test-precision
   RetentionPolicy: mypolicy
   WriteConsistency: anywrite
+  Protocol: HTTP
+  PayloadSize: 1400
 
 kandi:
   backoff:
@@ -35,12 +38,89 @@ kandi:
   batch:
     size: 4
     duration: 5
+  statsd:
+    flushInterval: 6
+    percentiles: [50, 99.9]
+    gaugeExpiry: 3
+  otlp:
+    encoding: JSON
+  timestamp:
+    source: Header
+    header: produced-at
+    headerFormat: rfc3339
+  validation:
+    maxPast: 604800000
+    maxFuture: 600000
+    correctPrecision: true
+  cardinality:
+    limit: 1000
+    window: 60000
+    action: Rewrite
+  dedup:
+    key: Header
+    header: message-id
+    window: 300000
+    maxEntries: 1000
+  downsample:
+    window: 60000
+    allowedLateness: 5000
+    aggregates: [Mean, Max]
+  coercion:
+    learn: true
+    fields:
+      - measurement: CPU
+        field: usageIdle
+        type: Float
+  enrich:
+    - source: Topic
+    - source: header
+      header: X-Producer
+      as: Field
+      name: producer
+  filters:
+    - name: no-test
+      measurement: test_*
+    - action: include
+      tagValues:
+        env: /^(prod|staging)$/
+  scripts:
+    - name: ratio
+      source: set field ratio = field.errors / field.requests if field.requests > 0
+      timeout: 5
+      onError: Drop
+  transforms:
+    - measurement: cpu*
+      renameTags:
+        host: hostname
+      dropTagsMatching: [^tmp_]
+      mapTags:
+        region:
+          us-west-2: usw2
+      topicTag: source_topic
+  archive:
+    directory: /var/lib/kandi/archive
+    content: Messages
+    maxSize: 1048576
+    maxAge: 600000
+    s3:
+      endpoint: http://localhost:9000/
+      bucket: metrics-archive
+      prefix: /kandi/
+      accessKey: test-access-key
+      secretKey: test-secret-key
+      sessionToken: test-session-token
   loglevel: debug
 
 kafka:
   brokers: test-url:9092
   topics: test-topics
+  topicPattern: ^metrics-.*
+  format: StatsD
   consumerGroup: test-consumer-group
+  deadLetter:
+    topic: test-dead-letter
+  payloadCompression: Gzip
+  maxPayloadSize: 1048576
   loggingEnabled: true
   consumer:
     offsets:
@@ -181,6 +261,162 @@ var KandiConfigConfigTests = []struct {
 			}
 		},
 	},
+	{
+		"kandi.Statsd.FlushInterval",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Statsd.FlushInterval
+			if actual != time.Duration(6)*time.Millisecond {
+				t.Error(fmt.Sprintf("%s expected to be %s but found %s", label, time.Duration(6)*time.Millisecond, actual))
+			}
+		},
+	},
+	{
+		"kandi.Statsd.GaugeExpiry",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Statsd.GaugeExpiry
+			if actual != 3 {
+				t.Error(fmt.Sprintf("%s expected to be 3 but found %d", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Statsd.Percentiles",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Statsd.Percentiles
+			if len(actual) != 2 || actual[0] != 50 || actual[1] != 99.9 {
+				t.Error(fmt.Sprintf("%s expected to be [50 99.9] but found %v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Otlp.Encoding",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Otlp.Encoding
+			if actual != "json" {
+				t.Error(fmt.Sprintf("%s expected to be json but found %s", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Timestamp",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Timestamp
+			if actual.Source != "header" || actual.Header != "produced-at" || actual.HeaderFormat != "rfc3339" {
+				t.Error(fmt.Sprintf("%s expected to be header produced-at rfc3339 but found %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Validation",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Validation
+			if actual.MaxPast != 7*24*time.Hour || actual.MaxFuture != 10*time.Minute || !actual.CorrectPrecision {
+				t.Error(fmt.Sprintf("%s expected to be 168h 10m true but found %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Cardinality",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Cardinality
+			if actual.Limit != 1000 || actual.Window != time.Minute || actual.Action != "rewrite" || actual.OverflowValue != "overflow" {
+				t.Error(fmt.Sprintf("%s expected to be 1000 1m rewrite overflow but found %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Dedup",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Dedup
+			if *actual != (DedupConfig{"header", "message-id", 5 * time.Minute, 1000}) {
+				t.Error(fmt.Sprintf("%s expected to be header message-id 5m 1000 but found %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Archive",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Archive
+			if actual.Directory != "/var/lib/kandi/archive" || actual.Content != "messages" || actual.MaxSize != 1048576 || actual.MaxAge != 10*time.Minute {
+				t.Error(fmt.Sprintf("%s expected to be /var/lib/kandi/archive messages 1048576 10m but found %+v", label, actual))
+			}
+			if *actual.S3 != (S3Config{"http://localhost:9000", "us-east-1", "metrics-archive", "kandi", "test-access-key", "test-secret-key", "test-session-token"}) {
+				t.Error(fmt.Sprintf("%s s3 was not loaded as expected: %+v", label, actual.S3))
+			}
+		},
+	},
+	{
+		"kandi.Downsample",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Downsample
+			if actual.Window != time.Minute || actual.AllowedLateness != 5*time.Second || fmt.Sprint(actual.Aggregates) != "[mean max]" {
+				t.Error(fmt.Sprintf("%s expected to be 1m 5s [mean max] but found %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Coercion",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			actual := toTest.Coercion
+			if !actual.Learn || len(actual.Fields) != 1 || *actual.Fields[0] != (FieldType{"CPU", "usageIdle", "float"}) {
+				t.Error(fmt.Sprintf("%s was not loaded as expected: %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Enrich",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			if len(toTest.Enrich) != 2 {
+				t.Error(fmt.Sprintf("%s expected 2 entries but found %d", label, len(toTest.Enrich)))
+				return
+			}
+			if *toTest.Enrich[0] != (EnrichConfig{"topic", "", "tag", ""}) || *toTest.Enrich[1] != (EnrichConfig{"header", "X-Producer", "field", "producer"}) {
+				t.Error(fmt.Sprintf("%s was not loaded as expected: %+v %+v", label, toTest.Enrich[0], toTest.Enrich[1]))
+			}
+		},
+	},
+	{
+		"kandi.Filters",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			if len(toTest.Filters) != 2 {
+				t.Error(fmt.Sprintf("%s expected 2 rules but found %d", label, len(toTest.Filters)))
+				return
+			}
+			exclude, include := toTest.Filters[0], toTest.Filters[1]
+			if exclude.Name != "no-test" || exclude.Action != "exclude" || exclude.Measurement != "test_*" {
+				t.Error(fmt.Sprintf("%s[0] was not loaded as expected: %+v", label, exclude))
+			}
+			if include.Action != "include" || include.TagValues["env"] != "/^(prod|staging)$/" {
+				t.Error(fmt.Sprintf("%s[1] was not loaded as expected: %+v", label, include))
+			}
+		},
+	},
+	{
+		"kandi.Scripts",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			if len(toTest.Scripts) != 1 {
+				t.Error(fmt.Sprintf("%s expected 1 script but found %d", label, len(toTest.Scripts)))
+				return
+			}
+			actual := toTest.Scripts[0]
+			if actual.Name != "ratio" || !strings.HasPrefix(actual.Source, "set field ratio") || actual.Timeout != 5*time.Millisecond || actual.OnError != "drop" {
+				t.Error(fmt.Sprintf("%s was not loaded as expected: %+v", label, actual))
+			}
+		},
+	},
+	{
+		"kandi.Transforms",
+		func(toTest *KandiConfig, label string, t *testing.T) {
+			if len(toTest.Transforms) != 1 {
+				t.Error(fmt.Sprintf("%s expected 1 rule but found %d", label, len(toTest.Transforms)))
+				return
+			}
+			actual := toTest.Transforms[0]
+			if actual.Measurement != "cpu*" || actual.RenameTags["host"] != "hostname" || fmt.Sprint(actual.DropTagsMatching) != "[^tmp_]" || actual.MapTags["region"]["us-west-2"] != "usw2" || actual.TopicTag != "source_topic" {
+				t.Error(fmt.Sprintf("%s was not loaded as expected: %+v", label, actual))
+			}
+		},
+	},
 	{
 		"kandi.loglevel",
 		func(toTest *KandiConfig, label string, t *testing.T) {
@@ -277,6 +513,24 @@ var InfluxConfigTests = []struct {
 			}
 		},
 	},
+	{
+		"influx.Protocol",
+		func(toTest *InfluxConfig, label string, t *testing.T) {
+			actual := toTest.Protocol
+			if actual != "http" {
+				t.Error(fmt.Sprintf("%s expected to be http but found %s", label, actual))
+			}
+		},
+	},
+	{
+		"influx.PayloadSize",
+		func(toTest *InfluxConfig, label string, t *testing.T) {
+			actual := toTest.PayloadSize
+			if actual != 1400 {
+				t.Error(fmt.Sprintf("%s expected to be 1400 but found %d", label, actual))
+			}
+		},
+	},
 }
 
 var KafkaConfigTests = []struct {
@@ -301,6 +555,15 @@ var KafkaConfigTests = []struct {
 			}
 		},
 	},
+	{
+		"kafka.Format",
+		func(toTest *KafkaConfig, label string, t *testing.T) {
+			actual := toTest.Format
+			if actual != "statsd" {
+				t.Error(fmt.Sprintf("%s expected to be statsd but found %s", label, actual))
+			}
+		},
+	},
 	{
 		"kafka.Cluster.ConsumerGroup",
 		func(toTest *KafkaConfig, label string, t *testing.T) {
@@ -310,6 +573,32 @@ var KafkaConfigTests = []struct {
 			}
 		},
 	},
+	{
+		"kafka.TopicPattern",
+		func(toTest *KafkaConfig, label string, t *testing.T) {
+			whitelist := toTest.Cluster.Group.Topics.Whitelist
+			if toTest.TopicPattern != "^metrics-.*" || whitelist == nil || !whitelist.MatchString("metrics-billing") || !toTest.Cluster.Metadata.Full {
+				t.Error(fmt.Sprintf("%s expected to subscribe to ^metrics-.* but found %s", label, toTest.TopicPattern))
+			}
+		},
+	},
+	{
+		"kafka.PayloadCompression",
+		func(toTest *KafkaConfig, label string, t *testing.T) {
+			if toTest.PayloadCompression != "gzip" || toTest.MaxPayloadSize != 1048576 {
+				t.Error(fmt.Sprintf("%s expected to be gzip 1048576 but found %s %d", label, toTest.PayloadCompression, toTest.MaxPayloadSize))
+			}
+		},
+	},
+	{
+		"kafka.DeadLetterTopic",
+		func(toTest *KafkaConfig, label string, t *testing.T) {
+			actual := toTest.DeadLetterTopic
+			if actual != "test-dead-letter" {
+				t.Error(fmt.Sprintf("%s expected to be test-dead-letter but found %s", label, actual))
+			}
+		},
+	},
 	{
 		"kafka.Cluster.LoggingEnabled",
 		func(toTest *KafkaConfig, label string, t *testing.T) {
@@ -584,3 +873,109 @@ func Test_environment_override(t *testing.T) {
 		test.removeEnv()
 	}
 }
+
+var TestTopicsConfig = []byte(`
+kafka:
+  format: line
+  topics:
+    - name: metrics-line
+    - name: metrics-json
+      format: JSON
+      precision: s
+      timestamp:
+        source: createTime
+      database: jsondb
+      retentionPolicy: weekly
+      tags:
+        source: json
+      json:
+        measurementKey: name
+        timeKey: time
+        timeFormat: unix
+        tagKeys: [host]
+    - name: metrics-graphite
+      format: graphite
+      graphite:
+        templates:
+          - servers.* .host.measurement*
+`)
+
+func Test_KafkaConfig_Topics_List_Is_Properly_Loaded(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	sut := load(TestTopicsConfig)
+	if sut.Kafka.Topics != "metrics-line,metrics-json,metrics-graphite" {
+		t.Error(fmt.Sprintf("kafka.Topics expected to be metrics-line,metrics-json,metrics-graphite but found %s", sut.Kafka.Topics))
+	}
+	if len(sut.Kafka.TopicConfigs) != 3 {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs expected 3 topics but found %d", len(sut.Kafka.TopicConfigs)))
+		return
+	}
+	line := sut.Kafka.TopicConfigs[0].resolve(sut)
+	if line.Format != "line" || line.Json != sut.Kandi.Json {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs[0] expected to inherit global settings but found %+v", line))
+	}
+	json := sut.Kafka.TopicConfigs[1]
+	if json.Format != "json" || json.Precision != "s" || json.Database != "jsondb" || json.RetentionPolicy != "weekly" || json.Tags["source"] != "json" {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs[1] was not loaded as expected: %+v", json))
+	}
+	if json.Timestamp == nil || json.Timestamp.Source != "createtime" {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs[1].Timestamp was not loaded as expected: %+v", json.Timestamp))
+	}
+	if json.Json.MeasurementKey != "name" || json.Json.TimeKey != "time" || json.Json.TimeFormat != "unix" || len(json.Json.TagKeys) != 1 {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs[1].Json was not loaded as expected: %+v", json.Json))
+	}
+	graphite := sut.Kafka.TopicConfigs[2]
+	if graphite.Format != "graphite" || len(graphite.Graphite.Templates) != 1 || graphite.Graphite.Separator != "." {
+		t.Error(fmt.Sprintf("kafka.TopicConfigs[2] was not loaded as expected: %+v", graphite.Graphite))
+	}
+}
+
+func Test_KafkaConfig_Invalid_Topic_Pattern_Fails(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	defer func() {
+		if recover() == nil {
+			t.Error("kafka.TopicPattern expected an invalid pattern to fail")
+		}
+	}()
+	load([]byte(`
+kafka:
+  brokers: test-url:9092
+  topicPattern: metrics-(
+`))
+}
+
+var TestSinkConfig = []byte(`
+sink:
+  type: Graphite
+  graphite:
+    address: carbon:2003
+    prefix: kandi
+    format: path
+    timeout: 2000
+  prometheus:
+    url: http://prometheus:9090/api/v1/write
+  republish:
+    topic: metrics-normalized
+    format: JSON
+`)
+
+func Test_SinkConfig_Is_Properly_Loaded(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	sut := load(TestSinkConfig)
+	if sut.Sink.Type != "graphite" {
+		t.Error(fmt.Sprintf("sink.Type expected to be graphite but found %s", sut.Sink.Type))
+	}
+	graphite := sut.Sink.Graphite
+	if graphite.Address != "carbon:2003" || graphite.Prefix != "kandi" || graphite.Format != "path" || graphite.Timeout != 2*time.Second {
+		t.Error(fmt.Sprintf("sink.Graphite not properly loaded: %+v", graphite))
+	}
+	if sut.Sink.Prometheus.Url != "http://prometheus:9090/api/v1/write" || sut.Sink.Prometheus.Timeout != 5*time.Second {
+		t.Error(fmt.Sprintf("sink.Prometheus not properly loaded: %+v", sut.Sink.Prometheus))
+	}
+	if sut.Sink.Republish.Topic != "metrics-normalized" || sut.Sink.Republish.Format != "json" {
+		t.Error(fmt.Sprintf("sink.Republish not properly loaded: %+v", sut.Sink.Republish))
+	}
+	if load(TestConfig).Sink.Type != "influx" {
+		t.Error("sink.Type expected to default to influx")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DeadLetter receives points that were rejected by a stage so they can be
+// inspected and replayed instead of being lost.
+type DeadLetter interface {
+	Send(point *influx.Point, message *sarama.ConsumerMessage, reason string)
+}
+
+// KafkaDeadLetter produces rejected points as line protocol to a topic. The
+// reason and the source record are carried in headers. Sending is best effort:
+// points are handed to an asynchronous producer, or dropped when its buffer is
+// full, and failures are logged and counted but never hold up the processing
+// path.
+type KafkaDeadLetter struct {
+	userConfig *KafkaConfig
+	lock       sync.Mutex
+	producer   sarama.AsyncProducer
+	done       sync.WaitGroup
+}
+
+func NewKafkaDeadLetter(userConfig *KafkaConfig) *KafkaDeadLetter {
+	return &KafkaDeadLetter{userConfig: userConfig}
+}
+
+func (d *KafkaDeadLetter) connect() (sarama.AsyncProducer, error) {
+	if d.producer != nil {
+		return d.producer, nil
+	}
+	config := d.userConfig.Cluster.Config
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	producer, err := sarama.NewAsyncProducer(strings.Split(d.userConfig.Brokers, ","), &config)
+	if err != nil {
+		return nil, err
+	}
+	d.use(producer)
+	return producer, nil
+}
+
+// use starts counting the outcomes of the producer until it is closed.
+func (d *KafkaDeadLetter) use(producer sarama.AsyncProducer) {
+	d.producer = producer
+	d.done.Add(2)
+	go func() {
+		defer d.done.Done()
+		for range producer.Successes() {
+			MetricsDeadLetterSent.Add(1)
+		}
+	}()
+	go func() {
+		defer d.done.Done()
+		for err := range producer.Errors() {
+			log.WithError(err.Err).WithField("topic", d.userConfig.DeadLetterTopic).Error("Failed to send point to dead letter topic")
+			MetricsDeadLetterFailure.Add(1)
+		}
+	}()
+}
+
+func (d *KafkaDeadLetter) Send(point *influx.Point, message *sarama.ConsumerMessage, reason string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	producer, err := d.connect()
+	if err != nil {
+		log.WithError(err).Error("Unable to create dead letter producer")
+		MetricsDeadLetterFailure.Add(1)
+		return
+	}
+	deadLetter := &sarama.ProducerMessage{
+		Topic:   d.userConfig.DeadLetterTopic,
+		Value:   sarama.StringEncoder(point.String()),
+		Headers: []sarama.RecordHeader{{Key: []byte("reason"), Value: []byte(reason)}},
+	}
+	// Points emitted by aggregation stages have no single source record.
+	if message != nil {
+		deadLetter.Headers = append(deadLetter.Headers,
+			sarama.RecordHeader{Key: []byte("topic"), Value: []byte(message.Topic)},
+			sarama.RecordHeader{Key: []byte("partition"), Value: []byte(strconv.Itoa(int(message.Partition)))},
+			sarama.RecordHeader{Key: []byte("offset"), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		)
+	}
+	select {
+	case producer.Input() <- deadLetter:
+	default:
+		log.WithField("topic", d.userConfig.DeadLetterTopic).Warn("Dead letter producer is full, dropping point")
+		MetricsDeadLetterFailure.Add(1)
+	}
+}
+
+// Close waits for the points handed to the producer to be sent.
+func (d *KafkaDeadLetter) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.producer != nil {
+		d.producer.AsyncClose()
+		d.done.Wait()
+		d.producer = nil
+	}
+}
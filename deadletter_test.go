@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+// mockAsyncProducer buffers a single input that the test acknowledges.
+type mockAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newMockAsyncProducer() *mockAsyncProducer {
+	return &mockAsyncProducer{make(chan *sarama.ProducerMessage, 1), make(chan *sarama.ProducerMessage), make(chan *sarama.ProducerError)}
+}
+
+func (p *mockAsyncProducer) AsyncClose() {
+	close(p.successes)
+	close(p.errors)
+}
+
+func (p *mockAsyncProducer) Close() error {
+	p.AsyncClose()
+	return nil
+}
+
+func (p *mockAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *mockAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *mockAsyncProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func Test_Dead_Letter_Never_Blocks_Processing(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	producer := newMockAsyncProducer()
+	sut := NewKafkaDeadLetter(&KafkaConfig{DeadLetterTopic: "rejected"})
+	sut.use(producer)
+	point, _ := influx.NewPoint("cpu", nil, map[string]interface{}{"value": 1.0}, time.Unix(1, 0))
+	sentBefore, failedBefore := MetricsDeadLetterSent.Value(), MetricsDeadLetterFailure.Value()
+
+	sent := make(chan bool)
+	go func() {
+		sut.Send(point, &sarama.ConsumerMessage{Topic: "metrics", Partition: 2, Offset: 7}, "too old")
+		sut.Send(point, nil, "too old")
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Expected sending to a full producer not to block")
+	}
+
+	message := <-producer.input
+	headers := map[string]string{}
+	for _, header := range message.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if message.Topic != "rejected" || fmt.Sprint(headers) != "map[offset:7 partition:2 reason:too old topic:metrics]" {
+		t.Error(fmt.Sprintf("Unexpected dead letter %s %v", message.Topic, headers))
+	}
+	producer.successes <- message
+	producer.errors <- &sarama.ProducerError{Msg: message, Err: errors.New("not enough replicas")}
+	sut.Close()
+
+	if MetricsDeadLetterSent.Value()-sentBefore != 1 || MetricsDeadLetterFailure.Value()-failedBefore != 2 {
+		t.Error(fmt.Sprintf("Expected 1 point sent and 2 failed but found %d and %d", MetricsDeadLetterSent.Value()-sentBefore, MetricsDeadLetterFailure.Value()-failedBefore))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"io"
+	"io/ioutil"
+)
+
+// Payload compression is applied by producers to the message value itself,
+// independently of the codec Kafka compresses record batches with. It is
+// one of none, gzip, snappy, lz4, zstd or auto, which recognises gzip, framed
+// snappy, lz4 frames and zstd by their magic bytes and leaves anything else
+// untouched. Raw snappy blocks carry no magic and must be configured.
+
+const defaultMaxPayloadSize = 64 * 1024 * 1024
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	lz4Magic    = []byte{0x04, 0x22, 0x4d, 0x18}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var errPayloadTooLarge = errors.New("decompressed payload exceeds the configured maximum size")
+
+func detectCompression(payload []byte) string {
+	switch {
+	case bytes.HasPrefix(payload, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(payload, snappyMagic):
+		return "snappy"
+	case bytes.HasPrefix(payload, lz4Magic):
+		return "lz4"
+	case bytes.HasPrefix(payload, zstdMagic):
+		return "zstd"
+	}
+	return "none"
+}
+
+// decompressPayload returns the payload decompressed with the compression,
+// failing rather than allocating more than limit bytes.
+func decompressPayload(payload []byte, compression string, limit int64) ([]byte, error) {
+	if compression == "auto" {
+		compression = detectCompression(payload)
+	}
+	switch compression {
+	case "", "none":
+		return payload, nil
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readLimited(reader, limit)
+	case "snappy":
+		if bytes.HasPrefix(payload, snappyMagic) {
+			return readLimited(snappy.NewReader(bytes.NewReader(payload)), limit)
+		}
+		length, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if int64(length) > limit {
+			return nil, errPayloadTooLarge
+		}
+		return snappy.Decode(nil, payload)
+	case "lz4":
+		return readLimited(lz4.NewReader(bytes.NewReader(payload)), limit)
+	case "zstd":
+		// A single goroutine decodes in step with the reads, so the limit
+		// bounds the work done as well.
+		reader, err := zstd.NewReader(bytes.NewReader(payload), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		decompressed, err := readLimited(reader, limit)
+		if err != nil || len(decompressed) > 0 {
+			return decompressed, err
+		}
+		// The stream decoder ends quietly at a truncated frame header, so an
+		// empty result is checked by decoding the whole frame.
+		if _, err := reader.DecodeAll(payload, nil); err != nil {
+			return nil, err
+		}
+		return decompressed, nil
+	}
+	return nil, fmt.Errorf("unknown payload compression %s", compression)
+}
+
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decompressed)) > limit {
+		return nil, errPayloadTooLarge
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"testing"
+)
+
+var payload = []byte("cpu value=1 1501096898000000000\ncpu value=2 1501096899000000000")
+
+func gzipped(value []byte) []byte {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	writer.Write(value)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func framedSnappy(value []byte) []byte {
+	buffer := &bytes.Buffer{}
+	writer := snappy.NewBufferedWriter(buffer)
+	writer.Write(value)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func lz4Frame(value []byte) []byte {
+	buffer := &bytes.Buffer{}
+	writer := lz4.NewWriter(buffer)
+	writer.Write(value)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func zstdFrame(value []byte) []byte {
+	buffer := &bytes.Buffer{}
+	writer, _ := zstd.NewWriter(buffer)
+	writer.Write(value)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+var DecompressTestCases = []struct {
+	label         string
+	compression   string
+	input         []byte
+	limit         int64
+	expectedError bool
+}{
+	{"Should Pass Through Uncompressed Payload", "none", payload, 1024, false},
+	{"Should Decompress Gzip", "gzip", gzipped(payload), 1024, false},
+	{"Should Decompress Snappy Block", "snappy", snappy.Encode(nil, payload), 1024, false},
+	{"Should Decompress Framed Snappy", "snappy", framedSnappy(payload), 1024, false},
+	{"Should Decompress Lz4 Frame", "lz4", lz4Frame(payload), 1024, false},
+	{"Should Decompress Zstd Frame", "zstd", zstdFrame(payload), 1024, false},
+	{"Should Detect Gzip", "auto", gzipped(payload), 1024, false},
+	{"Should Detect Framed Snappy", "auto", framedSnappy(payload), 1024, false},
+	{"Should Detect Lz4", "auto", lz4Frame(payload), 1024, false},
+	{"Should Detect Zstd", "auto", zstdFrame(payload), 1024, false},
+	{"Should Leave Plain Payload When Detecting", "auto", payload, 1024, false},
+	{"Should Reject Gzip Over Limit", "gzip", gzipped(payload), 16, true},
+	{"Should Reject Snappy Block Over Limit", "snappy", snappy.Encode(nil, payload), 16, true},
+	{"Should Reject Corrupt Gzip", "gzip", payload, 1024, true},
+	{"Should Reject Zstd Over Limit", "zstd", zstdFrame(payload), 16, true},
+	{"Should Reject Corrupt Zstd", "auto", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, 1024, true},
+}
+
+func Test_Decompress_Payload(t *testing.T) {
+	for _, testCase := range DecompressTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := decompressPayload(testCase.input, testCase.compression, testCase.limit)
+			if testCase.expectedError {
+				if err == nil {
+					t.Error(fmt.Sprintf("%s: expected an error", testCase.label))
+				}
+				return
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+			} else if !bytes.Equal(actual, payload) {
+				t.Error(fmt.Sprintf("%s: unexpected payload %q", testCase.label, actual))
+			}
+		})
+	}
+}
+
+func Test_Compressed_Messages_Are_Parsed(t *testing.T) {
+	conf := NewKandiTestConfig("localhost:8086", 2)
+	conf.Kafka.PayloadCompression = "auto"
+	conf.Kafka.MaxPayloadSize = 1024
+	sut := NewKandi(conf)
+
+	input := []*sarama.ConsumerMessage{{Value: gzipped(payload), Offset: 0}, {Value: []byte{0x1f, 0x8b, 0x00}, Offset: 1}}
+	prepared, _ := sut.prepare(input)
+
+	if len(prepared.batches[0].Points()) != 2 || len(prepared.commit) != 2 {
+		t.Error(fmt.Sprintf("Expected 2 points and 2 committed messages but found %d and %d", len(prepared.batches[0].Points()), len(prepared.commit)))
+	}
+}
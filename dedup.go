@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"strings"
+	"time"
+)
+
+// DedupConfig suppresses points seen within Window. Key selects what makes a
+// duplicate: point for the series and timestamp, header for the value of the
+// Header record header, or offset for the topic, partition and offset of the
+// message, which also catches redelivered points stamped with processing
+// time. At most MaxEntries keys are remembered, the oldest are forgotten first.
+type DedupConfig struct {
+	Key        string
+	Header     string
+	Window     time.Duration
+	MaxEntries int
+}
+
+func NewDedupConfig(entry map[string]interface{}) *DedupConfig {
+	conf := &DedupConfig{Key: "point", MaxEntries: 1000000}
+	if value, ok := entry["key"].(string); ok {
+		conf.Key = strings.ToLower(value)
+	}
+	if value, ok := entry["header"].(string); ok {
+		conf.Header = value
+	}
+	if value, ok := entry["window"].(int); ok {
+		conf.Window = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["maxentries"].(int); ok {
+		conf.MaxEntries = value
+	}
+	return conf
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// Dedup drops points whose key was already seen within the window.
+type Dedup struct {
+	config *DedupConfig
+	seen   map[string]time.Time
+	order  []dedupEntry
+	now    func() time.Time
+}
+
+func NewDedup(config *DedupConfig) (*Dedup, error) {
+	switch config.Key {
+	case "point", "offset":
+	case "header":
+		if config.Header == "" {
+			return nil, fmt.Errorf("dedup on header requires a header name")
+		}
+	default:
+		return nil, fmt.Errorf("unknown dedup key %s", config.Key)
+	}
+	return &Dedup{config: config, seen: make(map[string]time.Time), now: time.Now}, nil
+}
+
+func (d *Dedup) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	now := d.now()
+	d.expire(now)
+	if d.config.Key != "point" {
+		key, ok := d.messageKey(message)
+		if !ok || !d.seenBefore(key, now) {
+			return points
+		}
+		MetricsDuplicatesSuppressed.Add(int64(len(points)))
+		return points[:0]
+	}
+	unique := points[:0]
+	for _, point := range points {
+		if d.seenBefore(fmt.Sprintf("%s %d", SeriesKey(point.Name(), point.Tags()), point.UnixNano()), now) {
+			MetricsDuplicatesSuppressed.Add(1)
+			continue
+		}
+		unique = append(unique, point)
+	}
+	return unique
+}
+
+// messageKey identifies the message, or returns false when it cannot be told
+// apart, as for points flushed from a statsd window.
+func (d *Dedup) messageKey(message *sarama.ConsumerMessage) (string, bool) {
+	if message == nil {
+		return "", false
+	}
+	if d.config.Key == "offset" {
+		return fmt.Sprintf("%s/%d/%d", message.Topic, message.Partition, message.Offset), true
+	}
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == d.config.Header {
+			return string(header.Value), true
+		}
+	}
+	return "", false
+}
+
+// seenBefore reports whether the key is remembered, remembering it otherwise.
+func (d *Dedup) seenBefore(key string, now time.Time) bool {
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key, now})
+	if d.config.MaxEntries > 0 && len(d.order) > d.config.MaxEntries {
+		d.forgetOldest()
+	}
+	return false
+}
+
+func (d *Dedup) expire(now time.Time) {
+	for len(d.order) > 0 && now.Sub(d.order[0].seen) >= d.config.Window {
+		d.forgetOldest()
+	}
+}
+
+func (d *Dedup) forgetOldest() {
+	delete(d.seen, d.order[0].key)
+	d.order = d.order[1:]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+func dedupPoint(at time.Time) *influx.Point {
+	point, _ := influx.NewPoint("requests", map[string]string{"host": "web01"}, map[string]interface{}{"value": 1.0}, at)
+	return point
+}
+
+var DedupTestCases = []struct {
+	label    string
+	config   *DedupConfig
+	first    *sarama.ConsumerMessage
+	second   *sarama.ConsumerMessage
+	at       []time.Time
+	expected int
+}{
+	{
+		"Should Suppress Same Series And Timestamp",
+		&DedupConfig{Key: "point", Window: time.Minute},
+		&sarama.ConsumerMessage{Offset: 1},
+		&sarama.ConsumerMessage{Offset: 2},
+		[]time.Time{time.Unix(1501096898, 0), time.Unix(1501096898, 0)},
+		0,
+	},
+	{
+		"Should Keep Same Series At Another Timestamp",
+		&DedupConfig{Key: "point", Window: time.Minute},
+		&sarama.ConsumerMessage{Offset: 1},
+		&sarama.ConsumerMessage{Offset: 2},
+		[]time.Time{time.Unix(1501096898, 0), time.Unix(1501096899, 0)},
+		1,
+	},
+	{
+		"Should Suppress Redelivered Offset With Processing Time",
+		&DedupConfig{Key: "offset", Window: time.Minute},
+		&sarama.ConsumerMessage{Topic: "metrics", Offset: 1},
+		&sarama.ConsumerMessage{Topic: "metrics", Offset: 1},
+		[]time.Time{time.Unix(1501096898, 0), time.Unix(1501096999, 0)},
+		0,
+	},
+	{
+		"Should Suppress Repeated Message Id Header",
+		&DedupConfig{Key: "header", Header: "message-id", Window: time.Minute},
+		&sarama.ConsumerMessage{Offset: 1, Headers: []*sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("abc")}}},
+		&sarama.ConsumerMessage{Offset: 7, Headers: []*sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("abc")}}},
+		[]time.Time{time.Unix(1501096898, 0), time.Unix(1501096999, 0)},
+		0,
+	},
+	{
+		"Should Keep Messages Without Header",
+		&DedupConfig{Key: "header", Header: "message-id", Window: time.Minute},
+		&sarama.ConsumerMessage{Offset: 1},
+		&sarama.ConsumerMessage{Offset: 1},
+		[]time.Time{time.Unix(1501096898, 0), time.Unix(1501096898, 0)},
+		1,
+	},
+}
+
+func Test_Dedup(t *testing.T) {
+	for _, testCase := range DedupTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewDedup(testCase.config)
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			sut.Apply([]*influx.Point{dedupPoint(testCase.at[0])}, testCase.first)
+			actual := sut.Apply([]*influx.Point{dedupPoint(testCase.at[1])}, testCase.second)
+			if len(actual) != testCase.expected {
+				t.Error(fmt.Sprintf("%s: expected %d points but found %d", testCase.label, testCase.expected, len(actual)))
+			}
+		})
+	}
+}
+
+func Test_Dedup_Forgets_Keys_Outside_Window_And_Over_Capacity(t *testing.T) {
+	now := time.Unix(1501096898, 0)
+	sut, _ := NewDedup(&DedupConfig{Key: "point", Window: time.Minute, MaxEntries: 2})
+	sut.now = func() time.Time { return now }
+
+	sut.Apply([]*influx.Point{dedupPoint(time.Unix(1, 0)), dedupPoint(time.Unix(2, 0)), dedupPoint(time.Unix(3, 0))}, &sarama.ConsumerMessage{})
+	if actual := sut.Apply([]*influx.Point{dedupPoint(time.Unix(1, 0))}, &sarama.ConsumerMessage{}); len(actual) != 1 {
+		t.Error("Expected the oldest key to be forgotten over capacity")
+	}
+	now = now.Add(time.Minute)
+	if actual := sut.Apply([]*influx.Point{dedupPoint(time.Unix(3, 0))}, &sarama.ConsumerMessage{}); len(actual) != 1 {
+		t.Error("Expected keys to be forgotten outside of the window")
+	}
+}
+
+func Test_Dedup_Rejects_Invalid_Configuration(t *testing.T) {
+	if _, err := NewDedup(&DedupConfig{Key: "header"}); err == nil {
+		t.Error("Expected header key without header name to be rejected")
+	}
+	if _, err := NewDedup(&DedupConfig{Key: "payload"}); err == nil {
+		t.Error("Expected unknown key to be rejected")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var downsampleAggregates = []string{"mean", "min", "max", "sum", "count", "last"}
+
+// DownsampleConfig aggregates the points of a topic per series over tumbling
+// windows of Window. A window is written once the newest point of its series
+// is AllowedLateness past its end, or when no point arrived for a whole window
+// and lateness. Points older than the end of the last window of their series
+// written are dropped as late.
+type DownsampleConfig struct {
+	Window          time.Duration
+	AllowedLateness time.Duration
+	Aggregates      []string
+}
+
+func NewDownsampleConfig(entry map[string]interface{}) *DownsampleConfig {
+	conf := &DownsampleConfig{Aggregates: downsampleAggregates}
+	if value, ok := entry["window"].(int); ok {
+		conf.Window = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["allowedlateness"].(int); ok {
+		conf.AllowedLateness = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["aggregates"]; ok {
+		conf.Aggregates = nil
+		for _, aggregate := range cast.ToStringSlice(value) {
+			conf.Aggregates = append(conf.Aggregates, strings.ToLower(aggregate))
+		}
+	}
+	// A window of 0 disables downsampling, which is only meant when nothing
+	// else is configured.
+	settings := len(entry)
+	if _, ok := entry["window"]; ok {
+		settings--
+	}
+	if conf.Window < 0 || conf.Window == 0 && settings > 0 {
+		log.WithField("window", conf.Window).Error("Invalid downsample window")
+		panic(fmt.Sprintf("Invalid downsample window %s, a positive window is required", conf.Window))
+	}
+	return conf
+}
+
+type downsampleField struct {
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+	last  interface{}
+}
+
+type downsampleWindow struct {
+	series   string
+	name     string
+	tags     map[string]string
+	start    time.Time
+	fields   map[string]*downsampleField
+	messages map[*sarama.ConsumerMessage]bool
+}
+
+// downsampleSeries is the progress of a series: the newest point time seen,
+// the end of the last window written and the windows still open. Series are
+// tracked separately so that a point stamped in the future only closes the
+// windows of its own series.
+type downsampleSeries struct {
+	watermark time.Time
+	flushed   time.Time
+	open      int
+	lastAdd   time.Time
+}
+
+// Downsampler holds open windows and the messages that contributed to them. A
+// message is released once every window it contributed to has been flushed,
+// so its offset is marked only after the aggregates are written.
+type Downsampler struct {
+	config     *DownsampleConfig
+	lock       sync.Mutex
+	windows    map[string]*downsampleWindow
+	series     map[string]*downsampleSeries
+	references map[*sarama.ConsumerMessage]int
+	lastAdd    time.Time
+}
+
+func NewDownsampler(config *DownsampleConfig) *Downsampler {
+	return &Downsampler{config: config, windows: make(map[string]*downsampleWindow), series: make(map[string]*downsampleSeries), references: make(map[*sarama.ConsumerMessage]int)}
+}
+
+// Add aggregates the points into their windows. It returns false when no
+// point was accepted, in which case the message is not held.
+func (d *Downsampler) Add(points []*influx.Point, message *sarama.ConsumerMessage, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	held := false
+	for _, point := range points {
+		key := SeriesKey(point.Name(), point.Tags())
+		series, ok := d.series[key]
+		if !ok {
+			series = &downsampleSeries{}
+			d.series[key] = series
+		}
+		start := point.Time().Truncate(d.config.Window)
+		if !start.Add(d.config.Window).After(series.flushed) {
+			MetricsDownsampleLate.Add(1)
+			continue
+		}
+		fields, err := point.Fields()
+		if err != nil {
+			continue
+		}
+		window := d.window(key, series, point, start)
+		for name, value := range fields {
+			window.add(name, value)
+		}
+		if !window.messages[message] {
+			window.messages[message] = true
+			d.references[message]++
+		}
+		if point.Time().After(series.watermark) {
+			series.watermark = point.Time()
+		}
+		series.lastAdd = now
+		held = true
+	}
+	if held {
+		d.lastAdd = now
+	}
+	return held
+}
+
+func (d *Downsampler) window(key string, series *downsampleSeries, point *influx.Point, start time.Time) *downsampleWindow {
+	windowKey := key + " " + start.Format(time.RFC3339Nano)
+	window, ok := d.windows[windowKey]
+	if !ok {
+		window = &downsampleWindow{series: key, name: point.Name(), tags: point.Tags(), start: start, fields: make(map[string]*downsampleField), messages: make(map[*sarama.ConsumerMessage]bool)}
+		d.windows[windowKey] = window
+		series.open++
+	}
+	return window
+}
+
+func (w *downsampleWindow) add(name string, value interface{}) {
+	field, ok := w.fields[name]
+	if !ok {
+		field = &downsampleField{min: math.Inf(1), max: math.Inf(-1)}
+		w.fields[name] = field
+	}
+	field.last = value
+	var number float64
+	switch typed := value.(type) {
+	case float64:
+		number = typed
+	case int64:
+		number = float64(typed)
+	default:
+		return
+	}
+	field.count++
+	field.sum += number
+	field.min = math.Min(field.min, number)
+	field.max = math.Max(field.max, number)
+}
+
+// Flush returns the aggregates of the closed windows, or of every window when
+// forced or idle, along with the messages no open window depends on anymore.
+func (d *Downsampler) Flush(now time.Time, force bool) ([]*influx.Point, []*sarama.ConsumerMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	timeout := d.config.Window + d.config.AllowedLateness
+	idle := !d.lastAdd.IsZero() && now.Sub(d.lastAdd) >= timeout
+	keys := []string{}
+	for key, window := range d.windows {
+		closedBefore := d.series[window.series].watermark.Add(-d.config.AllowedLateness)
+		if force || idle || !window.start.Add(d.config.Window).After(closedBefore) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	points := []*influx.Point{}
+	released := []*sarama.ConsumerMessage{}
+	for _, key := range keys {
+		window := d.windows[key]
+		delete(d.windows, key)
+		series := d.series[window.series]
+		series.open--
+		if end := window.start.Add(d.config.Window); end.After(series.flushed) {
+			series.flushed = end
+		}
+		if point := d.aggregate(window); point != nil {
+			points = append(points, point)
+		}
+		for message := range window.messages {
+			if d.references[message]--; d.references[message] == 0 {
+				delete(d.references, message)
+				released = append(released, message)
+			}
+		}
+	}
+	// Series are forgotten once idle, like windows are written once idle.
+	for key, series := range d.series {
+		if series.open == 0 && now.Sub(series.lastAdd) >= timeout {
+			delete(d.series, key)
+		}
+	}
+	MetricsDownsamplePointsFlushed.Add(int64(len(points)))
+	return points, released
+}
+
+func (d *Downsampler) aggregate(window *downsampleWindow) *influx.Point {
+	fields := make(map[string]interface{})
+	for name, field := range window.fields {
+		for _, aggregate := range d.config.Aggregates {
+			if aggregate == "last" {
+				fields[name+"_last"] = field.last
+				continue
+			}
+			if field.count == 0 {
+				continue
+			}
+			switch aggregate {
+			case "mean":
+				fields[name+"_mean"] = field.sum / float64(field.count)
+			case "min":
+				fields[name+"_min"] = field.min
+			case "max":
+				fields[name+"_max"] = field.max
+			case "sum":
+				fields[name+"_sum"] = field.sum
+			case "count":
+				fields[name+"_count"] = field.count
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	point, err := influx.NewPoint(window.name, window.tags, fields, window.start)
+	if err != nil {
+		return nil
+	}
+	return point
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func downsamplePoint(value interface{}, at time.Time) *influx.Point {
+	point, _ := influx.NewPoint("requests", map[string]string{"host": "web01"}, map[string]interface{}{"value": value}, at)
+	return point
+}
+
+func Test_Downsampler_Aggregates_Tumbling_Windows(t *testing.T) {
+	start := time.Unix(1501096860, 0)
+	sut := NewDownsampler(&DownsampleConfig{Window: time.Minute, Aggregates: downsampleAggregates})
+	first, second, third := &sarama.ConsumerMessage{Offset: 0}, &sarama.ConsumerMessage{Offset: 1}, &sarama.ConsumerMessage{Offset: 2}
+
+	sut.Add([]*influx.Point{downsamplePoint(1.0, start), downsamplePoint(int64(3), start.Add(10*time.Second))}, first, start)
+	sut.Add([]*influx.Point{downsamplePoint(2.0, start.Add(20*time.Second))}, second, start)
+	points, released := sut.Flush(start, false)
+	if len(points) != 0 || len(released) != 0 {
+		t.Error(fmt.Sprintf("Expected open window to be held but flushed %v", pointStrings(points)))
+	}
+
+	sut.Add([]*influx.Point{downsamplePoint(5.0, start.Add(time.Minute))}, third, start)
+	points, released = sut.Flush(start, false)
+	expected := []string{"requests,host=web01 value_count=3i,value_last=2,value_max=3,value_mean=2,value_min=1,value_sum=6 1501096860000000000"}
+	if fmt.Sprint(pointStrings(points)) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", expected, pointStrings(points)))
+	}
+	if len(released) != 2 || len(sut.references) != 1 {
+		t.Error(fmt.Sprintf("Expected the messages of the closed window to be released but released %d and held %d", len(released), len(sut.references)))
+	}
+}
+
+func Test_Downsampler_Accepts_Late_Points_Within_Lateness(t *testing.T) {
+	start := time.Unix(1501096860, 0)
+	sut := NewDownsampler(&DownsampleConfig{Window: time.Minute, AllowedLateness: 30 * time.Second, Aggregates: []string{"count"}})
+
+	sut.Add([]*influx.Point{downsamplePoint(1.0, start), downsamplePoint(1.0, start.Add(70*time.Second))}, &sarama.ConsumerMessage{}, start)
+	if points, _ := sut.Flush(start, false); len(points) != 0 {
+		t.Error("Expected window within allowed lateness to stay open")
+	}
+	if !sut.Add([]*influx.Point{downsamplePoint(1.0, start.Add(50*time.Second))}, &sarama.ConsumerMessage{}, start) {
+		t.Error("Expected late point within allowed lateness to be accepted")
+	}
+
+	sut.Add([]*influx.Point{downsamplePoint(1.0, start.Add(90*time.Second))}, &sarama.ConsumerMessage{}, start)
+	points, _ := sut.Flush(start, false)
+	expected := []string{"requests,host=web01 value_count=2i 1501096860000000000"}
+	if fmt.Sprint(pointStrings(points)) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", expected, pointStrings(points)))
+	}
+	if sut.Add([]*influx.Point{downsamplePoint(1.0, start.Add(10*time.Second))}, &sarama.ConsumerMessage{}, start) {
+		t.Error("Expected point for a written window to be dropped")
+	}
+}
+
+func Test_Downsampler_Flushes_When_Idle(t *testing.T) {
+	start := time.Unix(1501096860, 0)
+	sut := NewDownsampler(&DownsampleConfig{Window: time.Minute, Aggregates: []string{"last"}})
+
+	sut.Add([]*influx.Point{downsamplePoint(1.0, start)}, &sarama.ConsumerMessage{}, start)
+	if points, _ := sut.Flush(start.Add(59*time.Second), false); len(points) != 0 {
+		t.Error("Expected window to stay open before the idle timeout")
+	}
+	if points, released := sut.Flush(start.Add(time.Minute), false); len(points) != 1 || len(released) != 1 {
+		t.Error("Expected idle window to be flushed")
+	}
+}
+
+func Test_Downsampler_Future_Point_Only_Closes_Its_Series(t *testing.T) {
+	start := time.Unix(1501096860, 0)
+	sut := NewDownsampler(&DownsampleConfig{Window: time.Minute, Aggregates: []string{"count"}})
+	future, _ := influx.NewPoint("requests", map[string]string{"host": "skewed"}, map[string]interface{}{"value": 1.0}, start.Add(24*time.Hour))
+
+	sut.Add([]*influx.Point{downsamplePoint(1.0, start)}, &sarama.ConsumerMessage{}, start)
+	sut.Add([]*influx.Point{future}, &sarama.ConsumerMessage{}, start)
+	if points, _ := sut.Flush(start, false); len(points) != 0 {
+		t.Error(fmt.Sprintf("Expected windows of other series to stay open but flushed %v", pointStrings(points)))
+	}
+	if !sut.Add([]*influx.Point{downsamplePoint(1.0, start.Add(10*time.Second))}, &sarama.ConsumerMessage{}, start) {
+		t.Error("Expected on time point of another series to be accepted")
+	}
+}
+
+func Test_Downsample_Config_Requires_A_Window(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	if conf := NewDownsampleConfig(nil); conf.Window != 0 {
+		t.Error("Expected downsampling to be disabled when not configured")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected aggregates without a window to fail")
+		}
+	}()
+	NewDownsampleConfig(map[string]interface{}{"aggregates": []interface{}{"mean"}})
+}
+
+func Test_Downsample_Offsets_Held_Until_Window_Written(t *testing.T) {
+	conf := NewKandiTestConfig("localhost:8086", 2)
+	conf.Kandi.Downsample = &DownsampleConfig{Window: time.Hour, Aggregates: downsampleAggregates}
+	sut := NewKandi(conf)
+	sut.Consumer = NewMockConsumer([]string{})
+
+	input := []*sarama.ConsumerMessage{{Value: []byte("requests value=1"), Offset: 0}, {Value: []byte("requests value=2"), Offset: 1}}
+	prepared, _ := sut.prepare(input)
+	if len(prepared.commit) != 0 || len(prepared.batches[0].Points()) != 0 {
+		t.Error("Messages in an open downsample window should not be committed or written")
+	}
+
+	points, released := sut.downsample[sut.fallback].Flush(time.Now(), true)
+	for _, message := range released {
+		sut.offsets.Done(message)
+	}
+	if len(points) != 1 || len(sut.offsets.Ready()) != 2 {
+		t.Error("Messages should be released once their window is flushed")
+	}
+}
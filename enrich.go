@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"strings"
+)
+
+// EnrichConfig attaches a piece of the Kafka record to every point. Source is
+// topic, partition, offset, key or header, the latter reading the Header
+// record header. As selects a tag or a field named Name, which defaults to
+// kafka_<source> or the header name. Offsets are best kept as fields, as a tag
+// they create a series per record.
+type EnrichConfig struct {
+	Source string
+	Header string
+	As     string
+	Name   string
+}
+
+func NewEnrichConfig(entry map[string]interface{}) *EnrichConfig {
+	conf := &EnrichConfig{As: "tag"}
+	if value, ok := entry["source"].(string); ok {
+		conf.Source = strings.ToLower(value)
+	}
+	if value, ok := entry["header"].(string); ok {
+		conf.Header = value
+	}
+	if value, ok := entry["as"].(string); ok {
+		conf.As = strings.ToLower(value)
+	}
+	if value, ok := entry["name"].(string); ok {
+		conf.Name = value
+	}
+	return conf
+}
+
+// Enrich adds Kafka record metadata to the points parsed from the record.
+// Points that do not come from a single record, like statsd aggregates, and
+// records missing the key or header are left as they are.
+type Enrich struct {
+	configs []*EnrichConfig
+}
+
+func NewEnrich(configs []*EnrichConfig) (*Enrich, error) {
+	for _, config := range configs {
+		switch config.Source {
+		case "topic", "partition", "offset", "key":
+		case "header":
+			if config.Header == "" {
+				return nil, fmt.Errorf("enrichment from a header requires a header name")
+			}
+		default:
+			return nil, fmt.Errorf("unknown enrichment source %s", config.Source)
+		}
+		if config.As != "tag" && config.As != "field" {
+			return nil, fmt.Errorf("enrichment must be added as tag or field, not %s", config.As)
+		}
+		if config.Name == "" {
+			if config.Source == "header" {
+				config.Name = config.Header
+			} else {
+				config.Name = "kafka_" + config.Source
+			}
+		}
+	}
+	return &Enrich{configs: configs}, nil
+}
+
+func (e *Enrich) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	if message == nil {
+		return points
+	}
+	tags, fields := e.metadata(message)
+	if len(tags) == 0 && len(fields) == 0 {
+		return points
+	}
+	for i, point := range points {
+		pointTags, pointFields := point.Tags(), map[string]interface{}{}
+		if existing, err := point.Fields(); err == nil {
+			pointFields = existing
+		}
+		for key, value := range tags {
+			pointTags[key] = value
+		}
+		for key, value := range fields {
+			pointFields[key] = value
+		}
+		if enriched, err := influx.NewPoint(point.Name(), pointTags, pointFields, point.Time()); err == nil {
+			points[i] = enriched
+		}
+	}
+	return points
+}
+
+func (e *Enrich) metadata(message *sarama.ConsumerMessage) (map[string]string, map[string]interface{}) {
+	tags := make(map[string]string)
+	fields := make(map[string]interface{})
+	for _, config := range e.configs {
+		var value interface{}
+		switch config.Source {
+		case "topic":
+			value = message.Topic
+		case "partition":
+			value = int64(message.Partition)
+		case "offset":
+			value = message.Offset
+		case "key":
+			if len(message.Key) > 0 {
+				value = string(message.Key)
+			}
+		case "header":
+			for _, header := range message.Headers {
+				if header != nil && string(header.Key) == config.Header {
+					value = string(header.Value)
+					break
+				}
+			}
+		}
+		if value == nil {
+			continue
+		}
+		if config.As == "field" {
+			fields[config.Name] = value
+		} else {
+			tags[config.Name] = fmt.Sprint(value)
+		}
+	}
+	return tags, fields
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+var EnrichTestCases = []struct {
+	label    string
+	configs  []*EnrichConfig
+	expected []string
+}{
+	{
+		"Should Tag Topic And Partition With Default Names",
+		[]*EnrichConfig{{Source: "topic", As: "tag"}, {Source: "partition", As: "tag"}},
+		[]string{"cpu,host=web01,kafka_partition=2,kafka_topic=metrics value=1 1501096898000000000"},
+	},
+	{
+		"Should Add Offset And Key As Fields",
+		[]*EnrichConfig{{Source: "offset", As: "field"}, {Source: "key", As: "field", Name: "record_key"}},
+		[]string{`cpu,host=web01 kafka_offset=42i,record_key="web01",value=1 1501096898000000000`},
+	},
+	{
+		"Should Tag Header And Skip Missing Header",
+		[]*EnrichConfig{{Source: "header", Header: "producer", As: "tag"}, {Source: "header", Header: "missing", As: "tag"}},
+		[]string{"cpu,host=web01,producer=billing value=1 1501096898000000000"},
+	},
+}
+
+func Test_Enrich(t *testing.T) {
+	message := &sarama.ConsumerMessage{Topic: "metrics", Partition: 2, Offset: 42, Key: []byte("web01"), Headers: []*sarama.RecordHeader{{Key: []byte("producer"), Value: []byte("billing")}}}
+	for _, testCase := range EnrichTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewEnrich(testCase.configs)
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			point, _ := influx.NewPoint("cpu", map[string]string{"host": "web01"}, map[string]interface{}{"value": 1.0}, time.Unix(1501096898, 0))
+			actual := pointStrings(sut.Apply([]*influx.Point{point}, message))
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Enrich_Leaves_Aggregated_Points_Untouched(t *testing.T) {
+	sut, _ := NewEnrich([]*EnrichConfig{{Source: "topic", As: "tag"}})
+	point, _ := influx.NewPoint("cpu", nil, map[string]interface{}{"value": 1.0}, time.Unix(1501096898, 0))
+	if actual := pointStrings(sut.Apply([]*influx.Point{point}, nil)); actual[0] != "cpu value=1 1501096898000000000" {
+		t.Error(fmt.Sprintf("Unexpected point %v", actual))
+	}
+}
+
+func Test_Enrich_Rejects_Invalid_Configuration(t *testing.T) {
+	for _, config := range []*EnrichConfig{{Source: "value", As: "tag"}, {Source: "header", As: "tag"}, {Source: "topic", As: "measurement"}} {
+		if _, err := NewEnrich([]*EnrichConfig{config}); err == nil {
+			t.Error(fmt.Sprintf("Expected %+v to be rejected", config))
+		}
+	}
+}
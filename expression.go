@@ -0,0 +1,569 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The expression language of scripts. Values are nil, float64, int64, string
+// and bool. References read the point being processed (measurement, time,
+// field.<name>, tag.<name>) and its Kafka record (kafka.topic,
+// kafka.partition, kafka.offset, kafka.key, header.<name>); names that are not
+// identifiers are written field["some-name"]. Missing references are nil.
+
+var errScriptTimeout = errors.New("script timed out")
+
+// maxScriptString caps the length of the strings a script builds, as a string
+// concatenated with itself doubles in length with every statement.
+const maxScriptString = 64 * 1024
+
+type scriptToken struct {
+	kind  string // ident, number, string, op or eof
+	text  string
+	value interface{}
+}
+
+func lexScript(line string) ([]scriptToken, error) {
+	tokens := []scriptToken{}
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#':
+			i = len(runes)
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, scriptToken{kind: "ident", text: string(runes[start:i])})
+		case unicode.IsDigit(r):
+			start := i
+			isFloat := false
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				if !unicode.IsDigit(runes[i]) {
+					isFloat = true
+				}
+				i++
+			}
+			text := string(runes[start:i])
+			token := scriptToken{kind: "number", text: text}
+			var err error
+			if isFloat {
+				token.value, err = strconv.ParseFloat(text, 64)
+			} else {
+				token.value, err = strconv.ParseInt(text, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", text)
+			}
+			tokens = append(tokens, token)
+		case r == '"':
+			value := []rune{}
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			tokens = append(tokens, scriptToken{kind: "string", text: string(value), value: string(value)})
+		default:
+			if i+1 < len(runes) {
+				if pair := string(runes[i : i+2]); pair == "==" || pair == "!=" || pair == "<=" || pair == ">=" || pair == "&&" || pair == "||" {
+					tokens = append(tokens, scriptToken{kind: "op", text: pair})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!()[]=,.", r) {
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+			tokens = append(tokens, scriptToken{kind: "op", text: string(r)})
+			i++
+		}
+	}
+	return append(tokens, scriptToken{kind: "eof"}), nil
+}
+
+// scriptEnv is the state a script runs against.
+type scriptEnv struct {
+	point    *scriptPoint
+	message  scriptMessage
+	deadline time.Time
+	steps    int
+}
+
+type scriptMessage struct {
+	topic     string
+	partition int32
+	offset    int64
+	key       string
+	headers   map[string]string
+	present   bool
+}
+
+// step fails the evaluation once the deadline of the script has passed. The
+// clock is only read every few steps to keep evaluation cheap.
+func (env *scriptEnv) step() error {
+	env.steps++
+	if env.steps%64 == 0 && time.Now().After(env.deadline) {
+		return errScriptTimeout
+	}
+	return nil
+}
+
+type scriptExpr interface {
+	eval(env *scriptEnv) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+type referenceExpr struct {
+	scope string
+	name  string
+}
+
+type unaryExpr struct {
+	op      string
+	operand scriptExpr
+}
+
+type binaryExpr struct {
+	op    string
+	left  scriptExpr
+	right scriptExpr
+}
+
+type callExpr struct {
+	name string
+	args []scriptExpr
+}
+
+type scriptParser struct {
+	tokens   []scriptToken
+	position int
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.tokens[p.position]
+}
+
+func (p *scriptParser) next() scriptToken {
+	token := p.tokens[p.position]
+	if token.kind != "eof" {
+		p.position++
+	}
+	return token
+}
+
+func (p *scriptParser) accept(text string) bool {
+	if token := p.peek(); (token.kind == "op" || token.kind == "ident") && token.text == text {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %s but found %q", text, p.peek().text)
+	}
+	return nil
+}
+
+// name reads a field or tag name, either an identifier or a string.
+func (p *scriptParser) name() (string, error) {
+	token := p.next()
+	if token.kind != "ident" && token.kind != "string" {
+		return "", fmt.Errorf("expected a name but found %q", token.text)
+	}
+	return token.text, nil
+}
+
+var scriptPrecedence = map[string]int{"||": 1, "&&": 2, "==": 3, "!=": 3, "<": 4, "<=": 4, ">": 4, ">=": 4, "+": 5, "-": 5, "*": 6, "/": 6, "%": 6}
+
+func (p *scriptParser) expression(minPrecedence int) (scriptExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		precedence, ok := scriptPrecedence[token.text]
+		if token.kind != "op" || !ok || precedence < minPrecedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.expression(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{token.text, left, right}
+	}
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	if p.accept("!") || p.accept("-") {
+		op := p.tokens[p.position-1].text
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op, operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	token := p.next()
+	switch token.kind {
+	case "number", "string":
+		return &literalExpr{token.value}, nil
+	case "op":
+		if token.text == "(" {
+			inner, err := p.expression(1)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	case "ident":
+		switch token.text {
+		case "true", "false":
+			return &literalExpr{token.text == "true"}, nil
+		case "nil":
+			return &literalExpr{nil}, nil
+		case "measurement", "time":
+			return &referenceExpr{scope: token.text}, nil
+		case "field", "tag", "header", "kafka":
+			return p.reference(token.text)
+		}
+		if p.accept("(") {
+			return p.call(token.text)
+		}
+		return nil, fmt.Errorf("unknown name %s", token.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func (p *scriptParser) reference(scope string) (scriptExpr, error) {
+	var name string
+	var err error
+	if p.accept("[") {
+		token := p.next()
+		if token.kind != "string" {
+			return nil, fmt.Errorf("expected a quoted name after %s[", scope)
+		}
+		name, err = token.text, p.expect("]")
+	} else if err = p.expect("."); err == nil {
+		name, err = p.name()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scope == "kafka" && name != "topic" && name != "partition" && name != "offset" && name != "key" {
+		return nil, fmt.Errorf("unknown kafka.%s", name)
+	}
+	return &referenceExpr{scope, name}, nil
+}
+
+var scriptFunctions = map[string]int{"float": 1, "int": 1, "string": 1, "has": 1, "lower": 1, "upper": 1, "round": 1, "abs": 1}
+
+func (p *scriptParser) call(name string) (scriptExpr, error) {
+	arity, ok := scriptFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	call := &callExpr{name: name}
+	for !p.accept(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expression(1)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	if len(call.args) != arity {
+		return nil, fmt.Errorf("%s takes %d argument(s)", name, arity)
+	}
+	return call, nil
+}
+
+func (e *literalExpr) eval(env *scriptEnv) (interface{}, error) {
+	return e.value, env.step()
+}
+
+func (e *referenceExpr) eval(env *scriptEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	switch e.scope {
+	case "measurement":
+		return env.point.name, nil
+	case "time":
+		return env.point.time.UnixNano(), nil
+	case "field":
+		return env.point.fields[e.name], nil
+	case "tag":
+		if value, ok := env.point.tags[e.name]; ok {
+			return value, nil
+		}
+	case "header":
+		if value, ok := env.message.headers[e.name]; ok {
+			return value, nil
+		}
+	case "kafka":
+		if !env.message.present {
+			return nil, nil
+		}
+		switch e.name {
+		case "topic":
+			return env.message.topic, nil
+		case "partition":
+			return int64(env.message.partition), nil
+		case "offset":
+			return env.message.offset, nil
+		case "key":
+			return env.message.key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *unaryExpr) eval(env *scriptEnv) (interface{}, error) {
+	value, err := e.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !truthy(value), nil
+	}
+	switch typed := value.(type) {
+	case int64:
+		return -typed, nil
+	case float64:
+		return -typed, nil
+	}
+	return nil, fmt.Errorf("cannot negate %v", value)
+}
+
+func (e *binaryExpr) eval(env *scriptEnv) (interface{}, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := e.right.eval(env)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := e.right.eval(env)
+		return truthy(right), err
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return scriptEqual(left, right), nil
+	case "!=":
+		return !scriptEqual(left, right), nil
+	}
+	if leftString, ok := left.(string); ok {
+		rightString, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to %v and %v", e.op, left, right)
+		}
+		switch e.op {
+		case "+":
+			if len(leftString)+len(rightString) > maxScriptString {
+				return nil, fmt.Errorf("string longer than %d bytes", maxScriptString)
+			}
+			return leftString + rightString, nil
+		case "<":
+			return leftString < rightString, nil
+		case "<=":
+			return leftString <= rightString, nil
+		case ">":
+			return leftString > rightString, nil
+		case ">=":
+			return leftString >= rightString, nil
+		}
+		return nil, fmt.Errorf("cannot apply %s to strings", e.op)
+	}
+	return arithmetic(e.op, left, right)
+}
+
+func arithmetic(op string, left interface{}, right interface{}) (interface{}, error) {
+	leftInt, leftIsInt := left.(int64)
+	rightInt, rightIsInt := right.(int64)
+	if leftIsInt && rightIsInt && op != "/" {
+		switch op {
+		case "+":
+			return leftInt + rightInt, nil
+		case "-":
+			return leftInt - rightInt, nil
+		case "*":
+			return leftInt * rightInt, nil
+		case "%":
+			if rightInt == 0 {
+				return nil, errors.New("modulo by zero")
+			}
+			return leftInt % rightInt, nil
+		}
+	}
+	leftFloat, leftOk := toFloat(left)
+	rightFloat, rightOk := toFloat(right)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("cannot apply %s to %v and %v", op, left, right)
+	}
+	switch op {
+	case "+":
+		return leftFloat + rightFloat, nil
+	case "-":
+		return leftFloat - rightFloat, nil
+	case "*":
+		return leftFloat * rightFloat, nil
+	case "/":
+		if rightFloat == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return leftFloat / rightFloat, nil
+	case "%":
+		if rightFloat == 0 {
+			return nil, errors.New("modulo by zero")
+		}
+		return math.Mod(leftFloat, rightFloat), nil
+	case "<":
+		return leftFloat < rightFloat, nil
+	case "<=":
+		return leftFloat <= rightFloat, nil
+	case ">":
+		return leftFloat > rightFloat, nil
+	case ">=":
+		return leftFloat >= rightFloat, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func (e *callExpr) eval(env *scriptEnv) (interface{}, error) {
+	value, err := e.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.name {
+	case "has":
+		return value != nil, nil
+	case "string":
+		if value == nil {
+			return nil, nil
+		}
+		return fmt.Sprint(value), nil
+	case "lower", "upper":
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string but got %v", e.name, value)
+		}
+		if e.name == "lower" {
+			return strings.ToLower(text), nil
+		}
+		return strings.ToUpper(text), nil
+	case "float":
+		if text, ok := value.(string); ok {
+			return strconv.ParseFloat(text, 64)
+		}
+		if number, ok := toFloat(value); ok {
+			return number, nil
+		}
+	case "int":
+		if text, ok := value.(string); ok {
+			return strconv.ParseInt(text, 10, 64)
+		}
+		if number, ok := toFloat(value); ok {
+			return int64(number), nil
+		}
+	case "round":
+		if number, ok := toFloat(value); ok {
+			if number < 0 {
+				return -math.Floor(-number + 0.5), nil
+			}
+			return math.Floor(number + 0.5), nil
+		}
+	case "abs":
+		if number, ok := value.(int64); ok && number < 0 {
+			return -number, nil
+		}
+		if number, ok := toFloat(value); ok {
+			return math.Abs(number), nil
+		}
+	}
+	return nil, fmt.Errorf("%s cannot convert %v", e.name, value)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case float64:
+		return typed, true
+	case int64:
+		return float64(typed), true
+	case bool:
+		if typed {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func truthy(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typed
+	case string:
+		return typed != ""
+	case int64:
+		return typed != 0
+	case float64:
+		return typed != 0
+	}
+	return true
+}
+
+func scriptEqual(left interface{}, right interface{}) bool {
+	leftFloat, leftNumber := toFloat(left)
+	rightFloat, rightNumber := toFloat(right)
+	_, leftBool := left.(bool)
+	_, rightBool := right.(bool)
+	if leftNumber && rightNumber && !leftBool && !rightBool {
+		return leftFloat == rightFloat
+	}
+	return left == right
+}
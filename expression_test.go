@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func evalExpression(source string) (interface{}, error) {
+	tokens, err := lexScript(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &scriptParser{tokens: tokens}
+	expression, err := parser.expression(1)
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+	env := &scriptEnv{
+		point: &scriptPoint{
+			name:   "requests",
+			tags:   map[string]string{"host": "web01", "region": "US-West"},
+			fields: map[string]interface{}{"count": int64(7), "errors": 2.0, "status-code": int64(500), "up": true},
+			time:   time.Unix(0, 1501096898000000000),
+		},
+		message: scriptMessage{topic: "metrics", partition: 3, offset: 42, key: "web01", headers: map[string]string{"x-env": "test"}, present: true},
+	}
+	return expression.eval(env)
+}
+
+var ExpressionTestCases = []struct {
+	label    string
+	source   string
+	expected interface{}
+}{
+	{"multiplication before addition", "1 + 2 * 3", int64(7)},
+	{"parentheses", "(1 + 2) * 3", int64(9)},
+	{"left associative subtraction", "10 - 4 - 3", int64(3)},
+	{"comparison before equality", "1 < 2 == true", true},
+	{"and before or", "true || false && false", true},
+	{"unary minus", "-2 * -3", int64(6)},
+	{"not", "!(1 > 2)", true},
+	{"integer modulo", "7 % 3", int64(1)},
+	{"float modulo", "7.5 % 2", 1.5},
+	{"division is always float", "7 / 2", 3.5},
+	{"integer and float arithmetic", "field.count + 0.5", 7.5},
+	{"booleans count as numbers", "true + 1", 2.0},
+	{"numbers equal across types", "7 == 7.0", true},
+	{"strings compare by value", `tag.host == "web01"`, true},
+	{"strings never equal numbers", `"1" == 1`, false},
+	{"string ordering", `"a" < "b"`, true},
+	{"string concatenation", `measurement + "_" + tag.host`, "requests_web01"},
+	{"missing references are nil", "field.missing", nil},
+	{"nil equals nil", "tag.missing == nil", true},
+	{"quoted names", `field["status-code"]`, int64(500)},
+	{"time in nanoseconds", "time", int64(1501096898000000000)},
+	{"kafka record", `kafka.topic + ":" + string(kafka.partition) + ":" + string(kafka.offset) + ":" + kafka.key`, "metrics:3:42:web01"},
+	{"headers", `header["x-env"]`, "test"},
+	{"and short circuits", "false && 1 / 0", false},
+	{"or short circuits", "true || 1 / 0", true},
+	{"empty strings are false", `"" || 0 || nil`, false},
+	{"has", "has(field.errors) && !has(tag.missing)", true},
+	{"lower", "lower(tag.region)", "us-west"},
+	{"upper", "upper(tag.host)", "WEB01"},
+	{"string of nil is nil", "string(field.missing)", nil},
+	{"float of string", `float("2.5") * 2`, 5.0},
+	{"int of string", `int("42") + 1`, int64(43)},
+	{"int truncates", "int(2.9)", int64(2)},
+	{"round half away from zero", "round(-2.5)", -3.0},
+	{"abs keeps integers", "abs(-3)", int64(3)},
+	{"abs of float", "abs(-1.5)", 1.5},
+	{"scientific notation", "1e3 + 1", 1001.0},
+	{"comments", "1 + 1 # two", int64(2)},
+}
+
+func Test_Expression(t *testing.T) {
+	for _, testCase := range ExpressionTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := evalExpression(testCase.source)
+
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if fmt.Sprintf("%T %v", actual, actual) != fmt.Sprintf("%T %v", testCase.expected, testCase.expected) {
+				t.Error(fmt.Sprintf("Expected %s to be %T %v but found %T %v", testCase.source, testCase.expected, testCase.expected, actual, actual))
+			}
+		})
+	}
+}
+
+var ExpressionErrorTestCases = []struct {
+	label  string
+	source string
+	err    string
+}{
+	{"division by zero", "field.count / 0", "division by zero"},
+	{"integer modulo by zero", "field.count % 0", "modulo by zero"},
+	{"string arithmetic", `tag.host - 1`, "cannot apply - to web01 and 1"},
+	{"string and number", `tag.host + 1`, "cannot apply + to web01 and 1"},
+	{"unsupported string operator", `"a" * "b"`, "cannot apply * to strings"},
+	{"nil arithmetic", "field.missing + 1", "cannot apply + to <nil> and 1"},
+	{"negating a string", `-tag.host`, "cannot negate web01"},
+	{"lower of a number", "lower(1)", "lower expects a string but got 1"},
+	{"invalid number string", `float("x")`, `strconv.ParseFloat: parsing "x": invalid syntax`},
+	{"unknown function", "sqrt(4)", "unknown function sqrt"},
+	{"wrong arity", "abs(1, 2)", "abs takes 1 argument(s)"},
+	{"unknown name", "value + 1", "unknown name value"},
+	{"unknown kafka reference", "kafka.timestamp", "unknown kafka.timestamp"},
+	{"unquoted bracket name", "field[count]", "expected a quoted name after field["},
+	{"unbalanced parentheses", "(1 + 2", `expected ) but found ""`},
+	{"unterminated string", `"abc`, "unterminated string"},
+	{"unexpected character", "1 & 2", `unexpected character '&'`},
+	{"invalid number", "1.2.3", "invalid number 1.2.3"},
+	{"trailing tokens", "1 2", `unexpected "2"`},
+}
+
+func Test_Expression_Errors(t *testing.T) {
+	for _, testCase := range ExpressionErrorTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := evalExpression(testCase.source)
+
+			if err == nil {
+				t.Error(fmt.Sprintf("Expected %s to fail but found %v", testCase.source, actual))
+			} else if err.Error() != testCase.err {
+				t.Error(fmt.Sprintf("Expected %s to fail with %q but found %q", testCase.source, testCase.err, err.Error()))
+			}
+		})
+	}
+}
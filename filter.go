@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/spf13/cast"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilterConfig is a single include or exclude rule. A rule matches a point
+// when every criterion it sets matches: the measurement name, any of the tag
+// keys, and the value of each listed tag. Patterns wrapped in slashes are
+// regular expressions, patterns holding *, ? or [ are globs, anything else is
+// compared exactly.
+type FilterConfig struct {
+	Name        string
+	Action      string
+	Measurement string
+	TagKey      string
+	TagValues   map[string]string
+}
+
+func NewFilterConfig(entry map[string]interface{}) *FilterConfig {
+	conf := &FilterConfig{Action: "exclude"}
+	if value, ok := entry["name"].(string); ok {
+		conf.Name = value
+	}
+	if value, ok := entry["action"].(string); ok {
+		conf.Action = strings.ToLower(value)
+	}
+	if value, ok := entry["measurement"].(string); ok {
+		conf.Measurement = value
+	}
+	if value, ok := entry["tagkey"].(string); ok {
+		conf.TagKey = value
+	}
+	if value, ok := entry["tagvalues"]; ok {
+		conf.TagValues = cast.ToStringMapString(value)
+	}
+	return conf
+}
+
+type matcher func(value string) bool
+
+func newMatcher(pattern string) (matcher, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expression, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return expression.MatchString, nil
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		return func(value string) bool {
+			matched, _ := path.Match(pattern, value)
+			return matched
+		}, nil
+	}
+	return func(value string) bool { return value == pattern }, nil
+}
+
+type filterRule struct {
+	name        string
+	include     bool
+	measurement matcher
+	tagKey      matcher
+	tagValues   map[string]matcher
+}
+
+func (r *filterRule) matches(point *influx.Point) bool {
+	if r.measurement != nil && !r.measurement(point.Name()) {
+		return false
+	}
+	tags := point.Tags()
+	if r.tagKey != nil {
+		found := false
+		for key := range tags {
+			if r.tagKey(key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range r.tagValues {
+		tag, ok := tags[key]
+		if !ok || !value(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter drops points before they are batched. When include rules are set a
+// point must match one of them, and a point matching any exclude rule is
+// dropped. Dropped points are counted per rule in MetricsFilteredPoints, those
+// matching no include rule under "include".
+type Filter struct {
+	includes []*filterRule
+	excludes []*filterRule
+}
+
+func NewFilter(configs []*FilterConfig) (*Filter, error) {
+	filter := &Filter{}
+	for i, config := range configs {
+		rule := &filterRule{name: config.Name, tagValues: make(map[string]matcher)}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("filter%d", i)
+		}
+		var err error
+		if config.Measurement != "" {
+			if rule.measurement, err = newMatcher(config.Measurement); err != nil {
+				return nil, err
+			}
+		}
+		if config.TagKey != "" {
+			if rule.tagKey, err = newMatcher(config.TagKey); err != nil {
+				return nil, err
+			}
+		}
+		for key, pattern := range config.TagValues {
+			if rule.tagValues[key], err = newMatcher(pattern); err != nil {
+				return nil, err
+			}
+		}
+		switch config.Action {
+		case "include":
+			filter.includes = append(filter.includes, rule)
+		case "exclude":
+			filter.excludes = append(filter.excludes, rule)
+		default:
+			return nil, fmt.Errorf("unknown filter action %s for %s", config.Action, rule.name)
+		}
+	}
+	return filter, nil
+}
+
+func (f *Filter) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	kept := points[:0]
+	for _, point := range points {
+		if rule := f.rejectedBy(point); rule != "" {
+			MetricsFilteredPoints.Add(rule, 1)
+			continue
+		}
+		kept = append(kept, point)
+	}
+	return kept
+}
+
+// rejectedBy returns the name of the rule dropping the point, or "" to keep it.
+func (f *Filter) rejectedBy(point *influx.Point) string {
+	if len(f.includes) > 0 {
+		included := false
+		for _, rule := range f.includes {
+			if rule.matches(point) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "include"
+		}
+	}
+	for _, rule := range f.excludes {
+		if rule.matches(point) {
+			return rule.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+var FilterTestCases = []struct {
+	label    string
+	rules    []*FilterConfig
+	expected []string
+}{
+	{
+		"Should Keep Everything Without Rules",
+		nil,
+		[]string{"cpu,env=prod value=1 1501096898000000000", "test_cpu,debug=1,env=dev value=1 1501096898000000000"},
+	},
+	{
+		"Should Exclude Measurement By Glob",
+		[]*FilterConfig{{Action: "exclude", Measurement: "test_*"}},
+		[]string{"cpu,env=prod value=1 1501096898000000000"},
+	},
+	{
+		"Should Exclude Measurement By Exact Name",
+		[]*FilterConfig{{Action: "exclude", Measurement: "test"}},
+		[]string{"cpu,env=prod value=1 1501096898000000000", "test_cpu,debug=1,env=dev value=1 1501096898000000000"},
+	},
+	{
+		"Should Exclude By Tag Key",
+		[]*FilterConfig{{Action: "exclude", TagKey: "debug"}},
+		[]string{"cpu,env=prod value=1 1501096898000000000"},
+	},
+	{
+		"Should Only Keep Included Tag Values",
+		[]*FilterConfig{{Action: "include", TagValues: map[string]string{"env": "/^(prod|staging)$/"}}},
+		[]string{"cpu,env=prod value=1 1501096898000000000"},
+	},
+	{
+		"Should Require Every Criterion Of A Rule",
+		[]*FilterConfig{{Action: "exclude", Measurement: "cpu", TagValues: map[string]string{"env": "dev"}}},
+		[]string{"cpu,env=prod value=1 1501096898000000000", "test_cpu,debug=1,env=dev value=1 1501096898000000000"},
+	},
+}
+
+func Test_Filter(t *testing.T) {
+	for _, testCase := range FilterTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewFilter(testCase.rules)
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			timestamp := time.Unix(1501096898, 0)
+			kept, _ := influx.NewPoint("cpu", map[string]string{"env": "prod"}, map[string]interface{}{"value": 1.0}, timestamp)
+			junk, _ := influx.NewPoint("test_cpu", map[string]string{"env": "dev", "debug": "1"}, map[string]interface{}{"value": 1.0}, timestamp)
+			actual := pointStrings(sut.Apply([]*influx.Point{kept, junk}, &sarama.ConsumerMessage{}))
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Filter_Counts_Dropped_Points_Per_Rule(t *testing.T) {
+	sut, _ := NewFilter([]*FilterConfig{{Name: "count-test", Action: "exclude", Measurement: "counted"}})
+	before := int64(0)
+	if counter := MetricsFilteredPoints.Get("count-test"); counter != nil {
+		before = counter.(interface{ Value() int64 }).Value()
+	}
+	point, _ := influx.NewPoint("counted", nil, map[string]interface{}{"value": 1.0}, time.Now())
+	sut.Apply([]*influx.Point{point}, &sarama.ConsumerMessage{})
+	if actual := MetricsFilteredPoints.Get("count-test").(interface{ Value() int64 }).Value(); actual != before+1 {
+		t.Error(fmt.Sprintf("Expected count-test to be %d but found %d", before+1, actual))
+	}
+}
+
+func Test_Filter_Rejects_Invalid_Rules(t *testing.T) {
+	if _, err := NewFilter([]*FilterConfig{{Action: "exclude", Measurement: "/(/"}}); err == nil {
+		t.Error("Expected invalid regular expression to be rejected")
+	}
+	if _, err := NewFilter([]*FilterConfig{{Action: "drop"}}); err == nil {
+		t.Error("Expected unknown action to be rejected")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GraphiteConfig struct {
+	Separator string
+	Templates []string
+}
+
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// GraphiteParser reads graphite plaintext lines, "path value [timestamp]", and
+// maps the dotted path onto a measurement, tags and a field with templates in
+// the format used by the influxdb graphite listener: "[filter] template [tags]".
+type GraphiteParser struct {
+	config    *GraphiteConfig
+	templates []*graphiteTemplate
+}
+
+func NewGraphiteParser(config *GraphiteConfig) (*GraphiteParser, error) {
+	parser := &GraphiteParser{config: config}
+	for _, definition := range config.Templates {
+		template, err := parseGraphiteTemplate(definition)
+		if err != nil {
+			return nil, err
+		}
+		parser.templates = append(parser.templates, template)
+	}
+	// The most specific filter wins, templates without a filter match last.
+	sort.SliceStable(parser.templates, func(i, j int) bool {
+		return len(parser.templates[i].filter) > len(parser.templates[j].filter)
+	})
+	return parser, nil
+}
+
+func parseGraphiteTemplate(definition string) (*graphiteTemplate, error) {
+	sections := strings.Fields(definition)
+	template := &graphiteTemplate{tags: map[string]string{}}
+	var tags string
+	switch {
+	case len(sections) == 1:
+		template.parts = strings.Split(sections[0], ".")
+	case len(sections) == 2 && strings.Contains(sections[1], "="):
+		template.parts = strings.Split(sections[0], ".")
+		tags = sections[1]
+	case len(sections) == 2:
+		template.filter = strings.Split(sections[0], ".")
+		template.parts = strings.Split(sections[1], ".")
+	case len(sections) == 3:
+		template.filter = strings.Split(sections[0], ".")
+		template.parts = strings.Split(sections[1], ".")
+		tags = sections[2]
+	default:
+		return nil, fmt.Errorf("invalid graphite template %q", definition)
+	}
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			pair := strings.SplitN(tag, "=", 2)
+			if len(pair) != 2 || pair[0] == "" {
+				return nil, fmt.Errorf("invalid tag %q in graphite template %q", tag, definition)
+			}
+			template.tags[pair[0]] = pair[1]
+		}
+	}
+	return template, nil
+}
+
+func (template *graphiteTemplate) matches(parts []string) bool {
+	if len(template.filter) > len(parts) {
+		return false
+	}
+	for i, filter := range template.filter {
+		if matched, _ := path.Match(filter, parts[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+var defaultGraphiteTemplate = &graphiteTemplate{parts: []string{"measurement*"}, tags: map[string]string{}}
+
+func (p *GraphiteParser) template(parts []string) *graphiteTemplate {
+	for _, template := range p.templates {
+		if template.matches(parts) {
+			return template
+		}
+	}
+	return defaultGraphiteTemplate
+}
+
+// apply returns the measurement, tags and field name encoded in the path.
+func (p *GraphiteParser) apply(metricPath string) (string, map[string]string, string) {
+	parts := strings.Split(metricPath, ".")
+	template := p.template(parts)
+
+	tags := make(map[string]string)
+	for key, value := range template.tags {
+		tags[key] = value
+	}
+	fromPath := make(map[string]bool)
+	measurement := []string{}
+	field := []string{}
+	for i, part := range template.parts {
+		if i >= len(parts) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field":
+			field = append(field, parts[i])
+		case "field*":
+			field = append(field, parts[i:]...)
+		default:
+			if fromPath[part] {
+				tags[part] = tags[part] + p.config.Separator + parts[i]
+			} else {
+				tags[part] = parts[i]
+				fromPath[part] = true
+			}
+		}
+	}
+
+	name := strings.Join(measurement, p.config.Separator)
+	if name == "" {
+		name = metricPath
+	}
+	fieldName := strings.Join(field, p.config.Separator)
+	if fieldName == "" {
+		fieldName = "value"
+	}
+	return name, tags, fieldName
+}
+
+func (p *GraphiteParser) Parse(message *sarama.ConsumerMessage, defaultTime time.Time) ([]*influx.Point, error) {
+	points := []*influx.Point{}
+	for _, line := range strings.Split(string(message.Value), "\n") {
+		sections := strings.Fields(line)
+		if len(sections) == 0 {
+			continue
+		}
+		if len(sections) < 2 {
+			return nil, fmt.Errorf("graphite line %q has no value", line)
+		}
+		value, err := strconv.ParseFloat(sections[1], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("graphite line %q has an invalid value", line)
+		}
+
+		timestamp := defaultTime
+		if len(sections) > 2 && sections[2] != "-1" {
+			seconds, err := strconv.ParseFloat(sections[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("graphite line %q has an invalid timestamp", line)
+			}
+			timestamp = time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+		}
+
+		name, tags, field := p.apply(sections[0])
+		point, err := influx.NewPoint(name, tags, map[string]interface{}{field: value}, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil, errors.New("graphite message contains no metrics")
+	}
+	return points, nil
+}
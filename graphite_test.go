@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+var GraphiteParserTestCases = []struct {
+	label         string
+	templates     []string
+	value         string
+	expected      []string
+	expectedError bool
+}{
+	{
+		"Should Use Whole Path As Measurement Without Templates",
+		nil,
+		"servers.web01.cpu.load 0.5 1501096898",
+		[]string{"servers.web01.cpu.load value=0.5 1501096898000000000"},
+		false,
+	},
+	{
+		"Should Apply Most Specific Matching Template",
+		[]string{"measurement* region=us", "servers.* .host.measurement.field*"},
+		"servers.web01.cpu.load.shortterm 0.5 1501096898\nstats.requests 3 1501096898",
+		[]string{
+			"cpu,host=web01 load.shortterm=0.5 1501096898000000000",
+			"stats.requests,region=us value=3 1501096898000000000",
+		},
+		false,
+	},
+	{
+		"Should Join Repeated Tags",
+		[]string{"dc.dc.measurement"},
+		"us.west.requests 1 1501096898",
+		[]string{"requests,dc=us.west value=1 1501096898000000000"},
+		false,
+	},
+	{
+		"Should Reject Line Without Value",
+		nil,
+		"servers.web01.cpu.load",
+		nil,
+		true,
+	},
+	{
+		"Should Reject Invalid Value",
+		nil,
+		"servers.web01.cpu.load abc 1501096898",
+		nil,
+		true,
+	},
+}
+
+func Test_Graphite_Parser(t *testing.T) {
+	for _, testCase := range GraphiteParserTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewGraphiteParser(&GraphiteConfig{Separator: ".", Templates: testCase.templates})
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected template error %s", testCase.label, err.Error()))
+				return
+			}
+			points, err := sut.Parse(&sarama.ConsumerMessage{Value: []byte(testCase.value)}, time.Now())
+			if testCase.expectedError {
+				if err == nil {
+					t.Error(fmt.Sprintf("%s: expected error parsing %s", testCase.label, testCase.value))
+				}
+				return
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			actual := pointStrings(points)
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Graphite_Parser_Rejects_Invalid_Template(t *testing.T) {
+	if _, err := NewGraphiteParser(&GraphiteConfig{Separator: ".", Templates: []string{"a b c d"}}); err == nil {
+		t.Error("Expected template with too many sections to be rejected")
+	}
+}
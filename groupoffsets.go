@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// offsetAdmin reads and commits the offsets of the consumer group.
+type offsetAdmin interface {
+	offsetClient
+	Committed(topic string, partition int32) (int64, error)
+	Commit(offsets map[topicPartition]int64) error
+	CommitAsMember(offsets map[topicPartition]int64) error
+	Members() (int, error)
+}
+
+type kafkaOffsetAdmin struct {
+	sarama.Client
+	group   string
+	session time.Duration
+}
+
+func (a *kafkaOffsetAdmin) Committed(topic string, partition int32) (int64, error) {
+	coordinator, err := a.Coordinator(a.group)
+	if err != nil {
+		return 0, err
+	}
+	request := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: a.group}
+	request.AddPartition(topic, partition)
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return 0, err
+	}
+	block := response.GetBlock(topic, partition)
+	if block == nil {
+		return 0, sarama.ErrIncompleteResponse
+	}
+	if block.Err != sarama.ErrNoError {
+		return 0, block.Err
+	}
+	return block.Offset, nil
+}
+
+// Commit stores the offsets outside of any generation of the group, which the
+// coordinator only accepts while the group has no members.
+func (a *kafkaOffsetAdmin) Commit(offsets map[topicPartition]int64) error {
+	coordinator, err := a.Coordinator(a.group)
+	if err != nil {
+		return err
+	}
+	return a.commit(coordinator, offsets, -1, "")
+}
+
+// CommitAsMember joins the group, which has the members rejoin and commit
+// their own offsets first, and stores the offsets within the generation it
+// joined before leaving the group again. It subscribes to no topic, so
+// members keep the partitions assigned by their leader, and should it lead
+// the group itself it assigns none until it leaves.
+func (a *kafkaOffsetAdmin) CommitAsMember(offsets map[topicPartition]int64) error {
+	coordinator, err := a.Coordinator(a.group)
+	if err != nil {
+		return err
+	}
+	join := &sarama.JoinGroupRequest{GroupId: a.group, SessionTimeout: int32(a.session / time.Millisecond), ProtocolType: "consumer"}
+	if err = join.AddGroupProtocolMetadata(string(cluster.StrategyRange), &sarama.ConsumerGroupMemberMetadata{Version: 1}); err != nil {
+		return err
+	}
+	joined, err := coordinator.JoinGroup(join)
+	if err != nil {
+		return err
+	}
+	if joined.Err != sarama.ErrNoError {
+		return joined.Err
+	}
+	defer coordinator.LeaveGroup(&sarama.LeaveGroupRequest{GroupId: a.group, MemberId: joined.MemberId})
+
+	sync := &sarama.SyncGroupRequest{GroupId: a.group, GenerationId: joined.GenerationId, MemberId: joined.MemberId}
+	if joined.LeaderId == joined.MemberId {
+		members, err := joined.GetMembers()
+		if err != nil {
+			return err
+		}
+		for member := range members {
+			if err = sync.AddGroupAssignmentMember(member, &sarama.ConsumerGroupMemberAssignment{}); err != nil {
+				return err
+			}
+		}
+	}
+	synced, err := coordinator.SyncGroup(sync)
+	if err != nil {
+		return err
+	}
+	if synced.Err != sarama.ErrNoError {
+		return synced.Err
+	}
+	return a.commit(coordinator, offsets, joined.GenerationId, joined.MemberId)
+}
+
+func (a *kafkaOffsetAdmin) commit(coordinator *sarama.Broker, offsets map[topicPartition]int64, generation int32, member string) error {
+	request := &sarama.OffsetCommitRequest{Version: 2, ConsumerGroup: a.group, ConsumerGroupGeneration: generation, ConsumerID: member, RetentionTime: -1}
+	for key, offset := range offsets {
+		request.AddBlock(key.topic, key.partition, offset, sarama.ReceiveTime, "")
+	}
+	response, err := coordinator.CommitOffset(request)
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range response.Errors {
+		for partition, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				return fmt.Errorf("unable to commit offset of %s/%d: %s", topic, partition, kerr.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (a *kafkaOffsetAdmin) Members() (int, error) {
+	coordinator, err := a.Coordinator(a.group)
+	if err != nil {
+		return 0, err
+	}
+	response, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{Groups: []string{a.group}})
+	if err != nil {
+		return 0, err
+	}
+	for _, group := range response.Groups {
+		if group.Err != sarama.ErrNoError {
+			return 0, group.Err
+		}
+		return len(group.Members), nil
+	}
+	return 0, nil
+}
+
+// groupOffset is the committed offset of the group on a partition, -1 when
+// none was committed, next to the offsets the partition holds.
+type groupOffset struct {
+	topicPartition
+	current int64
+	oldest  int64
+	newest  int64
+	target  int64
+}
+
+func (o *groupOffset) lag() int64 {
+	if o.current < 0 {
+		return o.newest - o.oldest
+	}
+	return o.newest - o.current
+}
+
+// OffsetReset moves the group to the oldest or newest offsets, to the first
+// offset stamped at or after a time, to an offset or by a number of offsets
+// from the committed one. Targets are kept within the offsets the partitions
+// hold. Unless executed the reset is only previewed.
+type OffsetReset struct {
+	Strategy string
+	Time     time.Time
+	Offset   int64
+	Execute  bool
+	Force    bool
+}
+
+func parseOffsetResetArgs(args []string, output io.Writer) (*OffsetReset, error) {
+	flags := flag.NewFlagSet("offsets reset", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Bool("to-earliest", false, "reset to the oldest offsets")
+	flags.Bool("to-latest", false, "reset to the newest offsets")
+	toTime := flags.String("to-time", "", "reset to the first offsets stamped at or after an RFC3339 time")
+	toOffset := flags.Int64("to-offset", 0, "reset to an offset")
+	shiftBy := flags.Int64("shift-by", 0, "move the committed offsets by a number of offsets")
+	conf := &OffsetReset{}
+	flags.BoolVar(&conf.Execute, "execute", false, "commit the new offsets rather than previewing them")
+	flags.BoolVar(&conf.Force, "force", false, "reset even though the group has active members")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	strategies := []string{}
+	flags.Visit(func(set *flag.Flag) {
+		if strings.HasPrefix(set.Name, "to-") || set.Name == "shift-by" {
+			strategies = append(strategies, set.Name)
+		}
+	})
+	if len(strategies) != 1 {
+		return nil, errors.New("exactly one of -to-earliest, -to-latest, -to-time, -to-offset or -shift-by is required")
+	}
+	conf.Strategy = strategies[0]
+	switch conf.Strategy {
+	case "to-time":
+		var err error
+		if conf.Time, err = time.Parse(time.RFC3339, *toTime); err != nil {
+			return nil, err
+		}
+	case "to-offset":
+		conf.Offset = *toOffset
+	case "shift-by":
+		conf.Offset = *shiftBy
+	}
+	return conf, nil
+}
+
+// target returns the offset the reset moves the partition to.
+func (r *OffsetReset) target(admin offsetAdmin, offset *groupOffset) (int64, error) {
+	target := offset.newest
+	switch r.Strategy {
+	case "to-earliest":
+		target = offset.oldest
+	case "to-time":
+		found, err := admin.GetOffset(offset.topic, offset.partition, r.Time.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return 0, err
+		}
+		if found >= 0 {
+			target = found
+		}
+	case "to-offset":
+		target = r.Offset
+	case "shift-by":
+		if offset.current < 0 {
+			return 0, fmt.Errorf("no offset committed on %s/%d to shift", offset.topic, offset.partition)
+		}
+		target = offset.current + r.Offset
+	}
+	if target < offset.oldest {
+		target = offset.oldest
+	}
+	if target > offset.newest {
+		target = offset.newest
+	}
+	return target, nil
+}
+
+func groupOffsets(admin offsetAdmin, userConfig *KafkaConfig) ([]*groupOffset, error) {
+	ranges, err := offsetRanges(admin, userConfig)
+	if err != nil {
+		return nil, err
+	}
+	offsets := []*groupOffset{}
+	for key, offsetRange := range ranges {
+		current, err := admin.Committed(key.topic, key.partition)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, &groupOffset{key, current, offsetRange.start, offsetRange.end, current})
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].topic != offsets[j].topic {
+			return offsets[i].topic < offsets[j].topic
+		}
+		return offsets[i].partition < offsets[j].partition
+	})
+	return offsets, nil
+}
+
+func printOffsets(output io.Writer, offsets []*groupOffset, withTarget bool) {
+	table := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	header := "TOPIC\tPARTITION\tCURRENT\tOLDEST\tNEWEST\tLAG"
+	if withTarget {
+		header += "\tTARGET"
+	}
+	fmt.Fprintln(table, header)
+	for _, offset := range offsets {
+		current := "-"
+		if offset.current >= 0 {
+			current = fmt.Sprint(offset.current)
+		}
+		line := fmt.Sprintf("%s\t%d\t%s\t%d\t%d\t%d", offset.topic, offset.partition, current, offset.oldest, offset.newest, offset.lag())
+		if withTarget {
+			line += fmt.Sprintf("\t%d", offset.target)
+		}
+		fmt.Fprintln(table, line)
+	}
+	table.Flush()
+}
+
+// runOffsets shows the offsets of the group, or resets them when given a
+// reset. A reset is refused while the group has members, which would keep
+// committing their own offsets, unless forced. A forced reset joins the group
+// to commit, since Kafka only accepts offsets committed outside of a group
+// generation for empty groups. Members that consume past the reset before
+// their next rebalance may still commit over it.
+func runOffsets(admin offsetAdmin, userConfig *KafkaConfig, reset *OffsetReset, output io.Writer) error {
+	offsets, err := groupOffsets(admin, userConfig)
+	if err != nil {
+		return err
+	}
+	if reset == nil {
+		printOffsets(output, offsets, false)
+		return nil
+	}
+	targets := make(map[topicPartition]int64)
+	for _, offset := range offsets {
+		if offset.target, err = reset.target(admin, offset); err != nil {
+			return err
+		}
+		targets[offset.topicPartition] = offset.target
+	}
+	printOffsets(output, offsets, true)
+	if !reset.Execute {
+		fmt.Fprintln(output, "Dry run, pass -execute to commit the target offsets.")
+		return nil
+	}
+	members, err := admin.Members()
+	if err != nil {
+		return err
+	}
+	if members > 0 && !reset.Force {
+		return fmt.Errorf("group %s has %d active members, stop them or pass -force", userConfig.ConsumerGroup, members)
+	}
+	if members > 0 {
+		err = admin.CommitAsMember(targets)
+	} else {
+		err = admin.Commit(targets)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Committed the target offsets of group %s.\n", userConfig.ConsumerGroup)
+	return nil
+}
+
+// offsets implements the offsets command, either show or reset, against the
+// configured consumer group and topics.
+func offsets(args []string, output io.Writer) error {
+	if len(args) == 0 || (args[0] != "show" && args[0] != "reset") {
+		return errors.New("usage: offsets show|reset")
+	}
+	var reset *OffsetReset
+	if args[0] == "reset" {
+		var err error
+		if reset, err = parseOffsetResetArgs(args[1:], os.Stderr); err != nil {
+			return err
+		}
+	}
+	conf := NewConfig()
+	// Looking offsets up by timestamp needs the 0.10.1 protocol.
+	if !conf.Kafka.Cluster.Version.IsAtLeast(sarama.V0_10_1_0) {
+		conf.Kafka.Cluster.Version = sarama.V0_10_1_0
+	}
+	// Joining the group waits up to a session for its members to rejoin.
+	session := conf.Kafka.Cluster.Group.Session.Timeout
+	if conf.Kafka.Cluster.Net.ReadTimeout <= session {
+		conf.Kafka.Cluster.Net.ReadTimeout = session + 5*time.Second
+	}
+	client, err := sarama.NewClient(strings.Split(conf.Kafka.Brokers, ","), &conf.Kafka.Cluster.Config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return runOffsets(&kafkaOffsetAdmin{client, conf.Kafka.ConsumerGroup, session}, conf.Kafka, reset, output)
+}
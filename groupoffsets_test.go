@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bsm/sarama-cluster"
+	"testing"
+	"time"
+)
+
+type mockOffsetAdmin struct {
+	mockOffsetClient
+	committed map[topicPartition]int64
+	members   int
+	commits   []map[topicPartition]int64
+	// joined counts the commits made as a member of the group.
+	joined int
+}
+
+func (a *mockOffsetAdmin) Committed(topic string, partition int32) (int64, error) {
+	if offset, ok := a.committed[topicPartition{topic, partition}]; ok {
+		return offset, nil
+	}
+	return -1, nil
+}
+
+func (a *mockOffsetAdmin) Commit(offsets map[topicPartition]int64) error {
+	a.commits = append(a.commits, offsets)
+	return nil
+}
+
+func (a *mockOffsetAdmin) CommitAsMember(offsets map[topicPartition]int64) error {
+	a.joined++
+	return a.Commit(offsets)
+}
+
+func (a *mockOffsetAdmin) Members() (int, error) {
+	return a.members, nil
+}
+
+func newMockOffsetAdmin(members int) *mockOffsetAdmin {
+	resetTime := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	return &mockOffsetAdmin{
+		mockOffsetClient: mockOffsetClient{
+			offsets: map[topicPartition][2]int64{
+				{"metrics", 0}: {10, 100},
+				{"metrics", 1}: {0, 50},
+			},
+			byTime: map[topicPartition]map[int64]int64{
+				{"metrics", 0}: {resetTime: 60},
+			},
+		},
+		committed: map[topicPartition]int64{{"metrics", 0}: 80},
+		members:   members,
+	}
+}
+
+func Test_Offsets_Show(t *testing.T) {
+	output := &bytes.Buffer{}
+
+	err := runOffsets(newMockOffsetAdmin(0), &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, nil, output)
+
+	expected := "TOPIC    PARTITION  CURRENT  OLDEST  NEWEST  LAG\n" +
+		"metrics  0          80       10      100     20\n" +
+		"metrics  1          -        0       50      50\n"
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	} else if output.String() != expected {
+		t.Error(fmt.Sprintf("Unexpected output.\n\texpected:\n%s\n\tactual:\n%s", expected, output.String()))
+	}
+}
+
+var OffsetResetTestCases = []struct {
+	label    string
+	args     []string
+	expected map[topicPartition]int64
+}{
+	{"earliest", []string{"-to-earliest", "-execute"}, map[topicPartition]int64{{"metrics", 0}: 10, {"metrics", 1}: 0}},
+	{"latest", []string{"--to-latest", "--execute"}, map[topicPartition]int64{{"metrics", 0}: 100, {"metrics", 1}: 50}},
+	{"time", []string{"-to-time", "2018-06-01T00:00:00Z", "-execute"}, map[topicPartition]int64{{"metrics", 0}: 60, {"metrics", 1}: 50}},
+	{"offset within the partitions", []string{"-to-offset", "40", "-execute"}, map[topicPartition]int64{{"metrics", 0}: 40, {"metrics", 1}: 40}},
+	{"offset beyond the partitions", []string{"-to-offset", "5", "-execute"}, map[topicPartition]int64{{"metrics", 0}: 10, {"metrics", 1}: 5}},
+}
+
+func Test_Offsets_Reset(t *testing.T) {
+	for _, testCase := range OffsetResetTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			admin := newMockOffsetAdmin(0)
+			reset, err := parseOffsetResetArgs(testCase.args, &bytes.Buffer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = runOffsets(admin, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, reset, &bytes.Buffer{})
+
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if len(admin.commits) != 1 || fmt.Sprint(admin.commits[0]) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("Unexpected commits.\n\texpected: %v\n\tactual: %v", testCase.expected, admin.commits))
+			}
+		})
+	}
+}
+
+func Test_Offsets_Reset_Shifting_Requires_A_Committed_Offset(t *testing.T) {
+	admin := newMockOffsetAdmin(0)
+	reset, _ := parseOffsetResetArgs([]string{"-shift-by", "-30", "-execute"}, &bytes.Buffer{})
+
+	err := runOffsets(admin, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, reset, &bytes.Buffer{})
+
+	if err == nil || len(admin.commits) != 0 {
+		t.Error(fmt.Sprintf("Expected shifting partition 1 to fail but committed %v", admin.commits))
+	}
+}
+
+func Test_Offsets_Reset_Previews_Without_Execute(t *testing.T) {
+	admin := newMockOffsetAdmin(0)
+	reset, _ := parseOffsetResetArgs([]string{"-to-latest"}, &bytes.Buffer{})
+	output := &bytes.Buffer{}
+
+	err := runOffsets(admin, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, reset, output)
+
+	expected := "TOPIC    PARTITION  CURRENT  OLDEST  NEWEST  LAG  TARGET\n" +
+		"metrics  0          80       10      100     20   100\n" +
+		"metrics  1          -        0       50      50   50\n" +
+		"Dry run, pass -execute to commit the target offsets.\n"
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	} else if output.String() != expected || len(admin.commits) != 0 {
+		t.Error(fmt.Sprintf("Unexpected preview.\n\texpected:\n%s\n\tactual:\n%s", expected, output.String()))
+	}
+}
+
+func Test_Offsets_Reset_Of_An_Active_Group(t *testing.T) {
+	admin := newMockOffsetAdmin(2)
+	reset, _ := parseOffsetResetArgs([]string{"-to-latest", "-execute"}, &bytes.Buffer{})
+
+	if err := runOffsets(admin, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, reset, &bytes.Buffer{}); err == nil || len(admin.commits) != 0 {
+		t.Error("Expected reset of an active group to be refused")
+	}
+
+	reset.Force = true
+	if err := runOffsets(admin, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, reset, &bytes.Buffer{}); err != nil || len(admin.commits) != 1 || admin.joined != 1 {
+		t.Error(fmt.Sprintf("Expected forced reset to commit as a member of the group but got %v", err))
+	}
+}
+
+func Test_Offsets_Reset_Requires_A_Single_Strategy(t *testing.T) {
+	for _, args := range [][]string{{}, {"-to-earliest", "-to-latest"}, {"-execute"}} {
+		if _, err := parseOffsetResetArgs(args, &bytes.Buffer{}); err == nil {
+			t.Error(fmt.Sprintf("Expected an error for %v", args))
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportConfig reads the lines of Files, or of stdin for "-", as messages of
+// Topic, whose settings decide how they are parsed and where they are written.
+// The lines written are checkpointed to Checkpoint, when given, and an import
+// restarted with the same checkpoint skips them.
+type ImportConfig struct {
+	Files          []string
+	Topic          string
+	Format         string
+	Checkpoint     string
+	ReportInterval time.Duration
+	MaxRetries     int
+}
+
+func parseImportArgs(args []string, output io.Writer) (*ImportConfig, error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(output)
+	conf := &ImportConfig{}
+	flags.StringVar(&conf.Topic, "topic", "import", "topic whose settings the lines are processed with")
+	flags.StringVar(&conf.Format, "format", "", "input format of the lines, instead of the configured one")
+	flags.StringVar(&conf.Checkpoint, "checkpoint", "", "file the lines written are checkpointed to")
+	flags.DurationVar(&conf.ReportInterval, "report-interval", 30*time.Second, "interval progress is logged at")
+	flags.IntVar(&conf.MaxRetries, "max-retries", 10, "failed attempts in a row to write a batch before giving up, 0 to retry forever")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if conf.MaxRetries < 0 {
+		return nil, fmt.Errorf("-max-retries must not be negative")
+	}
+	conf.Files = flags.Args()
+	if len(conf.Files) == 0 {
+		conf.Files = []string{"-"}
+	}
+	return conf, nil
+}
+
+// importCheckpoint holds the number of lines written per file.
+type importCheckpoint struct {
+	path  string
+	Files map[string]int64 `json:"files"`
+}
+
+func loadImportCheckpoint(path string) (*importCheckpoint, error) {
+	checkpoint := &importCheckpoint{path: path, Files: make(map[string]int64)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// countingReader counts the bytes read from the file, before decompression.
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+	lock   *sync.Mutex
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	read, err := r.reader.Read(p)
+	r.lock.Lock()
+	*r.count += int64(read)
+	r.lock.Unlock()
+	return read, err
+}
+
+type importFile struct {
+	path    string
+	size    int64
+	skip    int64
+	read    int64
+	written int64
+	eof     bool
+}
+
+// FileConsumer reads the lines of files one after the other as messages, one
+// partition per file with the line number as offset. Empty lines and comments
+// are passed on without a value so that every line is marked.
+type FileConsumer struct {
+	lock       sync.Mutex
+	files      []*importFile
+	topic      string
+	current    int
+	file       io.ReadCloser
+	reader     *bufio.Reader
+	bytesRead  int64
+	totalBytes int64
+	err        error
+	closed     bool
+	checkpoint *importCheckpoint
+	input      io.Reader
+	started    time.Time
+	reported   time.Time
+	interval   time.Duration
+}
+
+func NewFileConsumer(conf *ImportConfig, checkpoint *importCheckpoint, input io.Reader) (*FileConsumer, error) {
+	c := &FileConsumer{topic: conf.Topic, checkpoint: checkpoint, input: input, started: time.Now(), interval: conf.ReportInterval}
+	c.reported = c.started
+	for _, path := range conf.Files {
+		file := &importFile{path: path}
+		if path != "-" {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			file.size = info.Size()
+			c.totalBytes += file.size
+		}
+		if checkpoint != nil {
+			file.skip = checkpoint.Files[path]
+			file.written = file.skip
+		}
+		c.files = append(c.files, file)
+	}
+	return c, nil
+}
+
+// open opens the current file, decompressing it when gzipped.
+func (c *FileConsumer) open() error {
+	file := c.files[c.current]
+	var raw io.ReadCloser = ioutil.NopCloser(c.input)
+	if file.path != "-" {
+		opened, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+		raw = opened
+	}
+	c.file = raw
+	c.reader = bufio.NewReader(countingReader{raw, &c.bytesRead, &c.lock})
+	if magic, _ := c.reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		decompressed, err := gzip.NewReader(c.reader)
+		if err != nil {
+			return err
+		}
+		c.reader = bufio.NewReader(decompressed)
+	}
+	return nil
+}
+
+// ConsumeMessage returns the next line not written yet. Once every file was
+// read, or it was closed, it returns nil after a short wait.
+func (c *FileConsumer) ConsumeMessage() (*sarama.ConsumerMessage, error) {
+	for {
+		c.lock.Lock()
+		done := c.current >= len(c.files) || c.err != nil || c.closed
+		c.lock.Unlock()
+		if done {
+			time.Sleep(100 * time.Millisecond)
+			return nil, nil
+		}
+		if c.reader == nil {
+			if err := c.open(); err != nil {
+				c.fail(err)
+				return nil, err
+			}
+		}
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			c.fail(err)
+			return nil, err
+		}
+		c.lock.Lock()
+		file := c.files[c.current]
+		if len(line) == 0 && err == io.EOF {
+			file.eof = true
+			c.file.Close()
+			c.file = nil
+			c.reader = nil
+			c.current++
+			c.lock.Unlock()
+			continue
+		}
+		offset := file.read
+		file.read++
+		c.lock.Unlock()
+		if offset < file.skip {
+			continue
+		}
+		value := bytes.TrimSpace(line)
+		if bytes.HasPrefix(value, []byte("#")) {
+			value = nil
+		}
+		return &sarama.ConsumerMessage{Topic: c.topic, Partition: int32(c.current), Offset: offset, Value: value, Timestamp: time.Now()}, nil
+	}
+}
+
+// fail stops reading, the import ends with the error. Reads interrupted by
+// closing the consumer are not errors.
+func (c *FileConsumer) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.err = fmt.Errorf("unable to read %s: %s", c.files[c.current].path, err.Error())
+}
+
+func (c *FileConsumer) MarkOffset(messages []*sarama.ConsumerMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, message := range messages {
+		if message == nil || int(message.Partition) >= len(c.files) {
+			continue
+		}
+		if file := c.files[message.Partition]; message.Offset >= file.written {
+			file.written = message.Offset + 1
+		}
+	}
+	if c.checkpoint == nil {
+		return
+	}
+	for _, file := range c.files {
+		c.checkpoint.Files[file.path] = file.written
+	}
+	if err := saveJson(c.checkpoint.path, c.checkpoint); err != nil {
+		log.WithError(err).WithField("path", c.checkpoint.path).Error("Unable to save import checkpoint")
+	}
+}
+
+func (c *FileConsumer) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+// Observe logs the progress and returns true once every line read was written
+// or reading failed. Its signature matches Kandi.PostProcessors.
+func (c *FileConsumer) Observe(processedMessages []*sarama.ConsumerMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	done := c.err != nil || c.current >= len(c.files)
+	for _, file := range c.files {
+		done = done && file.eof && file.written >= file.read
+	}
+	now := time.Now()
+	if done || c.interval > 0 && now.Sub(c.reported) >= c.interval {
+		c.reported = now
+		c.log(now, done)
+	}
+	return done || c.err != nil
+}
+
+// log estimates the time left from the share of the file bytes read, which is
+// unknown when reading stdin.
+func (c *FileConsumer) log(now time.Time, done bool) {
+	var read, written int64
+	for _, file := range c.files {
+		read += file.read
+		written += file.written
+	}
+	fields := log.Fields{"files": len(c.files), "linesRead": read, "linesWritten": written}
+	if c.totalBytes > 0 && c.bytesRead > 0 {
+		fields["percent"] = 100 * c.bytesRead / c.totalBytes
+		remaining := time.Duration(float64(now.Sub(c.started)) * float64(c.totalBytes-c.bytesRead) / float64(c.bytesRead))
+		fields["eta"] = remaining.Truncate(time.Second).String()
+	}
+	if done {
+		log.WithFields(fields).Info("Import completed")
+	} else {
+		log.WithFields(fields).Info("Import progress")
+	}
+}
+
+// Err returns the error reading stopped at, if any.
+func (c *FileConsumer) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// importFiles writes the lines of files through the pipeline and returns once
+// all of them were written.
+func importFiles(args []string) error {
+	importConf, err := parseImportArgs(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	var checkpoint *importCheckpoint
+	if importConf.Checkpoint != "" {
+		if checkpoint, err = loadImportCheckpoint(importConf.Checkpoint); err != nil {
+			return fmt.Errorf("unable to read import checkpoint: %s", err.Error())
+		}
+	}
+	conf := NewConfig()
+	if importConf.Format != "" {
+		conf.Kafka.Format = strings.ToLower(importConf.Format)
+	}
+	consumer, err := NewFileConsumer(importConf, checkpoint, os.Stdin)
+	if err != nil {
+		return err
+	}
+	kandi := NewKandi(conf)
+	kandi.Consumer = consumer
+	kandi.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{consumer.Observe}
+	kandi.MaxRetries = importConf.MaxRetries
+
+	log.WithFields(log.Fields{"files": importConf.Files, "topic": importConf.Topic}).Info("Starting Kandi Import")
+	kandi.Start()
+	log.Info("Stopping Kandi Import")
+	if err := consumer.Err(); err != nil {
+		return err
+	}
+	return kandi.Err()
+}
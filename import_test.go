@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeImportFiles(t *testing.T) (string, []string) {
+	dir, err := ioutil.TempDir("", "kandi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "cpu.txt")
+	if err = ioutil.WriteFile(plain, []byte("cpu value=1 1\n\n# exported\ncpu value=2 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte("mem value=3 3\nmem value=4 4\n"))
+	writer.Close()
+	gzipped := filepath.Join(dir, "mem.txt.gz")
+	if err = ioutil.WriteFile(gzipped, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, []string{plain, gzipped}
+}
+
+func consumeAll(sut *FileConsumer) []*sarama.ConsumerMessage {
+	messages := []*sarama.ConsumerMessage{}
+	for {
+		message, err := sut.ConsumeMessage()
+		if message == nil || err != nil {
+			return messages
+		}
+		messages = append(messages, message)
+	}
+}
+
+func messageStrings(messages []*sarama.ConsumerMessage) string {
+	lines := []string{}
+	for _, message := range messages {
+		lines = append(lines, fmt.Sprintf("%s/%d/%d %s", message.Topic, message.Partition, message.Offset, message.Value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func Test_File_Consumer_Reads_Every_Line(t *testing.T) {
+	dir, files := writeImportFiles(t)
+	defer os.RemoveAll(dir)
+	log.SetLevel(log.PanicLevel)
+	sut, err := NewFileConsumer(&ImportConfig{Files: files, Topic: "import"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := consumeAll(sut)
+
+	expected := "import/0/0 cpu value=1 1\nimport/0/1 \nimport/0/2 \nimport/0/3 cpu value=2 2\nimport/1/0 mem value=3 3\nimport/1/1 mem value=4 4"
+	if messageStrings(actual) != expected {
+		t.Error(fmt.Sprintf("Unexpected messages.\n\texpected:\n%s\n\tactual:\n%s", expected, messageStrings(actual)))
+	}
+	if sut.Observe(actual) {
+		t.Error("Expected import to wait for the lines to be written")
+	}
+	sut.MarkOffset(actual)
+	if !sut.Observe(actual) {
+		t.Error("Expected import to finish once every line was written")
+	}
+}
+
+func Test_File_Consumer_Resumes_From_Checkpoint(t *testing.T) {
+	dir, files := writeImportFiles(t)
+	defer os.RemoveAll(dir)
+	log.SetLevel(log.PanicLevel)
+	path := filepath.Join(dir, "import.json")
+	checkpoint, _ := loadImportCheckpoint(path)
+	first, _ := NewFileConsumer(&ImportConfig{Files: files, Topic: "import"}, checkpoint, nil)
+	messages := consumeAll(first)
+	first.MarkOffset(messages[:5])
+
+	checkpoint, err := loadImportCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut, _ := NewFileConsumer(&ImportConfig{Files: files, Topic: "import"}, checkpoint, nil)
+	actual := consumeAll(sut)
+
+	if expected := "import/1/1 mem value=4 4"; messageStrings(actual) != expected {
+		t.Error(fmt.Sprintf("Unexpected messages.\n\texpected:\n%s\n\tactual:\n%s", expected, messageStrings(actual)))
+	}
+}
+
+func Test_File_Consumer_Reads_Stdin(t *testing.T) {
+	sut, _ := NewFileConsumer(&ImportConfig{Files: []string{"-"}, Topic: "metrics"}, nil, strings.NewReader("cpu value=1 1\n"))
+
+	actual := consumeAll(sut)
+
+	if expected := "metrics/0/0 cpu value=1 1"; messageStrings(actual) != expected {
+		t.Error(fmt.Sprintf("Unexpected messages.\n\texpected:\n%s\n\tactual:\n%s", expected, messageStrings(actual)))
+	}
+}
+
+func Test_File_Consumer_Of_Missing_File(t *testing.T) {
+	if _, err := NewFileConsumer(&ImportConfig{Files: []string{filepath.Join(os.TempDir(), "kandi-missing.txt")}}, nil, nil); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"github.com/Shopify/sarama"
+	"fmt"
 	influx "github.com/influxdata/influxdb/client/v2"
 	"github.com/influxdata/influxdb/models"
 	log "github.com/sirupsen/logrus"
@@ -21,13 +21,32 @@ type InfluxConfig struct {
 	WriteConsistency string
 	RetentionPolicy  string
 	AcceptedErrors   []string
+	// Protocol is http (default), udp or tcp. Points sent over udp or tcp
+	// are not acknowledged and may be lost after their offsets are committed.
+	Protocol string
+	// PayloadSize is the largest udp packet sent.
+	PayloadSize int
 }
 
 type Influx struct {
 	config *InfluxConfig
+	socket *influxSocket
+}
+
+func NewInflux(config *InfluxConfig) (*Influx, error) {
+	switch config.Protocol {
+	case "", "http":
+		return &Influx{config: config}, nil
+	case "udp", "tcp":
+		return &Influx{config: config, socket: newInfluxSocket(config)}, nil
+	}
+	return nil, fmt.Errorf("unknown influx protocol %s", config.Protocol)
 }
 
 func (i *Influx) Write(batch influx.BatchPoints) error {
+	if i.socket != nil {
+		return i.socket.Write(batch)
+	}
 	if batch != nil && len(batch.Points()) >= 0 {
 		client, err := i.NewClient()
 		defer client.Close()
@@ -53,54 +72,104 @@ func (i *Influx) Write(batch influx.BatchPoints) error {
 	return nil
 }
 
+func (i *Influx) Close() error {
+	if i.socket != nil {
+		return i.socket.Close()
+	}
+	return nil
+}
+
+// Health pings Influx.
+func (i *Influx) Health() error {
+	if i.socket != nil {
+		return i.socket.Health()
+	}
+	client, err := i.NewClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, _, err = client.Ping(i.config.Timeout)
+	return err
+}
+
 func (i *Influx) NewClient() (influx.Client, error) {
 	return influx.NewHTTPClient(influx.HTTPConfig{i.config.Url, i.config.User, i.config.Password, i.config.UserAgent, i.config.Timeout, false, nil})
 }
 
-func (i *Influx) ParseMessages(messages []*sarama.ConsumerMessage) influx.BatchPoints {
-	batchConf := influx.BatchPointsConfig{i.config.Precision, i.config.Database, i.config.RetentionPolicy, i.config.WriteConsistency}
+func (i *Influx) NewBatch() (influx.BatchPoints, error) {
+	return i.NewDestinationBatch(i.config.Database, i.config.RetentionPolicy)
+}
+
+func (i *Influx) NewDestinationBatch(database string, retentionPolicy string) (influx.BatchPoints, error) {
+	batchConf := influx.BatchPointsConfig{Precision: i.config.Precision, Database: database, RetentionPolicy: retentionPolicy, WriteConsistency: i.config.WriteConsistency}
 	batch, err := influx.NewBatchPoints(batchConf)
 	if err != nil {
-		log.WithFields(log.Fields{"precision": i.config.Precision, "database": i.config.Database, "retentionPolicy": i.config.RetentionPolicy, "WriteConsistency": i.config.WriteConsistency}).Info("Failed to create batch points configuration")
-		return nil
+		log.WithFields(log.Fields{"precision": i.config.Precision, "database": database, "retentionPolicy": retentionPolicy, "WriteConsistency": i.config.WriteConsistency}).Info("Failed to create batch points configuration")
+		return nil, err
 	}
+	return batch, nil
+}
 
-	if messages == nil || len(messages) == 0 {
-		return batch
+// FieldTypes returns the type of every field of the database by measurement,
+// as reported by SHOW FIELD KEYS.
+func (i *Influx) FieldTypes(database string) (map[string]map[string]string, error) {
+	client, err := i.NewClient()
+	if err != nil {
+		MetricInfluxInitializationFailure.Add(1)
+		return nil, err
 	}
-
-	log.WithField("points", len(messages)).Debug("Parsing messages into points")
-	for _, message := range messages {
-		if message != nil && len(message.Value) != 0 {
-			point, _ := i.ParseMessage(message)
-			if point != nil {
-				batch.AddPoint(point)
+	defer client.Close()
+	response, err := client.Query(influx.NewQuery("SHOW FIELD KEYS", database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+	types := make(map[string]map[string]string)
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			fields := make(map[string]string)
+			for _, row := range series.Values {
+				if len(row) < 2 {
+					continue
+				}
+				field, fieldOk := row[0].(string)
+				fieldType, typeOk := row[1].(string)
+				if fieldOk && typeOk {
+					fields[field] = fieldType
+				}
 			}
+			types[series.Name] = fields
 		}
 	}
-	log.WithField("points", len(batch.Points())).Debug("Successfully parsed messages into points")
-	return batch
+	return types, nil
 }
 
-func (i *Influx) ParseMessage(message *sarama.ConsumerMessage) (*influx.Point, error) {
-	if message != nil && message.Value != nil {
-		point, err := models.ParsePointsWithPrecision(message.Value, time.Now().UTC(), i.config.Precision)
-		if err != nil || len(point) == 0 {
-			log.WithError(err).Debug("Failed to parse message")
-			MetricsInfluxParseFailure.Add(1)
-			return nil, err
-		}
-		return influx.NewPointFrom(point[0]), nil
-	}
-	return nil, nil
+// SeriesKey returns the measurement and sorted tag set identifying a series.
+func SeriesKey(name string, tags map[string]string) string {
+	return string(models.MakeKey([]byte(name), models.NewTags(tags)))
 }
 
-func (i *Influx) NewBatch() (influx.BatchPoints, error) {
-	batchConf := influx.BatchPointsConfig{i.config.Precision, i.config.Database, i.config.RetentionPolicy, i.config.WriteConsistency}
-	batch, err := influx.NewBatchPoints(batchConf)
+// withDefaultTags adds the tags the point does not already carry.
+func withDefaultTags(point *influx.Point, defaults map[string]string) *influx.Point {
+	if len(defaults) == 0 {
+		return point
+	}
+	tags := point.Tags()
+	for key, value := range defaults {
+		if _, ok := tags[key]; !ok {
+			tags[key] = value
+		}
+	}
+	fields, err := point.Fields()
 	if err != nil {
-		log.WithFields(log.Fields{"precision": i.config.Precision, "database": i.config.Database, "retentionPolicy": i.config.RetentionPolicy, "WriteConsistency": i.config.WriteConsistency}).Info("Failed to create batch points configuration")
-		return nil, err
+		return point
 	}
-	return batch, nil
+	tagged, err := influx.NewPoint(point.Name(), tags, fields, point.Time())
+	if err != nil {
+		return point
+	}
+	return tagged
 }
@@ -89,7 +89,7 @@ func Test_Influx_With_Valid_Configuration(t *testing.T) {
 			testCase.configuration.Url = influxSpy.URL
 			testCase.configuration.AcceptedErrors = []string{"write failed: field type conflict: input", "partial write"}
 			input, _ := influx.NewBatchPoints(influx.BatchPointsConfig{testCase.configuration.Precision, testCase.configuration.Database, testCase.configuration.RetentionPolicy, testCase.configuration.WriteConsistency})
-			sut := &Influx{testCase.configuration}
+			sut := &Influx{config: testCase.configuration}
 
 			actual := sut.Write(input)
 
@@ -99,3 +99,26 @@ func Test_Influx_With_Valid_Configuration(t *testing.T) {
 		})
 	}
 }
+
+func Test_Influx_Field_Types_Are_Read_From_Show_Field_Keys(t *testing.T) {
+	influxSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "SHOW FIELD KEYS" || r.URL.Query().Get("db") != "metrics" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["idle","float"],["count","integer"]]},{"name":"events","columns":["fieldKey","fieldType"],"values":[["message","string"]]}]}]}`))
+	}))
+	defer influxSpy.Close()
+	sut := &Influx{config: &InfluxConfig{Url: influxSpy.URL}}
+
+	actual, err := sut.FieldTypes("metrics")
+
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+		return
+	}
+	if actual["cpu"]["idle"] != "float" || actual["cpu"]["count"] != "integer" || actual["events"]["message"] != "string" {
+		t.Error(fmt.Sprintf("Unexpected field types %v", actual))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// influxSocket writes line protocol to the UDP listener of Influx, or to a raw
+// TCP line protocol listener. Neither acknowledges points, so offsets are
+// committed as soon as the points are sent. Listeners are bound to a database,
+// the database and retention policy of a batch are ignored.
+type influxSocket struct {
+	config *InfluxConfig
+	lock   sync.Mutex
+	conn   net.Conn
+}
+
+func newInfluxSocket(config *InfluxConfig) *influxSocket {
+	return &influxSocket{config: config}
+}
+
+// address accepts the listener as host:port or as udp://host:port.
+func (s *influxSocket) address() string {
+	if parsed, err := url.Parse(s.config.Url); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return s.config.Url
+}
+
+func (s *influxSocket) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout(s.config.Protocol, s.address(), s.config.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// influxPackets joins the lines of the points into packets of at most
+// payloadSize bytes, or into a single packet without a payload size. Points
+// longer than a packet are split across points with fewer fields.
+func influxPackets(points []*influx.Point, precision string, payloadSize int) ([][]byte, error) {
+	packets := [][]byte{}
+	packet := []byte{}
+	add := func(line string) {
+		if payloadSize > 0 && len(packet) > 0 && len(packet)+len(line)+1 > payloadSize {
+			packets = append(packets, packet)
+			packet = []byte{}
+		}
+		packet = append(packet, line...)
+		packet = append(packet, '\n')
+	}
+	for _, point := range points {
+		line := point.PrecisionString(precision)
+		if payloadSize == 0 || len(line)+1 <= payloadSize {
+			add(line)
+			continue
+		}
+		fields, err := point.Fields()
+		if err != nil {
+			return nil, err
+		}
+		split, err := models.NewPoint(point.Name(), models.NewTags(point.Tags()), fields, point.Time())
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range split.Split(payloadSize - 1) {
+			add(part.PrecisionString(precision))
+		}
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+func (s *influxSocket) Write(batch influx.BatchPoints) error {
+	if batch == nil || len(batch.Points()) == 0 {
+		return nil
+	}
+	payloadSize := 0
+	if s.config.Protocol == "udp" {
+		payloadSize = s.config.PayloadSize
+	}
+	packets, err := influxPackets(batch.Points(), batch.Precision(), payloadSize)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.connect(); err != nil {
+		MetricInfluxInitializationFailure.Add(1)
+		return err
+	}
+	for _, packet := range packets {
+		if s.config.Timeout > 0 {
+			s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			log.WithError(err).WithFields(log.Fields{"protocol": s.config.Protocol, "address": s.address()}).Error("Error while sending points")
+			s.conn.Close()
+			s.conn = nil
+			MetricsInfluxWriteFailure.Add(1)
+			return err
+		}
+		MetricsInfluxPacketsSent.Add(1)
+		MetricsInfluxBytesSent.Add(int64(len(packet)))
+	}
+	MetricsInfluxWriteSuccess.Add(int64(len(batch.Points())))
+	return nil
+}
+
+// Health connects to the listener unless connected already. A UDP listener
+// that is down goes unnoticed.
+func (s *influxSocket) Health() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.connect(); err != nil {
+		return fmt.Errorf("unable to reach influx %s listener %s: %s", s.config.Protocol, s.address(), err.Error())
+	}
+	return nil
+}
+
+func (s *influxSocket) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func socketPoints() []*influx.Point {
+	at := time.Unix(1527847200, 0)
+	cpu, _ := influx.NewPoint("cpu", map[string]string{"host": "web1"}, map[string]interface{}{"idle": 91.5, "user": 4.5, "system": 4.0}, at)
+	mem, _ := influx.NewPoint("mem", map[string]string{"host": "web1"}, map[string]interface{}{"used": int64(42)}, at)
+	return []*influx.Point{cpu, mem}
+}
+
+var InfluxPacketsTestCases = []struct {
+	label       string
+	precision   string
+	payloadSize int
+	expected    []string
+}{
+	{
+		"single packet without payload size",
+		"s",
+		0,
+		[]string{"cpu,host=web1 idle=91.5,system=4,user=4.5 1527847200\nmem,host=web1 used=42i 1527847200\n"},
+	},
+	{
+		"points split across packets",
+		"s",
+		60,
+		[]string{"cpu,host=web1 idle=91.5,system=4,user=4.5 1527847200\n", "mem,host=web1 used=42i 1527847200\n"},
+	},
+	{
+		"packets joining points",
+		"ns",
+		200,
+		[]string{"cpu,host=web1 idle=91.5,system=4,user=4.5 1527847200000000000\nmem,host=web1 used=42i 1527847200000000000\n"},
+	},
+	{
+		"point split across fields",
+		"ns",
+		48,
+		[]string{
+			"cpu,host=web1 idle=91.5 1527847200000000000\n",
+			"cpu,host=web1 system=4 1527847200000000000\n",
+			"cpu,host=web1 user=4.5 1527847200000000000\n",
+			"mem,host=web1 used=42i 1527847200000000000\n",
+		},
+	},
+}
+
+func Test_Influx_Packets(t *testing.T) {
+	for _, testCase := range InfluxPacketsTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			packets, err := influxPackets(socketPoints(), testCase.precision, testCase.payloadSize)
+
+			actual := []string{}
+			for _, packet := range packets {
+				actual = append(actual, string(packet))
+				if testCase.payloadSize > 0 && len(packet) > testCase.payloadSize {
+					t.Error(fmt.Sprintf("Packet of %d bytes exceeds payload size %d", len(packet), testCase.payloadSize))
+				}
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", testCase.expected) {
+				t.Error(fmt.Sprintf("Unexpected packets.\n\texpected: %q\n\tactual: %q", testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Influx_Writes_Udp_Packets(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sut, _ := NewInflux(&InfluxConfig{Url: "udp://" + listener.LocalAddr().String(), Protocol: "udp", PayloadSize: 60, Timeout: time.Second})
+	defer sut.Close()
+	batch, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Precision: "s"})
+	batch.AddPoints(socketPoints())
+	sent, bytes := MetricsInfluxPacketsSent.Value(), MetricsInfluxBytesSent.Value()
+
+	if err = sut.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := []string{}
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for len(actual) < 2 {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, string(buffer[:n]))
+	}
+	expected := []string{"cpu,host=web1 idle=91.5,system=4,user=4.5 1527847200\n", "mem,host=web1 used=42i 1527847200\n"}
+	if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+		t.Error(fmt.Sprintf("Unexpected packets.\n\texpected: %q\n\tactual: %q", expected, actual))
+	}
+	if MetricsInfluxPacketsSent.Value()-sent != 2 || MetricsInfluxBytesSent.Value()-bytes != int64(len(expected[0])+len(expected[1])) {
+		t.Error("Expected packets and bytes sent to be counted")
+	}
+}
+
+func Test_Influx_Writes_Tcp_Lines(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		lines := []string{}
+		scanner := bufio.NewScanner(conn)
+		for len(lines) < 2 && scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+	sut, _ := NewInflux(&InfluxConfig{Url: listener.Addr().String(), Protocol: "tcp", PayloadSize: 10, Timeout: time.Second})
+	defer sut.Close()
+	batch, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Precision: "s"})
+	batch.AddPoints(socketPoints())
+
+	if err = sut.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := strings.Join(<-received, "\n"); actual != "cpu,host=web1 idle=91.5,system=4,user=4.5 1527847200\nmem,host=web1 used=42i 1527847200" {
+		t.Error(fmt.Sprintf("Unexpected lines %q", actual))
+	}
+}
+
+func Test_Influx_Tcp_Listener_Unavailable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+	sut, _ := NewInflux(&InfluxConfig{Url: address, Protocol: "tcp", Timeout: 100 * time.Millisecond})
+	batch, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Precision: "s"})
+	batch.AddPoints(socketPoints())
+
+	if sut.Write(batch) == nil || sut.Health() == nil {
+		t.Error("Expected write without listener to fail")
+	}
+}
+
+func Test_Influx_Unknown_Protocol(t *testing.T) {
+	if _, err := NewInflux(&InfluxConfig{Protocol: "quic"}); err == nil {
+		t.Error("Expected unknown protocol to be refused")
+	}
+}
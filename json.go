@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"strconv"
+	"time"
+)
+
+type JsonConfig struct {
+	Measurement    string
+	MeasurementKey string
+	TimeKey        string
+	TimeFormat     string
+	TagKeys        []string
+	StringFields   []string
+}
+
+// JsonParser turns a JSON object, or an array of objects, into one point per
+// object. Nested objects are flattened with keys joined by underscores. Numbers
+// and booleans become fields, strings are only kept when listed as tag keys or
+// string fields.
+type JsonParser struct {
+	config *JsonConfig
+}
+
+func (p *JsonParser) Parse(message *sarama.ConsumerMessage, defaultTime time.Time) ([]*influx.Point, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(message.Value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	objects := []interface{}{document}
+	if array, ok := document.([]interface{}); ok {
+		objects = array
+	}
+
+	points := []*influx.Point{}
+	for _, object := range objects {
+		object, ok := object.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("json message is not an object or an array of objects")
+		}
+		point, err := p.point(object, defaultTime)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func (p *JsonParser) point(object map[string]interface{}, defaultTime time.Time) (*influx.Point, error) {
+	flattened := make(map[string]interface{})
+	flattenJson("", object, flattened)
+
+	measurement := p.config.Measurement
+	if p.config.MeasurementKey != "" {
+		if value, ok := flattened[p.config.MeasurementKey].(string); ok && value != "" {
+			measurement = value
+		}
+		delete(flattened, p.config.MeasurementKey)
+	}
+	if measurement == "" {
+		return nil, errors.New("json message has no measurement")
+	}
+
+	timestamp := defaultTime
+	if p.config.TimeKey != "" {
+		if value, ok := flattened[p.config.TimeKey]; ok {
+			parsed, err := parseTimeValue(value, p.config.TimeFormat)
+			if err != nil {
+				return nil, err
+			}
+			timestamp = parsed
+		}
+		delete(flattened, p.config.TimeKey)
+	}
+
+	tags := make(map[string]string)
+	for _, key := range p.config.TagKeys {
+		if value, ok := flattened[key]; ok {
+			tags[key] = fmt.Sprint(value)
+			delete(flattened, key)
+		}
+	}
+
+	fields := make(map[string]interface{})
+	for key, value := range flattened {
+		switch value := value.(type) {
+		case json.Number:
+			number, err := value.Float64()
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = number
+		case bool:
+			fields[key] = value
+		case string:
+			if contains(p.config.StringFields, key) {
+				fields[key] = value
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("json message has no fields")
+	}
+	return influx.NewPoint(measurement, tags, fields, timestamp)
+}
+
+func flattenJson(prefix string, value interface{}, flattened map[string]interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range value {
+			if prefix != "" {
+				key = prefix + "_" + key
+			}
+			flattenJson(key, nested, flattened)
+		}
+	case []interface{}:
+		for i, nested := range value {
+			flattenJson(prefix+"_"+strconv.Itoa(i), nested, flattened)
+		}
+	case nil:
+	default:
+		flattened[prefix] = value
+	}
+}
+
+// parseTimeValue reads a unix timestamp in the unit named by the format, or a
+// string in the given time layout, RFC3339 by default.
+func parseTimeValue(value interface{}, format string) (time.Time, error) {
+	switch format {
+	case "unix", "unix_ms", "unix_us", "unix_ns":
+		var text string
+		switch value := value.(type) {
+		case json.Number:
+			text = value.String()
+		case string:
+			text = value
+		default:
+			return time.Time{}, fmt.Errorf("time %v is not a number", value)
+		}
+		unit := map[string]int64{"unix": 1e9, "unix_ms": 1e6, "unix_us": 1e3, "unix_ns": 1}[format]
+		if whole, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return time.Unix(0, whole*unit).UTC(), nil
+		}
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(number*float64(unit))).UTC(), nil
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("time %v is not a string", value)
+	}
+	layout := format
+	if layout == "" || layout == "rfc3339" {
+		layout = time.RFC3339Nano
+	}
+	return time.Parse(layout, text)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+var JsonParserTestCases = []struct {
+	label         string
+	config        *JsonConfig
+	value         string
+	expected      []string
+	expectedError bool
+}{
+	{
+		"Should Parse Object With Static Measurement",
+		&JsonConfig{Measurement: "cpu", TimeKey: "time", TimeFormat: "unix"},
+		`{"time": 1501096898, "usage": 12.5, "idle": true}`,
+		[]string{"cpu idle=true,usage=12.5 1501096898000000000"},
+		false,
+	},
+	{
+		"Should Parse Array With Measurement Key, Tags And Nested Fields",
+		&JsonConfig{MeasurementKey: "name", TagKeys: []string{"host"}, TimeKey: "ts", TimeFormat: "unix_ns"},
+		`[{"name": "mem", "host": "a", "ts": 1501096898000000001, "usage": {"used": 1, "free": 2}}]`,
+		[]string{"mem,host=a usage_free=2,usage_used=1 1501096898000000001"},
+		false,
+	},
+	{
+		"Should Keep Configured String Fields And Parse RFC3339 Time",
+		&JsonConfig{Measurement: "deploy", StringFields: []string{"version"}, TimeKey: "at", TimeFormat: "rfc3339"},
+		`{"at": "2017-07-26T19:21:38Z", "version": "1.2", "ignored": "x", "count": 1}`,
+		[]string{"deploy count=1,version=\"1.2\" 1501096898000000000"},
+		false,
+	},
+	{
+		"Should Reject Message Without Measurement",
+		&JsonConfig{},
+		`{"value": 1}`,
+		nil,
+		true,
+	},
+	{
+		"Should Reject Message Without Fields",
+		&JsonConfig{Measurement: "cpu"},
+		`{"host": "a"}`,
+		nil,
+		true,
+	},
+	{
+		"Should Reject Invalid Json",
+		&JsonConfig{Measurement: "cpu"},
+		`cpu value=1`,
+		nil,
+		true,
+	},
+}
+
+func Test_Json_Parser(t *testing.T) {
+	for _, testCase := range JsonParserTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut := &JsonParser{testCase.config}
+			points, err := sut.Parse(&sarama.ConsumerMessage{Value: []byte(testCase.value)}, time.Now())
+			if testCase.expectedError {
+				if err == nil {
+					t.Error(fmt.Sprintf("%s: expected error parsing %s", testCase.label, testCase.value))
+				}
+				return
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			actual := pointStrings(points)
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
@@ -8,11 +8,17 @@ import (
 )
 
 type KafkaConfig struct {
-	Brokers        string
-	Topics         string
-	ConsumerGroup  string
-	LoggingEnabled bool
-	Cluster        *cluster.Config
+	Brokers            string
+	Topics             string
+	TopicPattern       string
+	TopicConfigs       []*TopicConfig
+	Format             string
+	PayloadCompression string
+	MaxPayloadSize     int64
+	DeadLetterTopic    string
+	ConsumerGroup      string
+	LoggingEnabled     bool
+	Cluster            *cluster.Config
 }
 
 type Consumer interface {
@@ -26,39 +32,95 @@ type KafkaConsumer struct {
 	Consumer   *cluster.Consumer
 }
 
+// Offset is the end of a partition when a backfill started. Mark is the
+// offset the next message produced will get, so the partition is caught up
+// once the message at mark-1 is processed. Partitions holding no message are
+// finished from the start.
 type Offset struct {
-	finished	bool
-	mark		int64
+	finished bool
+	mark     int64
 }
 
-func GetCurrentoffset(userConfig *KafkaConfig) (map[int32]Offset) {
-	offsets := make(map[int32]Offset)
-	client, err := sarama.NewClient(strings.Split(userConfig.Brokers, ","), &userConfig.Cluster.Config)
-	if err != nil {
+// offsetClient is the part of sarama.Client needed to snapshot offsets.
+type offsetClient interface {
+	Topics() ([]string, error)
+	Partitions(topic string) ([]int32, error)
+	GetOffset(topic string, partitionID int32, time int64) (int64, error)
+}
 
+// consumedTopics returns the configured topics along with the existing topics
+// matching the topic pattern.
+func consumedTopics(client offsetClient, userConfig *KafkaConfig) ([]string, error) {
+	topics := []string{}
+	seen := make(map[string]bool)
+	for _, topic := range strings.Split(userConfig.Topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	if pattern := userConfig.Cluster.Group.Topics.Whitelist; pattern != nil {
+		existing, err := client.Topics()
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range existing {
+			if pattern.MatchString(topic) && !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
 	}
-	defer client.Close()
+	return topics, nil
+}
 
-	partitionIds, err := client.WritablePartitions(userConfig.Topics)
+// offsetRanges returns the oldest and newest offsets of every partition of the
+// consumed topics.
+func offsetRanges(client offsetClient, userConfig *KafkaConfig) (map[topicPartition]replayRange, error) {
+	topics, err := consumedTopics(client, userConfig)
 	if err != nil {
-
+		return nil, err
 	}
-
-	for _, partitionId := range partitionIds {
-		offset, err := client.GetOffset(userConfig.Topics, partitionId, sarama.OffsetNewest)
+	ranges := make(map[topicPartition]replayRange)
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
 		if err != nil {
-
+			return nil, err
+		}
+		for _, partition := range partitions {
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+			oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				return nil, err
+			}
+			ranges[topicPartition{topic, partition}] = replayRange{oldest, newest}
 		}
-		offsets[partitionId] = Offset{finished: false, mark: offset}
+	}
+	return ranges, nil
+}
+
+// rangeOffsets returns the offsets a backfill of the ranges ends at.
+func rangeOffsets(ranges map[topicPartition]replayRange) map[topicPartition]Offset {
+	offsets := make(map[topicPartition]Offset)
+	for key, offsetRange := range ranges {
+		offsets[key] = Offset{finished: offsetRange.start >= offsetRange.end, mark: offsetRange.end}
 	}
 	return offsets
 }
 
 func NewKafkaConsumer(userConfig *KafkaConfig) (*KafkaConsumer, error) {
 	brokers := strings.Split(userConfig.Brokers, ",")
-	topics := strings.Split(userConfig.Topics, ",")
+	// Topics matching the pattern are picked up by the consumer itself as
+	// metadata is refreshed, see Config.Group.Topics.Whitelist.
+	var topics []string
+	if userConfig.Topics != "" {
+		topics = strings.Split(userConfig.Topics, ",")
+	}
 
-	log.WithFields(log.Fields{"brokers": userConfig.Brokers, "topics": userConfig.Topics}).Debug("Creating new kafka consumer")
+	log.WithFields(log.Fields{"brokers": userConfig.Brokers, "topics": userConfig.Topics, "topicPattern": userConfig.TopicPattern}).Debug("Creating new kafka consumer")
 	consumer, err := cluster.NewConsumer(brokers, userConfig.ConsumerGroup, topics, userConfig.Cluster)
 	if err != nil {
 		log.WithFields(log.Fields{"brokers": userConfig.Brokers, "topics": userConfig.Topics}).WithError(err).Error("Error creating new kafka consumer")
@@ -83,6 +145,10 @@ func (c *KafkaConsumer) ConsumeMessage() (*sarama.ConsumerMessage, error) {
 	case ntf, more := <-c.Consumer.Notifications():
 		if more {
 			log.Printf("Rebalanced: %+v\n", ntf)
+			if ntf.Type == cluster.RebalanceOK {
+				MetricsKafkaRebalances.Add(1)
+				subscribedTopics.set(c.userConfig.TopicPattern, ntf.Current)
+			}
 		}
 	}
 	return nil, nil
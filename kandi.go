@@ -1,21 +1,180 @@
 package main
 
 import (
+	"fmt"
 	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 type Kandi struct {
-	conf     *Config
-	Consumer Consumer
-	Influx   *Influx
+	conf           *Config
+	Consumer       Consumer
+	Influx         *Influx
+	Sink           Sink
 	PostProcessors []func(processedMessages []*sarama.ConsumerMessage) bool
+	Stages         []Stage
+	DeadLetter     DeadLetter
+	Archive        *Archive
+	topics         map[string]*topicHandler
+	fallback       *topicHandler
+	statsd         map[*topicHandler]*Statsd
+	downsample     map[*topicHandler]*Downsampler
+	offsets        *OffsetTracker
+	// MaxRetries is the number of times in a row a batch is retried before
+	// processing gives up, 0 to retry forever.
+	MaxRetries int
+	err        error
+	// consumerLock guards the consumer, which is created by the consuming
+	// goroutine but closed by Start.
+	consumerLock   sync.Mutex
+	consumerClosed bool
+}
+
+// delivery holds prepared batches until they are written. Retrying a delivery
+// never re-parses its messages, so aggregation stages only see them once, and
+// never rewrites the batches that were already written.
+type delivery struct {
+	batches  []influx.BatchPoints
+	written  int
+	consumed []*sarama.ConsumerMessage
+	commit   []*sarama.ConsumerMessage
 }
 
 func NewKandi(conf *Config) *Kandi {
-	influx := &Influx{conf.Influx}
-	return &Kandi{conf: conf, Influx: influx, PostProcessors: []func(processedMessages []*sarama.ConsumerMessage) bool {}}
+	influx, err := NewInflux(conf.Influx)
+	if err != nil {
+		log.WithError(err).Error("Unable to create influx")
+		panic(fmt.Sprintf("Unable to create influx: %s", err.Error()))
+	}
+	kandi := &Kandi{conf: conf, Influx: influx, PostProcessors: []func(processedMessages []*sarama.ConsumerMessage) bool{}, topics: make(map[string]*topicHandler), statsd: make(map[*topicHandler]*Statsd), downsample: make(map[*topicHandler]*Downsampler), offsets: NewOffsetTracker()}
+	if conf.Kafka.DeadLetterTopic != "" {
+		kandi.DeadLetter = NewKafkaDeadLetter(conf.Kafka)
+	}
+	if dedup := conf.Kandi.Dedup; dedup != nil && dedup.Window > 0 {
+		stage, err := NewDedup(dedup)
+		if err != nil {
+			log.WithError(err).Error("Unable to create deduplication")
+			panic(fmt.Sprintf("Unable to create deduplication: %s", err.Error()))
+		}
+		kandi.Stages = append(kandi.Stages, stage)
+	}
+	if len(conf.Kandi.Enrich) > 0 {
+		enrich, err := NewEnrich(conf.Kandi.Enrich)
+		if err != nil {
+			log.WithError(err).Error("Unable to create enrichment")
+			panic(fmt.Sprintf("Unable to create enrichment: %s", err.Error()))
+		}
+		kandi.Stages = append(kandi.Stages, enrich)
+	}
+	if validation := conf.Kandi.Validation; validation != nil && (validation.MaxPast > 0 || validation.MaxFuture > 0) {
+		kandi.Stages = append(kandi.Stages, NewTimestampValidation(validation, kandi.DeadLetter))
+	}
+	if len(conf.Kandi.Filters) > 0 {
+		filter, err := NewFilter(conf.Kandi.Filters)
+		if err != nil {
+			log.WithError(err).Error("Unable to create filter rules")
+			panic(fmt.Sprintf("Unable to create filter rules: %s", err.Error()))
+		}
+		kandi.Stages = append(kandi.Stages, filter)
+	}
+	if len(conf.Kandi.Transforms) > 0 {
+		transform, err := NewTransform(conf.Kandi.Transforms)
+		if err != nil {
+			log.WithError(err).Error("Unable to create transform rules")
+			panic(fmt.Sprintf("Unable to create transform rules: %s", err.Error()))
+		}
+		kandi.Stages = append(kandi.Stages, transform)
+	}
+	for _, config := range conf.Kandi.Scripts {
+		script, err := NewScript(config)
+		if err != nil {
+			log.WithError(err).WithField("script", config.Name).Error("Unable to compile script")
+			panic(fmt.Sprintf("Unable to compile script %s: %s", config.Name, err.Error()))
+		}
+		kandi.Stages = append(kandi.Stages, script)
+	}
+	if cardinality := conf.Kandi.Cardinality; cardinality != nil && cardinality.Limit > 0 {
+		kandi.Stages = append(kandi.Stages, NewCardinalityLimiter(cardinality))
+	}
+	if coercion := conf.Kandi.Coercion; coercion != nil && (coercion.Learn || len(coercion.Fields) > 0) {
+		kandi.Stages = append(kandi.Stages, kandi.newCoercion(coercion))
+	}
+	if archive := conf.Kandi.Archive; archive != nil && archive.Directory != "" {
+		var err error
+		if kandi.Archive, err = NewArchive(archive); err != nil {
+			log.WithError(err).Error("Unable to create archive")
+			panic(fmt.Sprintf("Unable to create archive: %s", err.Error()))
+		}
+	}
+	sink, err := NewSink(conf, influx)
+	if err != nil {
+		log.WithError(err).Error("Unable to create sink")
+		panic(fmt.Sprintf("Unable to create sink: %s", err.Error()))
+	}
+	kandi.Sink = sink
+	sinkHealth.set(sink)
+	kandi.fallback = kandi.addTopic(&TopicConfig{Tags: map[string]string{}})
+	for _, topic := range conf.Kafka.TopicConfigs {
+		kandi.topics[topic.Name] = kandi.addTopic(topic)
+	}
+	return kandi
+}
+
+// newCoercion builds the coercion stage from the field types already stored in
+// every database kandi writes to, then from the declared types. Databases are
+// not told apart, a measurement is expected to keep its types across them.
+func (k *Kandi) newCoercion(config *CoercionConfig) *Coercion {
+	coercion := NewCoercion()
+	if config.Learn {
+		databases := map[string]bool{k.conf.Influx.Database: true}
+		for _, topic := range k.conf.Kafka.TopicConfigs {
+			if topic.Database != "" {
+				databases[topic.Database] = true
+			}
+		}
+		for database := range databases {
+			types, err := k.Influx.FieldTypes(database)
+			if err != nil {
+				log.WithError(err).WithField("database", database).Warn("Unable to learn field types")
+				continue
+			}
+			for measurement, fields := range types {
+				for field, fieldType := range fields {
+					coercion.Learn(measurement, field, fieldType)
+				}
+			}
+		}
+	}
+	for _, declared := range config.Fields {
+		coercion.Learn(declared.Measurement, declared.Field, declared.Type)
+	}
+	return coercion
+}
+
+func (k *Kandi) addTopic(topic *TopicConfig) *topicHandler {
+	handler, err := newTopicHandler(topic, k.conf)
+	if err != nil {
+		log.WithError(err).WithField("topic", topic.Name).Error("Unable to create parser for configured input format.")
+		panic(fmt.Sprintf("Unable to create parser for topic %s", topic.Name))
+	}
+	if handler.parser == nil {
+		k.statsd[handler] = NewStatsd(k.conf.Kandi.Statsd)
+	} else if downsample := handler.config.Downsample; downsample != nil && downsample.Window > 0 {
+		k.downsample[handler] = NewDownsampler(downsample)
+	}
+	return handler
+}
+
+// topic returns the handler configured for the topic, or the global settings
+// for topics that are not configured individually.
+func (k *Kandi) topic(name string) *topicHandler {
+	if handler, ok := k.topics[name]; ok {
+		return handler
+	}
+	return k.fallback
 }
 
 var MESSAGES_READY_TO_PROCESS chan []*sarama.ConsumerMessage
@@ -35,9 +194,21 @@ func (k *Kandi) Start() bool {
 
 	doneProcessing := <-PROCESSING_COMPLETED
 	log.WithField("doneProcessing", doneProcessing).Debug("Completed Processing")
-	STOP_CONSUMING <-true
+	STOP_CONSUMING <- true
+	// Closing the consumer interrupts it when it waits for messages that never
+	// come, such as once a backfilled topic is drained.
+	k.closeConsumer()
 	doneConsuming := <-CONSUMING_COMPLETED
 	log.WithField("doneConsuming", doneConsuming).Debug("Completed Consuming")
+	if deadLetter, ok := k.DeadLetter.(*KafkaDeadLetter); ok {
+		deadLetter.Close()
+	}
+	if k.Archive != nil {
+		k.Archive.Close()
+	}
+	if err := k.Sink.Close(); err != nil {
+		log.WithError(err).Warn("Unable to close sink")
+	}
 	defer close(PROCESSING_COMPLETED)
 	defer close(MESSAGES_READY_TO_PROCESS)
 	return true
@@ -55,16 +226,18 @@ func (k *Kandi) ConsumeMessages() {
 			} else {
 				log.Debug("STOP_CONSUMING channel already closed")
 			}
-			log.Debug("Stopping consumer")
-			if k.Consumer != nil {
-				k.Consumer.Close()
-			}
-			CONSUMING_COMPLETED <- true
+			k.stopConsuming()
 			return
 		default:
 			batchOfMessages, err := k.fromKafka()
 			if batchOfMessages != nil && len(batchOfMessages) > 0 {
-				MESSAGES_READY_TO_PROCESS <- batchOfMessages
+				// Processing may have completed and stopped reading.
+				select {
+				case MESSAGES_READY_TO_PROCESS <- batchOfMessages:
+				case <-STOP_CONSUMING:
+					k.stopConsuming()
+					return
+				}
 			}
 			if err != nil {
 				backoff.Handle()
@@ -73,14 +246,45 @@ func (k *Kandi) ConsumeMessages() {
 	}
 }
 
-func (k *Kandi) fromKafka() ([]*sarama.ConsumerMessage, error) {
-	if k.Consumer == nil {
+func (k *Kandi) stopConsuming() {
+	log.Debug("Stopping consumer")
+	k.closeConsumer()
+	CONSUMING_COMPLETED <- true
+}
+
+// closeConsumer closes the consumer once, and keeps a new one from being
+// created afterwards.
+func (k *Kandi) closeConsumer() {
+	k.consumerLock.Lock()
+	defer k.consumerLock.Unlock()
+	if k.consumerClosed {
+		return
+	}
+	k.consumerClosed = true
+	if k.Consumer != nil {
+		k.Consumer.Close()
+	}
+}
+
+// consumer returns the consumer, creating it first if need be. It returns nil
+// once the consumer was closed without ever being created.
+func (k *Kandi) consumer() (Consumer, error) {
+	k.consumerLock.Lock()
+	defer k.consumerLock.Unlock()
+	if k.Consumer == nil && !k.consumerClosed {
 		consumer, err := NewKafkaConsumer(k.conf.Kafka)
-		if err == nil {
-			k.Consumer = consumer
-		} else {
+		if err != nil {
 			return nil, err
 		}
+		k.Consumer = consumer
+	}
+	return k.Consumer, nil
+}
+
+func (k *Kandi) fromKafka() ([]*sarama.ConsumerMessage, error) {
+	consumer, err := k.consumer()
+	if err != nil || consumer == nil {
+		return nil, err
 	}
 
 	maxDuration := k.conf.Kandi.Batch.Duration
@@ -96,7 +300,7 @@ func (k *Kandi) fromKafka() ([]*sarama.ConsumerMessage, error) {
 			break
 		}
 
-		message, err := k.Consumer.ConsumeMessage()
+		message, err := consumer.ConsumeMessage()
 		if err != nil {
 			log.WithError(err).Error("Kafka encountered an error while consuming")
 			MetricsKafkaConsumptionError.Add(1)
@@ -113,56 +317,272 @@ func (k *Kandi) Process() {
 	log.Debug("Starting to process messages")
 	backoff := NewBackoffHandler("influx", k.conf)
 
-	var batchOfMessages []*sarama.ConsumerMessage
+	var pending *delivery
+	failures := 0
 
 	for {
-		if batchOfMessages == nil {
-			messagesFromKafka, ok := <-MESSAGES_READY_TO_PROCESS
-			if ok {
-				batchOfMessages = messagesFromKafka
+		var err error
+		if pending == nil {
+			select {
+			case messagesFromKafka, ok := <-MESSAGES_READY_TO_PROCESS:
+				if ok {
+					pending, err = k.prepare(messagesFromKafka)
+				}
+			case <-k.flushTimer():
+				pending, err = k.prepare(nil)
 			}
 		} else {
-			stop, err := k.toInflux(batchOfMessages)
-			if err != nil {
-				backoff.Handle()
-			} else if stop {
-				PROCESSING_COMPLETED <- true
-			} else {
-				batchOfMessages = nil
+			var stop bool
+			if stop, err = k.deliver(pending); err == nil {
+				pending = nil
+				failures = 0
+				if stop {
+					k.err = k.flush(backoff)
+					PROCESSING_COMPLETED <- k.err == nil
+					return
+				}
 			}
 		}
+		if err != nil && k.retry(backoff, &failures, err) {
+			k.err = err
+			PROCESSING_COMPLETED <- false
+			return
+		}
 	}
 }
 
-func (k *Kandi) toInflux(batchOfMessages []*sarama.ConsumerMessage) (bool, error) {
-	startTime := time.Now()
+// retry backs off after a failed attempt. It returns true once MaxRetries
+// attempts in a row failed and processing should give up.
+func (k *Kandi) retry(backoff *BackoffHandler, failures *int, err error) bool {
+	if *failures++; k.MaxRetries > 0 && *failures > k.MaxRetries {
+		log.WithError(err).WithField("attempts", *failures).Error("Giving up processing")
+		return true
+	}
+	backoff.Handle()
+	return false
+}
 
-	influxBatch, err := k.Influx.NewBatch()
+// flush writes the windows still open when processing stops, rather than
+// dropping them, and commits the offsets they held.
+func (k *Kandi) flush(backoff *BackoffHandler) error {
+	batches := make(map[destination]influx.BatchPoints)
+	if err := k.flushAggregates(batches, time.Now().UTC(), true); err != nil {
+		return err
+	}
+	prepared := k.newDelivery(nil, batches)
+	failures := 0
+	for {
+		err := k.write(prepared)
+		if err == nil {
+			if held := k.offsets.Held(); held > 0 {
+				log.WithField("messages", held).Warn("Offsets of messages still held are not committed")
+			}
+			return nil
+		}
+		if k.retry(backoff, &failures, err) {
+			return err
+		}
+	}
+}
+
+// Err returns the error processing gave up on, if any.
+func (k *Kandi) Err() error {
+	return k.err
+}
+
+// flushTimer fires when an aggregation window is due so that windows are
+// written even when no new messages arrive.
+func (k *Kandi) flushTimer() <-chan time.Time {
+	var interval time.Duration
+	if len(k.statsd) > 0 {
+		interval = k.conf.Kandi.Statsd.FlushInterval
+	}
+	for handler := range k.downsample {
+		if window := handler.config.Downsample.Window; interval == 0 || window < interval {
+			interval = window
+		}
+	}
+	if interval == 0 {
+		return nil
+	}
+	return time.After(interval)
+}
+
+func (k *Kandi) toInflux(batchOfMessages []*sarama.ConsumerMessage) (bool, error) {
+	prepared, err := k.prepare(batchOfMessages)
 	if err != nil {
-		log.WithError(err).Error("Failed to create new influx batch")
 		return false, err
 	}
+	return k.deliver(prepared)
+}
 
+func (k *Kandi) prepare(batchOfMessages []*sarama.ConsumerMessage) (*delivery, error) {
+	batches := make(map[destination]influx.BatchPoints)
+	// The fallback destination is always written, even when empty.
+	if _, err := k.batchFor(batches, k.fallback.destination); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
 	for _, message := range batchOfMessages {
-		point, err := k.Influx.ParseMessage(message)
-		if err == nil && point != nil {
-			influxBatch.AddPoint(point)
+		if message == nil {
+			continue
+		}
+		k.offsets.Track(message)
+		handler := k.topic(message.Topic)
+		if err := k.decompress(handler, message); err != nil {
+			log.WithError(err).WithField("topic", message.Topic).Debug("Failed to decompress message")
+			MetricsPayloadDecompressFailure.Add(1)
+			k.offsets.Done(message)
+			continue
+		}
+		if statsd, ok := k.statsd[handler]; ok {
+			if !statsd.Add(message) {
+				k.offsets.Done(message)
+			}
+			continue
+		}
+		if len(message.Value) != 0 {
+			points, err := handler.parser.Parse(message, handler.config.Timestamp.defaultTime(message, now))
+			if err != nil {
+				log.WithError(err).WithField("topic", message.Topic).Debug("Failed to parse message")
+				MetricsInfluxParseFailure.Add(1)
+			} else if downsampler, ok := k.downsample[handler]; ok {
+				if downsampler.Add(k.process(handler, points, message), message, now) {
+					continue
+				}
+			} else if err = k.addPoints(batches, handler, k.process(handler, points, message)); err != nil {
+				return nil, err
+			}
+		}
+		k.offsets.Done(message)
+	}
+
+	if err := k.flushAggregates(batches, now, false); err != nil {
+		return nil, err
+	}
+	return k.newDelivery(batchOfMessages, batches), nil
+}
+
+// flushAggregates adds the points of the statsd and downsample windows that
+// are due, or of every window when forced, and releases the messages they
+// held.
+func (k *Kandi) flushAggregates(batches map[destination]influx.BatchPoints, now time.Time, force bool) error {
+	for handler, statsd := range k.statsd {
+		points, released := statsd.Flush(now, force)
+		if err := k.addPoints(batches, handler, k.process(handler, points, nil)); err != nil {
+			return err
+		}
+		for _, message := range released {
+			k.offsets.Done(message)
+		}
+	}
+	for handler, downsampler := range k.downsample {
+		points, released := downsampler.Flush(now, force)
+		if err := k.addPoints(batches, handler, points); err != nil {
+			return err
+		}
+		for _, message := range released {
+			k.offsets.Done(message)
 		}
 	}
+	return nil
+}
 
-	err = k.Influx.Write(influxBatch)
+func (k *Kandi) newDelivery(consumed []*sarama.ConsumerMessage, batches map[destination]influx.BatchPoints) *delivery {
+	prepared := &delivery{consumed: consumed, commit: k.offsets.Ready()}
+	for _, batch := range batches {
+		prepared.batches = append(prepared.batches, batch)
+	}
+	return prepared
+}
+
+func (k *Kandi) batchFor(batches map[destination]influx.BatchPoints, to destination) (influx.BatchPoints, error) {
+	if batch, ok := batches[to]; ok {
+		return batch, nil
+	}
+	batch, err := k.Influx.NewDestinationBatch(to.database, to.retentionPolicy)
 	if err != nil {
-		return false, err
+		log.WithError(err).Error("Failed to create new influx batch")
+		return nil, err
 	}
+	batches[to] = batch
+	return batch, nil
+}
 
-	k.Consumer.MarkOffset(batchOfMessages)
-	MetricsInfluxProcessDuration.Add(time.Since(startTime).Nanoseconds())
+// decompress replaces the value of the message with its decompressed payload.
+// The message itself is updated, rather than a copy, as aggregation windows
+// hold on to it until their offsets are released.
+func (k *Kandi) decompress(handler *topicHandler, message *sarama.ConsumerMessage) error {
+	compression := handler.config.PayloadCompression
+	if compression == "" || compression == "none" || len(message.Value) == 0 {
+		return nil
+	}
+	value, err := decompressPayload(message.Value, compression, handler.config.MaxPayloadSize)
+	if err != nil {
+		return err
+	}
+	message.Value = value
+	return nil
+}
+
+// process tags the points of a message with the defaults of its topic and
+// runs them through the stages. Points flushed from a statsd window have no
+// message.
+func (k *Kandi) process(handler *topicHandler, points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	for i, point := range points {
+		points[i] = withDefaultTags(point, handler.config.Tags)
+	}
+	return applyStages(k.Stages, points, message)
+}
+
+func (k *Kandi) addPoints(batches map[destination]influx.BatchPoints, handler *topicHandler, points []*influx.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	batch, err := k.batchFor(batches, handler.destination)
+	if err != nil {
+		return err
+	}
+	batch.AddPoints(points)
+	return nil
+}
+
+func (k *Kandi) deliver(prepared *delivery) (bool, error) {
+	if err := k.write(prepared); err != nil {
+		return false, err
+	}
 	for _, processor := range k.PostProcessors {
-		stop := processor(batchOfMessages)
+		stop := processor(prepared.consumed)
 		if stop {
 			log.Debug("Post processing triggered processing to stop")
 			return true, nil
 		}
 	}
 	return false, nil
-}
\ No newline at end of file
+}
+
+// write writes the batches of the delivery and commits its offsets.
+func (k *Kandi) write(prepared *delivery) error {
+	startTime := time.Now()
+
+	for ; prepared.written < len(prepared.batches); prepared.written++ {
+		err := k.Sink.Write(prepared.batches[prepared.written])
+		if err != nil {
+			return err
+		}
+	}
+	// Offsets are only committed once their points are archived as well.
+	if k.Archive != nil {
+		if err := k.Archive.Write(prepared.batches, prepared.consumed); err != nil {
+			log.WithError(err).Error("Failed to archive batch")
+			return err
+		}
+	}
+
+	if len(prepared.commit) > 0 {
+		k.Consumer.MarkOffset(prepared.commit)
+	}
+	MetricsInfluxProcessDuration.Add(time.Since(startTime).Nanoseconds())
+	return nil
+}
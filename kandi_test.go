@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -267,3 +268,266 @@ func (suite *KandiTestSuite) AssertOffsetsCommitted(sut *Kandi, t *testing.T) {
 		}
 	}
 }
+
+func Test_Should_Dispatch_Messages_By_Topic(t *testing.T) {
+	written := make(map[string][]string)
+	influxHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				written[r.URL.Query().Get("db")] = append(written[r.URL.Query().Get("db")], line)
+			}
+		}
+	}))
+	defer influxHandler.Close()
+
+	conf := NewKandiTestConfig(influxHandler.URL, 3)
+	conf.Kafka.TopicConfigs = []*TopicConfig{
+		{Name: "metrics-json", Format: "json", Database: "jsondb", Tags: map[string]string{"source": "json", "host": "default"}, Json: &JsonConfig{Measurement: "cpu", TagKeys: []string{"host"}}},
+		{Name: "metrics-graphite", Format: "graphite", Graphite: &GraphiteConfig{Separator: "."}},
+	}
+	sut := NewKandi(conf)
+	sut.Consumer = NewMockConsumer([]string{})
+	log.SetLevel(log.PanicLevel)
+
+	input := []*sarama.ConsumerMessage{
+		{Topic: "metrics-line", Value: []byte("mem value=1 1501096898000000000")},
+		{Topic: "metrics-json", Value: []byte(`{"host": "a", "value": 2}`)},
+		{Topic: "metrics-graphite", Value: []byte("disk.used 3 1501096898")},
+	}
+	_, err := sut.toInflux(input)
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error dispatching messages by topic: %s", err.Error()))
+	}
+
+	expected := map[string][]string{
+		"testdb": {"disk.used value=3 1501096898000000000", "mem value=1 1501096898000000000"},
+		"jsondb": {"cpu,host=a,source=json value=2"},
+	}
+	for database, lines := range expected {
+		actual := written[database]
+		if len(actual) != len(lines) {
+			t.Error(fmt.Sprintf("Expected %d points written to %s but found %v", len(lines), database, actual))
+			continue
+		}
+		for _, line := range lines {
+			found := false
+			for _, candidate := range actual {
+				if strings.HasPrefix(candidate, line) {
+					found = true
+				}
+			}
+			if !found {
+				t.Error(fmt.Sprintf("Expected %s to be written to %s but found %v", line, database, actual))
+			}
+		}
+	}
+}
+
+// boundedConsumer returns its lines once, then nothing, like the consumers of
+// backfill, replay and import.
+type boundedConsumer struct {
+	lock      sync.Mutex
+	lines     []string
+	next      int
+	marked    int
+	processed int
+}
+
+func (c *boundedConsumer) ConsumeMessage() (*sarama.ConsumerMessage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.next >= len(c.lines) {
+		time.Sleep(time.Millisecond)
+		return nil, nil
+	}
+	c.next++
+	return &sarama.ConsumerMessage{Topic: "metrics", Offset: int64(c.next - 1), Value: []byte(c.lines[c.next-1])}, nil
+}
+
+func (c *boundedConsumer) MarkOffset(messages []*sarama.ConsumerMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.marked += len(messages)
+}
+
+func (c *boundedConsumer) Close() {}
+
+func (c *boundedConsumer) done(processedMessages []*sarama.ConsumerMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.marked >= len(c.lines)
+}
+
+// read stops once every line was processed, whether or not an aggregation
+// window still holds it, like backfill and replay do.
+func (c *boundedConsumer) read(processedMessages []*sarama.ConsumerMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, message := range processedMessages {
+		if message != nil {
+			c.processed++
+		}
+	}
+	return c.processed >= len(c.lines)
+}
+
+// drainedConsumer returns its lines once, then blocks until it is closed, like
+// a Kafka consumer of a drained topic.
+type drainedConsumer struct {
+	*boundedConsumer
+	closed chan bool
+}
+
+func newDrainedConsumer(lines ...string) *drainedConsumer {
+	return &drainedConsumer{&boundedConsumer{lines: lines}, make(chan bool)}
+}
+
+func (c *drainedConsumer) ConsumeMessage() (*sarama.ConsumerMessage, error) {
+	c.lock.Lock()
+	drained := c.next >= len(c.lines)
+	c.lock.Unlock()
+	if drained {
+		<-c.closed
+		return nil, nil
+	}
+	return c.boundedConsumer.ConsumeMessage()
+}
+
+func (c *drainedConsumer) Close() {
+	close(c.closed)
+}
+
+func startBounded(sut *Kandi, t *testing.T) {
+	started := make(chan bool)
+	go func() {
+		sut.Start()
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected bounded run to complete")
+	}
+}
+
+func Test_Bounded_Consumer_Runs_To_Completion(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	var lock sync.Mutex
+	written := []string{}
+	influxHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				written = append(written, line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxHandler.Close()
+	conf := NewKandiTestConfig(influxHandler.URL, 2)
+	conf.Influx.Timeout = time.Second
+	conf.Kandi.Batch.Duration = 10 * time.Millisecond
+	sut := NewKandi(conf)
+	consumer := &boundedConsumer{lines: []string{"cpu value=1 1", "cpu value=2 2", "cpu value=3 3"}}
+	sut.Consumer = consumer
+	sut.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{consumer.done}
+
+	startBounded(sut, t)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if fmt.Sprint(written) != "[cpu value=1 1 cpu value=2 2 cpu value=3 3]" {
+		t.Error(fmt.Sprintf("Expected every point to be written once but found %v", written))
+	}
+	if sut.Err() != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", sut.Err().Error()))
+	}
+}
+
+func Test_Start_Returns_Once_The_Consumer_Is_Drained(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	influxHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxHandler.Close()
+	conf := NewKandiTestConfig(influxHandler.URL, 2)
+	conf.Influx.Timeout = time.Second
+	sut := NewKandi(conf)
+	consumer := newDrainedConsumer("cpu value=1 1", "cpu value=2 2")
+	sut.Consumer = consumer
+	sut.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{consumer.done}
+
+	startBounded(sut, t)
+
+	if consumer.marked != 2 {
+		t.Error(fmt.Sprintf("Expected every offset to be marked but %d were", consumer.marked))
+	}
+}
+
+func Test_Bounded_Consumer_Gives_Up_After_Max_Retries(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	attempts := 0
+	influxHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer influxHandler.Close()
+	conf := NewKandiTestConfig(influxHandler.URL, 2)
+	conf.Influx.Timeout = time.Second
+	conf.Kandi.Batch.Duration = 10 * time.Millisecond
+	sut := NewKandi(conf)
+	consumer := &boundedConsumer{lines: []string{"cpu value=1 1"}}
+	sut.Consumer = consumer
+	sut.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{consumer.done}
+	sut.MaxRetries = 2
+
+	startBounded(sut, t)
+
+	if sut.Err() == nil {
+		t.Error("Expected the run to fail with the error of the last attempt")
+	}
+	if attempts != 3 || consumer.marked != 0 {
+		t.Error(fmt.Sprintf("Expected 3 attempts and no offsets marked but found %d attempts and %d marked", attempts, consumer.marked))
+	}
+}
+
+func Test_Open_Windows_Are_Written_When_Processing_Stops(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	var lock sync.Mutex
+	written := []string{}
+	influxHandler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				written = append(written, line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxHandler.Close()
+	conf := NewKandiTestConfig(influxHandler.URL, 2)
+	conf.Influx.Timeout = time.Second
+	conf.Kandi.Batch.Duration = 10 * time.Millisecond
+	conf.Kafka.Format = "statsd"
+	conf.Kandi.Statsd = &StatsdConfig{FlushInterval: time.Hour}
+	sut := NewKandi(conf)
+	consumer := &boundedConsumer{lines: []string{"requests:1|c", "requests:2|c"}}
+	sut.Consumer = consumer
+	sut.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{consumer.read}
+
+	startBounded(sut, t)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(written) != 1 || !strings.HasPrefix(written[0], "requests,metric_type=counter value=3") {
+		t.Error(fmt.Sprintf("Expected the open statsd window to be written but found %v", written))
+	}
+	if consumer.marked != 2 {
+		t.Error(fmt.Sprintf("Expected the offsets held by the window to be committed but %d were", consumer.marked))
+	}
+}
@@ -4,8 +4,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
-	"github.com/Shopify/sarama"
-	"time"
 )
 
 func main() {
@@ -21,10 +19,34 @@ func main() {
 	if len(args) > 1 {
 		switch args[1] {
 
+			case "test-script":
+				if err := testScript(args[2:], os.Stdin, os.Stdout); err != nil {
+					log.WithError(err).Error("Unable to test script")
+					os.Exit(1)
+				}
+				break
+			case "import":
+				if err := importFiles(args[2:]); err != nil {
+					log.WithError(err).Error("Unable to import")
+					os.Exit(1)
+				}
+				break
+			case "offsets":
+				if err := offsets(args[2:], os.Stdout); err != nil {
+					log.WithError(err).Error("Unable to manage offsets")
+					os.Exit(1)
+				}
+				break
+			case "replay":
+				if err := replay(args[2:]); err != nil {
+					log.WithError(err).Error("Unable to replay")
+					os.Exit(1)
+				}
+				break
 			case "backfill":
-				backfill(NewKandi(NewConfig()))
-				for {
-					time.Sleep(time.Duration(24) * time.Hour)
+				if err := backfill(args[2:]); err != nil {
+					log.WithError(err).Error("Unable to backfill")
+					os.Exit(1)
 				}
 				break
 			default:
@@ -36,40 +58,6 @@ func main() {
 	}
 }
 
-func backfill(kandi *Kandi) {
-	currentOffsets := GetCurrentoffset(kandi.conf.Kafka)
-	postProcessor := func(processedMessages []*sarama.ConsumerMessage) bool {
-		for _, message := range processedMessages {
-			if message != nil {
-				if value, ok := currentOffsets[message.Partition]; ok && !value.finished && message.Offset > value.mark {
-					value.finished = true
-					currentOffsets[message.Partition] = value
-
-					finished := true
-					for _, partitionOffset := range currentOffsets {
-						if !partitionOffset.finished {
-							finished = false
-							break
-						}
-					}
-					if finished {
-						return true
-					}
-				}
-			}
-		}
-		return false
-	}
-	kandi.conf.Kafka.Cluster.Consumer.Offsets.Initial = sarama.OffsetOldest
-	kandi.conf.Kafka.Cluster.Consumer.Offsets.Retention = 1 * time.Millisecond
-	kandi.conf.Kafka.ConsumerGroup = kandi.conf.Kafka.ConsumerGroup + "-backfill"
-	kandi.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool {postProcessor}
-
-	log.Debug("Starting Kandi Backfill")
-	kandi.Start()
-	log.Info("Stopping Kandi Backfill")
-}
-
 func start(kandi *Kandi) {
 	log.Debug("Starting Kandi")
 	kandi.Start()
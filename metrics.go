@@ -27,6 +27,71 @@ var MetricsInfluxParseFailure = expvar.NewInt("influxParseFailure")
 var MetricInfluxPartialWrite = expvar.NewInt("influxPartialWrite")
 var MetricInfluxFieldTypeConflict = expvar.NewInt("influxFieldTypeConflict")
 
+var MetricsSubscribedTopicCount = expvar.NewInt("subscribedTopicCount")
+var MetricsKafkaRebalances = expvar.NewInt("kafkaRebalances")
+
+var MetricsStatsdSamples = expvar.NewInt("statsdSamples")
+var MetricsStatsdParseFailure = expvar.NewInt("statsdParseFailure")
+var MetricsStatsdPointsFlushed = expvar.NewInt("statsdPointsFlushed")
+
+var MetricsOtlpConversionFailure = expvar.NewInt("otlpConversionFailure")
+
+var MetricsDefaultTimeFallback = expvar.NewInt("defaultTimeFallback")
+
+var MetricsTimestampRejected = expvar.NewMap("timestampRejected")
+var MetricsTimestampCorrected = expvar.NewMap("timestampCorrected")
+
+var MetricsFilteredPoints = expvar.NewMap("filteredPoints")
+
+var MetricsCardinalityExceeded = expvar.NewMap("cardinalityExceeded")
+var MetricsCardinalityLimited = expvar.NewMap("cardinalityLimited")
+
+var MetricsFieldCoerced = expvar.NewMap("fieldCoerced")
+var MetricsFieldUnconvertible = expvar.NewMap("fieldUnconvertible")
+
+var MetricsDownsampleLate = expvar.NewInt("downsampleLate")
+var MetricsDownsamplePointsFlushed = expvar.NewInt("downsamplePointsFlushed")
+
+var MetricsDuplicatesSuppressed = expvar.NewInt("duplicatesSuppressed")
+
+var MetricsScriptError = expvar.NewMap("scriptError")
+var MetricsScriptTimeout = expvar.NewMap("scriptTimeout")
+
+var MetricsPayloadDecompressFailure = expvar.NewInt("payloadDecompressFailure")
+
+var MetricsTransformFailure = expvar.NewInt("transformFailure")
+
+var MetricsInfluxPacketsSent = expvar.NewInt("influxPacketsSent")
+var MetricsInfluxBytesSent = expvar.NewInt("influxBytesSent")
+
+var MetricsSinkValuesWritten = expvar.NewMap("sinkValuesWritten")
+var MetricsSinkWriteFailure = expvar.NewMap("sinkWriteFailure")
+var MetricsSinkRejected = expvar.NewMap("sinkRejected")
+var MetricsSinkSkippedFields = expvar.NewInt("sinkSkippedFields")
+
+var MetricsArchiveLinesWritten = expvar.NewInt("archiveLinesWritten")
+var MetricsArchiveFilesClosed = expvar.NewInt("archiveFilesClosed")
+var MetricsArchiveWriteFailure = expvar.NewInt("archiveWriteFailure")
+var MetricsArchiveUploadFailure = expvar.NewInt("archiveUploadFailure")
+
+var MetricsRepublishPointsSent = expvar.NewInt("republishPointsSent")
+var MetricsRepublishFailure = expvar.NewInt("republishFailure")
+
+var MetricsDeadLetterSent = expvar.NewInt("deadLetterSent")
+var MetricsDeadLetterFailure = expvar.NewInt("deadLetterFailure")
+
+// MetricsPointsWritten returns the points written to Influx, or the values
+// written to any other sink.
+func MetricsPointsWritten() int64 {
+	written := MetricsInfluxWriteSuccess.Value()
+	MetricsSinkValuesWritten.Do(func(value expvar.KeyValue) {
+		if count, ok := value.Value.(*expvar.Int); ok {
+			written += count.Value()
+		}
+	})
+	return written
+}
+
 func MetricsKafkaConsumption(startTime time.Time, points int64) {
 	MetricsKafkaMessages.Add(points)
 	MetricsKafkaDuration.Add(time.Since(startTime).Nanoseconds())
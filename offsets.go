@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type trackedMessage struct {
+	message *sarama.ConsumerMessage
+	done    bool
+}
+
+// OffsetTracker keeps consumed messages in offset order per partition so that a
+// message held by an aggregation stage also holds back every later offset of
+// its partition. Only the contiguous run of completed messages is ever released
+// for marking. Messages not done yet are indexed so that completing one does
+// not scan its partition.
+type OffsetTracker struct {
+	pending map[topicPartition][]*trackedMessage
+	open    map[*sarama.ConsumerMessage]*trackedMessage
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{pending: make(map[topicPartition][]*trackedMessage), open: make(map[*sarama.ConsumerMessage]*trackedMessage)}
+}
+
+func (t *OffsetTracker) Track(message *sarama.ConsumerMessage) {
+	if message == nil {
+		return
+	}
+	key := topicPartition{message.Topic, message.Partition}
+	tracked := &trackedMessage{message: message}
+	t.pending[key] = append(t.pending[key], tracked)
+	t.open[message] = tracked
+}
+
+func (t *OffsetTracker) Done(message *sarama.ConsumerMessage) {
+	if message == nil {
+		return
+	}
+	if tracked, ok := t.open[message]; ok {
+		tracked.done = true
+		delete(t.open, message)
+	}
+}
+
+// Ready removes and returns the messages that are safe to mark, in offset order.
+func (t *OffsetTracker) Ready() []*sarama.ConsumerMessage {
+	ready := []*sarama.ConsumerMessage{}
+	for key, tracked := range t.pending {
+		completed := 0
+		for completed < len(tracked) && tracked[completed].done {
+			ready = append(ready, tracked[completed].message)
+			completed++
+		}
+		if completed == len(tracked) {
+			delete(t.pending, key)
+		} else {
+			t.pending[key] = tracked[completed:]
+		}
+	}
+	return ready
+}
+
+// Held returns the number of messages waiting on an aggregation stage.
+func (t *OffsetTracker) Held() int {
+	held := 0
+	for _, tracked := range t.pending {
+		held += len(tracked)
+	}
+	return held
+}
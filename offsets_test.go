@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"testing"
+)
+
+func Test_OffsetTracker_Releases_Contiguous_Completed_Messages(t *testing.T) {
+	sut := NewOffsetTracker()
+	first := &sarama.ConsumerMessage{Topic: "a", Partition: 0, Offset: 0}
+	held := &sarama.ConsumerMessage{Topic: "a", Partition: 0, Offset: 1}
+	last := &sarama.ConsumerMessage{Topic: "a", Partition: 0, Offset: 2}
+	other := &sarama.ConsumerMessage{Topic: "b", Partition: 0, Offset: 0}
+	for _, message := range []*sarama.ConsumerMessage{first, held, last, other} {
+		sut.Track(message)
+	}
+	sut.Done(first)
+	sut.Done(last)
+	sut.Done(other)
+
+	ready := sut.Ready()
+	if len(ready) != 2 {
+		t.Error(fmt.Sprintf("Expected 2 messages ready but found %d", len(ready)))
+	}
+	for _, message := range ready {
+		if message == held || message == last {
+			t.Error(fmt.Sprintf("Message at offset %d should be held behind offset 1", message.Offset))
+		}
+	}
+	if sut.Held() != 2 {
+		t.Error(fmt.Sprintf("Expected 2 messages held but found %d", sut.Held()))
+	}
+
+	sut.Done(held)
+	ready = sut.Ready()
+	if len(ready) != 2 || ready[0] != held || ready[1] != last {
+		t.Error("Held messages should be released in offset order once completed")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// OpenTsdbConfig writes to the HTTP API of OpenTSDB at Url.
+type OpenTsdbConfig struct {
+	Url     string
+	Timeout time.Duration
+}
+
+func NewOpenTsdbConfig(entry map[string]interface{}) *OpenTsdbConfig {
+	conf := &OpenTsdbConfig{Timeout: 5 * time.Second}
+	if value, ok := entry["url"].(string); ok {
+		conf.Url = strings.TrimSuffix(value, "/")
+	}
+	if value, ok := entry["timeout"].(int); ok {
+		conf.Timeout = time.Duration(value) * time.Millisecond
+	}
+	return conf
+}
+
+// OpenTsdbSink puts every numeric field as a data point named after its
+// measurement and field. OpenTSDB requires a tag, points without any are
+// tagged with their measurement. Data points OpenTSDB rejects are dropped
+// rather than retried.
+type OpenTsdbSink struct {
+	config *OpenTsdbConfig
+	client *http.Client
+}
+
+func NewOpenTsdbSink(config *OpenTsdbConfig) (*OpenTsdbSink, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("opentsdb sink requires a url")
+	}
+	return &OpenTsdbSink{config: config, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+type openTsdbPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func openTsdbName(value string) string {
+	return sanitize(value, func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' || c == '_' || c == '.' || c == '/'
+	})
+}
+
+func openTsdbPoints(metrics []sinkMetric) []openTsdbPoint {
+	points := []openTsdbPoint{}
+	for _, metric := range metrics {
+		tags := make(map[string]string)
+		for key, value := range metric.tags {
+			tags[openTsdbName(key)] = openTsdbName(value)
+		}
+		if len(tags) == 0 {
+			tags["measurement"] = openTsdbName(metric.name)
+		}
+		points = append(points, openTsdbPoint{openTsdbName(metric.fullName(".")), metric.time.UnixNano() / int64(time.Millisecond), metric.value, tags})
+	}
+	return points
+}
+
+func (s *OpenTsdbSink) Write(batch influx.BatchPoints) error {
+	metrics := sinkMetrics(batch.Points())
+	if len(metrics) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(openTsdbPoints(metrics))
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(s.config.Url+"/api/put?summary", "application/json", bytes.NewReader(body))
+	if err != nil {
+		MetricsSinkWriteFailure.Add("opentsdb", 1)
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusBadRequest {
+		summary := struct {
+			Success int64 `json:"success"`
+			Failed  int64 `json:"failed"`
+		}{}
+		content, _ := ioutil.ReadAll(response.Body)
+		json.Unmarshal(content, &summary)
+		log.WithFields(log.Fields{"success": summary.Success, "failed": summary.Failed}).Error("OpenTSDB rejected data points")
+		MetricsSinkValuesWritten.Add("opentsdb", summary.Success)
+		MetricsSinkRejected.Add("opentsdb", int64(len(metrics))-summary.Success)
+		return nil
+	}
+	if response.StatusCode/100 != 2 {
+		MetricsSinkWriteFailure.Add("opentsdb", 1)
+		return fmt.Errorf("opentsdb put failed: %s", response.Status)
+	}
+	MetricsSinkValuesWritten.Add("opentsdb", int64(len(metrics)))
+	return nil
+}
+
+// Health asks OpenTSDB for its version.
+func (s *OpenTsdbSink) Health() error {
+	response, err := s.client.Get(s.config.Url + "/api/version")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("opentsdb is unhealthy: %s", response.Status)
+	}
+	return nil
+}
+
+func (s *OpenTsdbSink) Close() error {
+	return nil
+}
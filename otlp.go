@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"time"
+)
+
+type OtlpConfig struct {
+	Encoding string
+}
+
+// OtlpParser decodes OTLP ExportMetricsServiceRequest messages, as published by
+// the OpenTelemetry Collector kafka exporter, in either protobuf or JSON.
+type OtlpParser struct {
+	config *OtlpConfig
+}
+
+func (p *OtlpParser) Parse(message *sarama.ConsumerMessage, defaultTime time.Time) ([]*influx.Point, error) {
+	request, err := p.decode(message.Value)
+	if err != nil {
+		return nil, err
+	}
+	return request.points(defaultTime), nil
+}
+
+func (p *OtlpParser) decode(value []byte) (*otlpExportMetricsServiceRequest, error) {
+	encoding := p.config.Encoding
+	if encoding == "" || encoding == "auto" {
+		encoding = "protobuf"
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+			encoding = "json"
+		}
+	}
+
+	request := &otlpExportMetricsServiceRequest{}
+	switch encoding {
+	case "json":
+		if err := json.Unmarshal(value, request); err != nil {
+			return nil, err
+		}
+	case "protobuf":
+		if err := request.unmarshalProto(newProtoReader(value)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported otlp encoding %q", encoding)
+	}
+	return request, nil
+}
+
+type otlpExportMetricsServiceRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name       string          `json:"name"`
+	Version    string          `json:"version"`
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpMetric struct {
+	Name                 string                    `json:"name"`
+	Description          string                    `json:"description"`
+	Unit                 string                    `json:"unit"`
+	Gauge                *otlpGauge                `json:"gauge"`
+	Sum                  *otlpSum                  `json:"sum"`
+	Histogram            *otlpHistogram            `json:"histogram"`
+	ExponentialHistogram *otlpExponentialHistogram `json:"exponentialHistogram"`
+	Summary              *otlpSummary              `json:"summary"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                    `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                       `json:"aggregationTemporality"`
+}
+
+type otlpExponentialHistogram struct {
+	DataPoints             []*otlpExponentialHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                                  `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64      `json:"timeUnixNano"`
+	AsDouble     *otlpDouble     `json:"asDouble"`
+	AsInt        *otlpInt64      `json:"asInt"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes     []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpUint64      `json:"timeUnixNano"`
+	Count          otlpUint64      `json:"count"`
+	Sum            *otlpDouble     `json:"sum"`
+	BucketCounts   []otlpUint64    `json:"bucketCounts"`
+	ExplicitBounds []otlpDouble    `json:"explicitBounds"`
+	Min            *otlpDouble     `json:"min"`
+	Max            *otlpDouble     `json:"max"`
+}
+
+type otlpExponentialHistogramDataPoint struct {
+	Attributes   []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64      `json:"timeUnixNano"`
+	Count        otlpUint64      `json:"count"`
+	Sum          *otlpDouble     `json:"sum"`
+	Scale        int32           `json:"scale"`
+	ZeroCount    otlpUint64      `json:"zeroCount"`
+	Positive     *otlpBuckets    `json:"positive"`
+	Negative     *otlpBuckets    `json:"negative"`
+	Min          *otlpDouble     `json:"min"`
+	Max          *otlpDouble     `json:"max"`
+}
+
+type otlpBuckets struct {
+	Offset       int32        `json:"offset"`
+	BucketCounts []otlpUint64 `json:"bucketCounts"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes     []*otlpKeyValue      `json:"attributes"`
+	TimeUnixNano   otlpUint64           `json:"timeUnixNano"`
+	Count          otlpUint64           `json:"count"`
+	Sum            otlpDouble           `json:"sum"`
+	QuantileValues []*otlpValueQuantile `json:"quantileValues"`
+}
+
+type otlpValueQuantile struct {
+	Quantile otlpDouble `json:"quantile"`
+	Value    otlpDouble `json:"value"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue"`
+	BoolValue   *bool           `json:"boolValue"`
+	IntValue    *otlpInt64      `json:"intValue"`
+	DoubleValue *otlpDouble     `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue"`
+	KvlistValue *otlpKvlist     `json:"kvlistValue"`
+	BytesValue  []byte          `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []*otlpAnyValue `json:"values"`
+}
+
+type otlpKvlist struct {
+	Values []*otlpKeyValue `json:"values"`
+}
+
+// OTLP/JSON encodes 64 bit integers as strings and non finite doubles as
+// their names, both of which encoding/json rejects for numeric types.
+
+type otlpUint64 uint64
+type otlpInt64 int64
+type otlpDouble float64
+
+func (v *otlpUint64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(string(bytes.Trim(data, `"`)), 10, 64)
+	*v = otlpUint64(value)
+	return err
+}
+
+func (v *otlpInt64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(string(bytes.Trim(data, `"`)), 10, 64)
+	*v = otlpInt64(value)
+	return err
+}
+
+func (v *otlpDouble) UnmarshalJSON(data []byte) error {
+	switch string(bytes.Trim(data, `"`)) {
+	case "NaN":
+		*v = otlpDouble(math.NaN())
+	case "Infinity":
+		*v = otlpDouble(math.Inf(1))
+	case "-Infinity":
+		*v = otlpDouble(math.Inf(-1))
+	default:
+		value, err := strconv.ParseFloat(string(bytes.Trim(data, `"`)), 64)
+		*v = otlpDouble(value)
+		return err
+	}
+	return nil
+}
+
+func (value *otlpAnyValue) String() string {
+	switch {
+	case value == nil:
+		return ""
+	case value.StringValue != nil:
+		return *value.StringValue
+	case value.BoolValue != nil:
+		return strconv.FormatBool(*value.BoolValue)
+	case value.IntValue != nil:
+		return strconv.FormatInt(int64(*value.IntValue), 10)
+	case value.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*value.DoubleValue), 'g', -1, 64)
+	case value.BytesValue != nil:
+		encoded, _ := json.Marshal(value.BytesValue)
+		return string(bytes.Trim(encoded, `"`))
+	}
+	encoded, _ := json.Marshal(value.plain())
+	return string(encoded)
+}
+
+func (value *otlpAnyValue) plain() interface{} {
+	switch {
+	case value == nil:
+		return nil
+	case value.ArrayValue != nil:
+		values := []interface{}{}
+		for _, element := range value.ArrayValue.Values {
+			values = append(values, element.plain())
+		}
+		return values
+	case value.KvlistValue != nil:
+		values := map[string]interface{}{}
+		for _, element := range value.KvlistValue.Values {
+			values[element.Key] = element.Value.plain()
+		}
+		return values
+	}
+	return value.String()
+}
+
+func otlpTags(tags map[string]string, attributes []*otlpKeyValue) map[string]string {
+	for _, attribute := range attributes {
+		if attribute != nil && attribute.Key != "" {
+			if value := attribute.Value.String(); value != "" {
+				tags[attribute.Key] = value
+			}
+		}
+	}
+	return tags
+}
+
+func otlpTime(nanos otlpUint64, defaultTime time.Time) time.Time {
+	if nanos == 0 {
+		return defaultTime
+	}
+	return time.Unix(0, int64(nanos)).UTC()
+}
+
+type otlpPoints struct {
+	points      []*influx.Point
+	defaultTime time.Time
+}
+
+func (p *otlpPoints) add(name string, tags map[string]string, fields map[string]interface{}, nanos otlpUint64) {
+	for key, value := range fields {
+		if value, ok := value.(float64); ok && (math.IsNaN(value) || math.IsInf(value, 0)) {
+			delete(fields, key)
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+	point, err := influx.NewPoint(name, tags, fields, otlpTime(nanos, p.defaultTime))
+	if err != nil {
+		log.WithError(err).WithField("metric", name).Debug("Failed to create otlp point")
+		MetricsOtlpConversionFailure.Add(1)
+		return
+	}
+	p.points = append(p.points, point)
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
+
+// points maps every data point onto an influx point named after its metric.
+// Resource, scope and data point attributes become tags. Histogram and summary
+// buckets are written as additional points tagged with le or quantile.
+func (request *otlpExportMetricsServiceRequest) points(defaultTime time.Time) []*influx.Point {
+	converted := &otlpPoints{points: []*influx.Point{}, defaultTime: defaultTime}
+	for _, resourceMetrics := range request.ResourceMetrics {
+		if resourceMetrics == nil {
+			continue
+		}
+		resourceTags := map[string]string{}
+		if resourceMetrics.Resource != nil {
+			otlpTags(resourceTags, resourceMetrics.Resource.Attributes)
+		}
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			if scopeMetrics == nil {
+				continue
+			}
+			scopeTags := copyTags(resourceTags)
+			if scope := scopeMetrics.Scope; scope != nil {
+				if scope.Name != "" {
+					scopeTags["otel.scope.name"] = scope.Name
+				}
+				if scope.Version != "" {
+					scopeTags["otel.scope.version"] = scope.Version
+				}
+				otlpTags(scopeTags, scope.Attributes)
+			}
+			for _, metric := range scopeMetrics.Metrics {
+				if metric != nil && metric.Name != "" {
+					converted.metric(metric, scopeTags)
+				}
+			}
+		}
+	}
+	return converted.points
+}
+
+func (p *otlpPoints) metric(metric *otlpMetric, scopeTags map[string]string) {
+	switch {
+	case metric.Gauge != nil:
+		for _, dataPoint := range metric.Gauge.DataPoints {
+			p.number(metric.Name, "gauge", dataPoint, scopeTags)
+		}
+	case metric.Sum != nil:
+		field := "gauge"
+		if metric.Sum.IsMonotonic {
+			field = "counter"
+		}
+		for _, dataPoint := range metric.Sum.DataPoints {
+			p.number(metric.Name, field, dataPoint, scopeTags)
+		}
+	case metric.Histogram != nil:
+		for _, dataPoint := range metric.Histogram.DataPoints {
+			p.histogram(metric.Name, dataPoint, scopeTags)
+		}
+	case metric.ExponentialHistogram != nil:
+		for _, dataPoint := range metric.ExponentialHistogram.DataPoints {
+			p.exponentialHistogram(metric.Name, dataPoint, scopeTags)
+		}
+	case metric.Summary != nil:
+		for _, dataPoint := range metric.Summary.DataPoints {
+			p.summary(metric.Name, dataPoint, scopeTags)
+		}
+	}
+}
+
+func (p *otlpPoints) number(name string, field string, dataPoint *otlpNumberDataPoint, scopeTags map[string]string) {
+	if dataPoint == nil {
+		return
+	}
+	fields := map[string]interface{}{}
+	if dataPoint.AsInt != nil {
+		fields[field] = int64(*dataPoint.AsInt)
+	} else if dataPoint.AsDouble != nil {
+		fields[field] = float64(*dataPoint.AsDouble)
+	}
+	p.add(name, otlpTags(copyTags(scopeTags), dataPoint.Attributes), fields, dataPoint.TimeUnixNano)
+}
+
+func histogramFields(count otlpUint64, sum *otlpDouble, min *otlpDouble, max *otlpDouble) map[string]interface{} {
+	fields := map[string]interface{}{"count": int64(count)}
+	if sum != nil {
+		fields["sum"] = float64(*sum)
+	}
+	if min != nil {
+		fields["min"] = float64(*min)
+	}
+	if max != nil {
+		fields["max"] = float64(*max)
+	}
+	return fields
+}
+
+func (p *otlpPoints) bucket(name string, tags map[string]string, le float64, cumulative uint64, nanos otlpUint64) {
+	bucketTags := copyTags(tags)
+	bucketTags["le"] = strconv.FormatFloat(le, 'g', -1, 64)
+	p.add(name, bucketTags, map[string]interface{}{"bucket": int64(cumulative)}, nanos)
+}
+
+func (p *otlpPoints) histogram(name string, dataPoint *otlpHistogramDataPoint, scopeTags map[string]string) {
+	if dataPoint == nil {
+		return
+	}
+	tags := otlpTags(copyTags(scopeTags), dataPoint.Attributes)
+	p.add(name, tags, histogramFields(dataPoint.Count, dataPoint.Sum, dataPoint.Min, dataPoint.Max), dataPoint.TimeUnixNano)
+
+	var cumulative uint64
+	for i, count := range dataPoint.BucketCounts {
+		cumulative += uint64(count)
+		le := math.Inf(1)
+		if i < len(dataPoint.ExplicitBounds) {
+			le = float64(dataPoint.ExplicitBounds[i])
+		}
+		p.bucket(name, tags, le, cumulative, dataPoint.TimeUnixNano)
+	}
+}
+
+func (p *otlpPoints) exponentialHistogram(name string, dataPoint *otlpExponentialHistogramDataPoint, scopeTags map[string]string) {
+	if dataPoint == nil {
+		return
+	}
+	tags := otlpTags(copyTags(scopeTags), dataPoint.Attributes)
+	fields := histogramFields(dataPoint.Count, dataPoint.Sum, dataPoint.Min, dataPoint.Max)
+	fields["scale"] = int64(dataPoint.Scale)
+	fields["zero_count"] = int64(dataPoint.ZeroCount)
+	p.add(name, tags, fields, dataPoint.TimeUnixNano)
+
+	// Negative and zero buckets all lie below the first positive boundary.
+	cumulative := uint64(dataPoint.ZeroCount)
+	if dataPoint.Negative != nil {
+		for _, count := range dataPoint.Negative.BucketCounts {
+			cumulative += uint64(count)
+		}
+	}
+	if dataPoint.Positive != nil {
+		base := math.Pow(2, math.Pow(2, -float64(dataPoint.Scale)))
+		for i, count := range dataPoint.Positive.BucketCounts {
+			cumulative += uint64(count)
+			le := math.Pow(base, float64(int(dataPoint.Positive.Offset)+i+1))
+			p.bucket(name, tags, le, cumulative, dataPoint.TimeUnixNano)
+		}
+	}
+}
+
+func (p *otlpPoints) summary(name string, dataPoint *otlpSummaryDataPoint, scopeTags map[string]string) {
+	if dataPoint == nil {
+		return
+	}
+	tags := otlpTags(copyTags(scopeTags), dataPoint.Attributes)
+	p.add(name, tags, map[string]interface{}{"count": int64(dataPoint.Count), "sum": float64(dataPoint.Sum)}, dataPoint.TimeUnixNano)
+	for _, quantile := range dataPoint.QuantileValues {
+		if quantile == nil {
+			continue
+		}
+		quantileTags := copyTags(tags)
+		quantileTags["quantile"] = strconv.FormatFloat(float64(quantile.Quantile), 'g', -1, 64)
+		p.add(name, quantileTags, map[string]interface{}{"value": float64(quantile.Value)}, dataPoint.TimeUnixNano)
+	}
+}
+
+// The unmarshalProto methods follow the field numbers of
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto and the
+// messages it imports. Unknown fields are skipped.
+
+func (request *otlpExportMetricsServiceRequest) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		if field == 1 && wireType == protoBytes {
+			resourceMetrics := &otlpResourceMetrics{}
+			if err = unmarshalProtoMessage(r, resourceMetrics.unmarshalProto); err == nil {
+				request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics)
+			}
+		} else {
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalProtoMessage(r *protoReader, unmarshal func(*protoReader) error) error {
+	message, err := r.message()
+	if err != nil {
+		return err
+	}
+	return unmarshal(message)
+}
+
+func (resourceMetrics *otlpResourceMetrics) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			resourceMetrics.Resource = &otlpResource{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				return unmarshalProtoAttributes(r, 1, &resourceMetrics.Resource.Attributes)
+			})
+		case field == 2 && wireType == protoBytes:
+			scopeMetrics := &otlpScopeMetrics{}
+			if err = unmarshalProtoMessage(r, scopeMetrics.unmarshalProto); err == nil {
+				resourceMetrics.ScopeMetrics = append(resourceMetrics.ScopeMetrics, scopeMetrics)
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalProtoAttributes reads the message's KeyValue attributes, stored at
+// the given field number, skipping everything else.
+func unmarshalProtoAttributes(r *protoReader, number int, attributes *[]*otlpKeyValue) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		if field == number && wireType == protoBytes {
+			err = unmarshalProtoKeyValue(r, attributes)
+		} else {
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalProtoKeyValue(r *protoReader, attributes *[]*otlpKeyValue) error {
+	keyValue := &otlpKeyValue{}
+	err := unmarshalProtoMessage(r, func(r *protoReader) error {
+		for r.more() {
+			field, wireType, err := r.next()
+			if err != nil {
+				return err
+			}
+			switch {
+			case field == 1 && wireType == protoBytes:
+				var key []byte
+				key, err = r.bytes()
+				keyValue.Key = string(key)
+			case field == 2 && wireType == protoBytes:
+				keyValue.Value = &otlpAnyValue{}
+				err = unmarshalProtoMessage(r, keyValue.Value.unmarshalProto)
+			default:
+				err = r.skip(wireType)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		*attributes = append(*attributes, keyValue)
+	}
+	return err
+}
+
+func (value *otlpAnyValue) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			var raw []byte
+			raw, err = r.bytes()
+			stringValue := string(raw)
+			value.StringValue = &stringValue
+		case field == 2 && wireType == protoVarint:
+			var raw uint64
+			raw, err = r.varint()
+			boolValue := raw != 0
+			value.BoolValue = &boolValue
+		case field == 3 && wireType == protoVarint:
+			var raw uint64
+			raw, err = r.varint()
+			intValue := otlpInt64(int64(raw))
+			value.IntValue = &intValue
+		case field == 4 && wireType == protoFixed64:
+			var raw float64
+			raw, err = r.double()
+			doubleValue := otlpDouble(raw)
+			value.DoubleValue = &doubleValue
+		case field == 5 && wireType == protoBytes:
+			value.ArrayValue = &otlpArrayValue{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				for r.more() {
+					field, wireType, err := r.next()
+					if err != nil {
+						return err
+					}
+					if field == 1 && wireType == protoBytes {
+						element := &otlpAnyValue{}
+						if err = unmarshalProtoMessage(r, element.unmarshalProto); err == nil {
+							value.ArrayValue.Values = append(value.ArrayValue.Values, element)
+						}
+					} else {
+						err = r.skip(wireType)
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		case field == 6 && wireType == protoBytes:
+			value.KvlistValue = &otlpKvlist{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				return unmarshalProtoAttributes(r, 1, &value.KvlistValue.Values)
+			})
+		case field == 7 && wireType == protoBytes:
+			value.BytesValue, err = r.bytes()
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (scopeMetrics *otlpScopeMetrics) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			scopeMetrics.Scope = &otlpScope{}
+			err = unmarshalProtoMessage(r, scopeMetrics.Scope.unmarshalProto)
+		case field == 2 && wireType == protoBytes:
+			metric := &otlpMetric{}
+			if err = unmarshalProtoMessage(r, metric.unmarshalProto); err == nil {
+				scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (scope *otlpScope) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw []byte
+		switch {
+		case field == 1 && wireType == protoBytes:
+			raw, err = r.bytes()
+			scope.Name = string(raw)
+		case field == 2 && wireType == protoBytes:
+			raw, err = r.bytes()
+			scope.Version = string(raw)
+		case field == 3 && wireType == protoBytes:
+			err = unmarshalProtoKeyValue(r, &scope.Attributes)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (metric *otlpMetric) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw []byte
+		switch {
+		case field == 1 && wireType == protoBytes:
+			raw, err = r.bytes()
+			metric.Name = string(raw)
+		case field == 2 && wireType == protoBytes:
+			raw, err = r.bytes()
+			metric.Description = string(raw)
+		case field == 3 && wireType == protoBytes:
+			raw, err = r.bytes()
+			metric.Unit = string(raw)
+		case field == 5 && wireType == protoBytes:
+			metric.Gauge = &otlpGauge{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				_, _, err := unmarshalProtoDataPoints(r, func(r *protoReader) error {
+					dataPoint := &otlpNumberDataPoint{}
+					metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, dataPoint)
+					return dataPoint.unmarshalProto(r)
+				})
+				return err
+			})
+		case field == 7 && wireType == protoBytes:
+			metric.Sum = &otlpSum{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				temporality, monotonic, err := unmarshalProtoDataPoints(r, func(r *protoReader) error {
+					dataPoint := &otlpNumberDataPoint{}
+					metric.Sum.DataPoints = append(metric.Sum.DataPoints, dataPoint)
+					return dataPoint.unmarshalProto(r)
+				})
+				metric.Sum.AggregationTemporality = temporality
+				metric.Sum.IsMonotonic = monotonic
+				return err
+			})
+		case field == 9 && wireType == protoBytes:
+			metric.Histogram = &otlpHistogram{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				temporality, _, err := unmarshalProtoDataPoints(r, func(r *protoReader) error {
+					dataPoint := &otlpHistogramDataPoint{}
+					metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, dataPoint)
+					return dataPoint.unmarshalProto(r)
+				})
+				metric.Histogram.AggregationTemporality = temporality
+				return err
+			})
+		case field == 10 && wireType == protoBytes:
+			metric.ExponentialHistogram = &otlpExponentialHistogram{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				temporality, _, err := unmarshalProtoDataPoints(r, func(r *protoReader) error {
+					dataPoint := &otlpExponentialHistogramDataPoint{}
+					metric.ExponentialHistogram.DataPoints = append(metric.ExponentialHistogram.DataPoints, dataPoint)
+					return dataPoint.unmarshalProto(r)
+				})
+				metric.ExponentialHistogram.AggregationTemporality = temporality
+				return err
+			})
+		case field == 11 && wireType == protoBytes:
+			metric.Summary = &otlpSummary{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				_, _, err := unmarshalProtoDataPoints(r, func(r *protoReader) error {
+					dataPoint := &otlpSummaryDataPoint{}
+					metric.Summary.DataPoints = append(metric.Summary.DataPoints, dataPoint)
+					return dataPoint.unmarshalProto(r)
+				})
+				return err
+			})
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalProtoDataPoints reads the body shared by every metric data type:
+// data points at field 1, aggregation temporality at 2 and monotonicity at 3.
+func unmarshalProtoDataPoints(r *protoReader, dataPoint func(*protoReader) error) (int, bool, error) {
+	temporality := 0
+	monotonic := false
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return temporality, monotonic, err
+		}
+		var raw uint64
+		switch {
+		case field == 1 && wireType == protoBytes:
+			err = unmarshalProtoMessage(r, dataPoint)
+		case field == 2 && wireType == protoVarint:
+			raw, err = r.varint()
+			temporality = int(raw)
+		case field == 3 && wireType == protoVarint:
+			raw, err = r.varint()
+			monotonic = raw != 0
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return temporality, monotonic, err
+		}
+	}
+	return temporality, monotonic, nil
+}
+
+func protoDouble(r *protoReader) (*otlpDouble, error) {
+	raw, err := r.double()
+	value := otlpDouble(raw)
+	return &value, err
+}
+
+func (dataPoint *otlpNumberDataPoint) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw uint64
+		switch {
+		case field == 7 && wireType == protoBytes:
+			err = unmarshalProtoKeyValue(r, &dataPoint.Attributes)
+		case field == 3 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.TimeUnixNano = otlpUint64(raw)
+		case field == 4 && wireType == protoFixed64:
+			dataPoint.AsDouble, err = protoDouble(r)
+		case field == 6 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			value := otlpInt64(int64(raw))
+			dataPoint.AsInt = &value
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dataPoint *otlpHistogramDataPoint) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw uint64
+		var values []uint64
+		switch {
+		case field == 9 && wireType == protoBytes:
+			err = unmarshalProtoKeyValue(r, &dataPoint.Attributes)
+		case field == 3 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.TimeUnixNano = otlpUint64(raw)
+		case field == 4 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.Count = otlpUint64(raw)
+		case field == 5 && wireType == protoFixed64:
+			dataPoint.Sum, err = protoDouble(r)
+		case field == 6 && (wireType == protoBytes || wireType == protoFixed64):
+			values, err = r.fixed64s(wireType, nil)
+			for _, value := range values {
+				dataPoint.BucketCounts = append(dataPoint.BucketCounts, otlpUint64(value))
+			}
+		case field == 7 && (wireType == protoBytes || wireType == protoFixed64):
+			values, err = r.fixed64s(wireType, nil)
+			for _, value := range values {
+				dataPoint.ExplicitBounds = append(dataPoint.ExplicitBounds, otlpDouble(math.Float64frombits(value)))
+			}
+		case field == 11 && wireType == protoFixed64:
+			dataPoint.Min, err = protoDouble(r)
+		case field == 12 && wireType == protoFixed64:
+			dataPoint.Max, err = protoDouble(r)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dataPoint *otlpExponentialHistogramDataPoint) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw uint64
+		switch {
+		case field == 1 && wireType == protoBytes:
+			err = unmarshalProtoKeyValue(r, &dataPoint.Attributes)
+		case field == 3 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.TimeUnixNano = otlpUint64(raw)
+		case field == 4 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.Count = otlpUint64(raw)
+		case field == 5 && wireType == protoFixed64:
+			dataPoint.Sum, err = protoDouble(r)
+		case field == 6 && wireType == protoVarint:
+			dataPoint.Scale, err = r.zigzag32()
+		case field == 7 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.ZeroCount = otlpUint64(raw)
+		case field == 8 && wireType == protoBytes:
+			dataPoint.Positive = &otlpBuckets{}
+			err = unmarshalProtoMessage(r, dataPoint.Positive.unmarshalProto)
+		case field == 9 && wireType == protoBytes:
+			dataPoint.Negative = &otlpBuckets{}
+			err = unmarshalProtoMessage(r, dataPoint.Negative.unmarshalProto)
+		case field == 12 && wireType == protoFixed64:
+			dataPoint.Min, err = protoDouble(r)
+		case field == 13 && wireType == protoFixed64:
+			dataPoint.Max, err = protoDouble(r)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (buckets *otlpBuckets) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var values []uint64
+		switch {
+		case field == 1 && wireType == protoVarint:
+			buckets.Offset, err = r.zigzag32()
+		case field == 2 && (wireType == protoBytes || wireType == protoVarint):
+			values, err = r.varints(wireType, nil)
+			for _, value := range values {
+				buckets.BucketCounts = append(buckets.BucketCounts, otlpUint64(value))
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dataPoint *otlpSummaryDataPoint) unmarshalProto(r *protoReader) error {
+	for r.more() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		var raw uint64
+		switch {
+		case field == 7 && wireType == protoBytes:
+			err = unmarshalProtoKeyValue(r, &dataPoint.Attributes)
+		case field == 3 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.TimeUnixNano = otlpUint64(raw)
+		case field == 4 && wireType == protoFixed64:
+			raw, err = r.fixed64()
+			dataPoint.Count = otlpUint64(raw)
+		case field == 5 && wireType == protoFixed64:
+			var sum float64
+			sum, err = r.double()
+			dataPoint.Sum = otlpDouble(sum)
+		case field == 6 && wireType == protoBytes:
+			quantile := &otlpValueQuantile{}
+			err = unmarshalProtoMessage(r, func(r *protoReader) error {
+				for r.more() {
+					field, wireType, err := r.next()
+					if err != nil {
+						return err
+					}
+					var value float64
+					switch {
+					case field == 1 && wireType == protoFixed64:
+						value, err = r.double()
+						quantile.Quantile = otlpDouble(value)
+					case field == 2 && wireType == protoFixed64:
+						value, err = r.double()
+						quantile.Value = otlpDouble(value)
+					default:
+						err = r.skip(wireType)
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			dataPoint.QuantileValues = append(dataPoint.QuantileValues, quantile)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
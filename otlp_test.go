@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Test helpers producing protobuf wire format.
+
+func uvarint(value uint64) []byte {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	return encoded[:binary.PutUvarint(encoded, value)]
+}
+
+func fixed64(value uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, value)
+	return encoded
+}
+
+func protoKey(field int, wireType int) []byte {
+	return uvarint(uint64(field<<3 | wireType))
+}
+
+func protoField(field int, value []byte) []byte {
+	return protoConcat(protoKey(field, protoBytes), uvarint(uint64(len(value))), value)
+}
+
+func protoFixed(field int, value uint64) []byte {
+	return protoConcat(protoKey(field, protoFixed64), fixed64(value))
+}
+
+func protoUvarint(field int, value uint64) []byte {
+	return protoConcat(protoKey(field, protoVarint), uvarint(value))
+}
+
+func protoConcat(parts ...[]byte) []byte {
+	joined := []byte{}
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return joined
+}
+
+func protoAttribute(field int, key string, value string) []byte {
+	return protoField(field, protoConcat(protoField(1, []byte(key)), protoField(2, protoField(1, []byte(value)))))
+}
+
+var otlpTestJson = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+    "scopeMetrics": [{
+      "scope": {"name": "meter", "version": "1.0"},
+      "metrics": [
+        {"name": "queue.size", "gauge": {"dataPoints": [{"timeUnixNano": "1501096898000000000", "asInt": "7", "attributes": [{"key": "shard", "value": {"intValue": "3"}}]}]}},
+        {"name": "requests", "sum": {"isMonotonic": true, "aggregationTemporality": 2, "dataPoints": [{"timeUnixNano": "1501096898000000000", "asDouble": 12.5}]}},
+        {"name": "latency", "histogram": {"dataPoints": [{"timeUnixNano": "1501096898000000000", "count": "3", "sum": 6, "bucketCounts": ["1", "2"], "explicitBounds": [1]}]}},
+        {"name": "size", "exponentialHistogram": {"dataPoints": [{"timeUnixNano": "1501096898000000000", "count": "3", "scale": 0, "zeroCount": "1", "positive": {"offset": 0, "bucketCounts": ["2"]}}]}},
+        {"name": "rpc", "summary": {"dataPoints": [{"timeUnixNano": "1501096898000000000", "count": "4", "sum": 8, "quantileValues": [{"quantile": 0.5, "value": 2}]}]}}
+      ]
+    }]
+  }]
+}`
+
+func otlpTestProtobuf() []byte {
+	gauge := protoField(5, protoField(1, protoConcat(
+		protoAttribute(7, "shard", "3"),
+		protoFixed(3, 1501096898000000000),
+		protoFixed(6, 7),
+	)))
+	sum := protoField(7, protoConcat(
+		protoField(1, protoConcat(protoFixed(3, 1501096898000000000), protoFixed(4, math.Float64bits(12.5)))),
+		protoUvarint(2, 2),
+		protoUvarint(3, 1),
+	))
+	histogram := protoField(9, protoField(1, protoConcat(
+		protoFixed(3, 1501096898000000000),
+		protoFixed(4, 3),
+		protoFixed(5, math.Float64bits(6)),
+		protoField(6, protoConcat(fixed64(1), fixed64(2))),
+		protoField(7, fixed64(math.Float64bits(1))),
+	)))
+	exponential := protoField(10, protoField(1, protoConcat(
+		protoFixed(3, 1501096898000000000),
+		protoFixed(4, 3),
+		protoFixed(7, 1),
+		protoField(8, protoField(2, []byte{2})),
+	)))
+	summary := protoField(11, protoField(1, protoConcat(
+		protoFixed(3, 1501096898000000000),
+		protoFixed(4, 4),
+		protoFixed(5, math.Float64bits(8)),
+		protoField(6, protoConcat(protoFixed(1, math.Float64bits(0.5)), protoFixed(2, math.Float64bits(2)))),
+	)))
+	metrics := protoConcat(
+		protoField(2, protoConcat(protoField(1, []byte("queue.size")), gauge)),
+		protoField(2, protoConcat(protoField(1, []byte("requests")), sum)),
+		protoField(2, protoConcat(protoField(1, []byte("latency")), histogram)),
+		protoField(2, protoConcat(protoField(1, []byte("size")), exponential)),
+		protoField(2, protoConcat(protoField(1, []byte("rpc")), summary)),
+	)
+	scope := protoField(1, protoConcat(protoField(1, []byte("meter")), protoField(2, []byte("1.0"))))
+	resource := protoField(1, protoAttribute(1, "service.name", "checkout"))
+	return protoField(1, protoConcat(resource, protoField(2, protoConcat(scope, metrics))))
+}
+
+var otlpExpectedPoints = []string{
+	"latency,le=+Inf,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout bucket=3i 1501096898000000000",
+	"latency,le=1,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout bucket=1i 1501096898000000000",
+	"latency,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout count=3i,sum=6 1501096898000000000",
+	"queue.size,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout,shard=3 gauge=7i 1501096898000000000",
+	"requests,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout counter=12.5 1501096898000000000",
+	"rpc,otel.scope.name=meter,otel.scope.version=1.0,quantile=0.5,service.name=checkout value=2 1501096898000000000",
+	"rpc,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout count=4i,sum=8 1501096898000000000",
+	"size,le=2,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout bucket=3i 1501096898000000000",
+	"size,otel.scope.name=meter,otel.scope.version=1.0,service.name=checkout count=3i,scale=0i,zero_count=1i 1501096898000000000",
+}
+
+func pointStrings(points []*influx.Point) []string {
+	actual := []string{}
+	for _, point := range points {
+		actual = append(actual, point.String())
+	}
+	sort.Strings(actual)
+	return actual
+}
+
+func Test_Otlp_Parser_Decodes_Metrics(t *testing.T) {
+	testCases := []struct {
+		label    string
+		encoding string
+		value    []byte
+	}{
+		{"Should Decode OTLP JSON", "json", []byte(otlpTestJson)},
+		{"Should Detect OTLP JSON", "auto", []byte(otlpTestJson)},
+		{"Should Decode OTLP Protobuf", "protobuf", otlpTestProtobuf()},
+		{"Should Detect OTLP Protobuf", "auto", otlpTestProtobuf()},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut := &OtlpParser{&OtlpConfig{Encoding: testCase.encoding}}
+			points, err := sut.Parse(&sarama.ConsumerMessage{Value: testCase.value}, time.Now())
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			actual := pointStrings(points)
+			if fmt.Sprint(actual) != fmt.Sprint(otlpExpectedPoints) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, otlpExpectedPoints, actual))
+			}
+		})
+	}
+}
+
+func Test_Otlp_Parser_Rejects_Truncated_Protobuf(t *testing.T) {
+	value := otlpTestProtobuf()
+	sut := &OtlpParser{&OtlpConfig{Encoding: "protobuf"}}
+	if _, err := sut.Parse(&sarama.ConsumerMessage{Value: value[:len(value)-3]}, time.Now()); err == nil {
+		t.Error("Expected truncated protobuf message to fail decoding")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"time"
+)
+
+// Parser turns the value of a consumed message into points. The default time is
+// used for points that do not carry their own timestamp.
+type Parser interface {
+	Parse(message *sarama.ConsumerMessage, defaultTime time.Time) ([]*influx.Point, error)
+}
+
+func NewParser(topic *TopicConfig) (Parser, error) {
+	switch topic.Format {
+	case "", "line":
+		return &LineProtocolParser{topic.Precision}, nil
+	case "otlp":
+		return &OtlpParser{topic.Otlp}, nil
+	case "json":
+		return &JsonParser{topic.Json}, nil
+	case "graphite":
+		return NewGraphiteParser(topic.Graphite)
+	}
+	return nil, fmt.Errorf("unsupported input format %q", topic.Format)
+}
+
+type LineProtocolParser struct {
+	precision string
+}
+
+func (p *LineProtocolParser) Parse(message *sarama.ConsumerMessage, defaultTime time.Time) ([]*influx.Point, error) {
+	parsed, err := models.ParsePointsWithPrecision(message.Value, defaultTime, p.precision)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*influx.Point, 0, len(parsed))
+	for _, point := range parsed {
+		points = append(points, influx.NewPointFrom(point))
+	}
+	return points, nil
+}
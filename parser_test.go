@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+var LineProtocolParserTestCases = []struct {
+	label    string
+	value    string
+	expected []string
+}{
+	{"single point", "cpu value=1 1501096898000000000", []string{"cpu value=1 1501096898000000000"}},
+	{
+		"every point of the message",
+		"cpu value=1 1501096898000000000\nmem,host=a used=2i 1501096898000000000\n\ndisk free=3 1501096898000000000",
+		[]string{"cpu value=1 1501096898000000000", "mem,host=a used=2i 1501096898000000000", "disk free=3 1501096898000000000"},
+	},
+	{"default time", "cpu value=1", []string{"cpu value=1 1501096898000000000"}},
+}
+
+func Test_Line_Protocol_Parser(t *testing.T) {
+	sut := &LineProtocolParser{}
+	for _, testCase := range LineProtocolParserTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			points, err := sut.Parse(&sarama.ConsumerMessage{Value: []byte(testCase.value)}, time.Unix(0, 1501096898000000000))
+
+			actual := []string{}
+			for _, point := range points {
+				actual = append(actual, point.String())
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("Unexpected points.\n\texpected: %v\n\tactual: %v", testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Line_Protocol_Parser_Rejects_Invalid_Lines(t *testing.T) {
+	sut := &LineProtocolParser{}
+	if _, err := sut.Parse(&sarama.ConsumerMessage{Value: []byte("cpu value=1\nnot line protocol")}, time.Now()); err == nil {
+		t.Error("Expected a message with an invalid line to be rejected")
+	}
+}
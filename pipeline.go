@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+)
+
+// Stage processes the points parsed from a single message before they are
+// batched. A stage drops points by leaving them out of the returned slice and
+// may emit points of its own.
+type Stage interface {
+	Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point
+}
+
+func applyStages(stages []Stage, points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	for _, stage := range stages {
+		if len(points) == 0 {
+			break
+		}
+		points = stage.Apply(points, message)
+	}
+	return points
+}
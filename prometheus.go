@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/snappy"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PrometheusConfig writes to the Prometheus remote write endpoint at Url.
+type PrometheusConfig struct {
+	Url     string
+	Timeout time.Duration
+}
+
+func NewPrometheusConfig(entry map[string]interface{}) *PrometheusConfig {
+	conf := &PrometheusConfig{Timeout: 5 * time.Second}
+	if value, ok := entry["url"].(string); ok {
+		conf.Url = value
+	}
+	if value, ok := entry["timeout"].(int); ok {
+		conf.Timeout = time.Duration(value) * time.Millisecond
+	}
+	return conf
+}
+
+// PrometheusSink writes every numeric field as a series named after its
+// measurement and field, labelled with the tags of its point. Batches the
+// endpoint rejects as invalid are dropped rather than retried, unless it is
+// throttling or timed out the request.
+type PrometheusSink struct {
+	writeStatus
+	config *PrometheusConfig
+	client *http.Client
+}
+
+func NewPrometheusSink(config *PrometheusConfig) (*PrometheusSink, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("prometheus sink requires a url")
+	}
+	return &PrometheusSink{config: config, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+type prometheusLabel struct {
+	name  string
+	value string
+}
+
+// prometheusWriteRequest encodes the metrics as a snappy compressed
+// prometheus.WriteRequest.
+func prometheusWriteRequest(metrics []sinkMetric) []byte {
+	request := &protoWriter{}
+	for _, metric := range metrics {
+		labels := []prometheusLabel{{"__name__", prometheusName(metric.fullName("_"), true)}}
+		for key, value := range metric.tags {
+			labels = append(labels, prometheusLabel{prometheusName(key, false), value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		series := &protoWriter{}
+		for _, label := range labels {
+			encoded := &protoWriter{}
+			encoded.bytes(1, []byte(label.name))
+			encoded.bytes(2, []byte(label.value))
+			series.message(1, encoded)
+		}
+		sample := &protoWriter{}
+		sample.double(1, metric.value)
+		sample.varint(2, uint64(metric.time.UnixNano()/int64(time.Millisecond)))
+		series.message(2, sample)
+		request.message(1, series)
+	}
+	return snappy.Encode(nil, request.buf)
+}
+
+// prometheusName sanitizes a metric name, which may contain colons, or a
+// label name.
+func prometheusName(name string, metric bool) string {
+	sanitized := sanitize(name, func(c rune) bool {
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == ':' && metric
+	})
+	if sanitized == "" || '0' <= sanitized[0] && sanitized[0] <= '9' {
+		return "_" + sanitized
+	}
+	return sanitized
+}
+
+func (s *PrometheusSink) Write(batch influx.BatchPoints) error {
+	metrics := sinkMetrics(batch.Points())
+	if len(metrics) == 0 {
+		return nil
+	}
+	request, err := http.NewRequest("POST", s.config.Url, bytes.NewReader(prometheusWriteRequest(metrics)))
+	if err != nil {
+		return s.record(err)
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	response, err := s.client.Do(request)
+	if err != nil {
+		MetricsSinkWriteFailure.Add("prometheus", 1)
+		return s.record(err)
+	}
+	defer response.Body.Close()
+	// Throttled and timed out requests are not invalid and are retried.
+	if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusRequestTimeout {
+		body, _ := ioutil.ReadAll(response.Body)
+		log.WithFields(log.Fields{"status": response.Status, "values": len(metrics)}).Errorf("Prometheus rejected values: %s", body)
+		MetricsSinkRejected.Add("prometheus", int64(len(metrics)))
+		return s.record(nil)
+	}
+	if response.StatusCode/100 != 2 {
+		MetricsSinkWriteFailure.Add("prometheus", 1)
+		return s.record(fmt.Errorf("prometheus remote write failed: %s", response.Status))
+	}
+	MetricsSinkValuesWritten.Add("prometheus", int64(len(metrics)))
+	return s.record(nil)
+}
+
+func (s *PrometheusSink) Close() error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Minimal protobuf wire format support for the handful of well known schemas
+// kandi speaks. Only the wire types used by those schemas are understood.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf message is truncated")
+
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func newProtoReader(buf []byte) *protoReader {
+	return &protoReader{buf: buf}
+}
+
+func (r *protoReader) more() bool {
+	return r.pos < len(r.buf)
+}
+
+// next reads the key of the next field.
+func (r *protoReader) next() (int, int, error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *protoReader) zigzag32() (int32, error) {
+	value, err := r.varint()
+	return int32(uint32(value>>1) ^ -uint32(value&1)), err
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if r.pos+8 > len(r.buf) {
+		return 0, errProtoTruncated
+	}
+	value := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return value, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	value, err := r.fixed64()
+	return math.Float64frombits(value), err
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)-r.pos) < length {
+		return nil, errProtoTruncated
+	}
+	value := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return value, nil
+}
+
+func (r *protoReader) message() (*protoReader, error) {
+	value, err := r.bytes()
+	if err != nil {
+		return nil, err
+	}
+	return newProtoReader(value), nil
+}
+
+// fixed64s reads a repeated fixed64 field in either packed or unpacked form.
+func (r *protoReader) fixed64s(wireType int, values []uint64) ([]uint64, error) {
+	if wireType == protoFixed64 {
+		value, err := r.fixed64()
+		return append(values, value), err
+	}
+	packed, err := r.message()
+	if err != nil {
+		return values, err
+	}
+	for packed.more() {
+		value, err := packed.fixed64()
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// varints reads a repeated varint field in either packed or unpacked form.
+func (r *protoReader) varints(wireType int, values []uint64) ([]uint64, error) {
+	if wireType == protoVarint {
+		value, err := r.varint()
+		return append(values, value), err
+	}
+	packed, err := r.message()
+	if err != nil {
+		return values, err
+	}
+	for packed.more() {
+		value, err := packed.varint()
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r *protoReader) skip(wireType int) error {
+	switch wireType {
+	case protoVarint:
+		_, err := r.varint()
+		return err
+	case protoFixed64:
+		_, err := r.fixed64()
+		return err
+	case protoBytes:
+		_, err := r.bytes()
+		return err
+	case protoFixed32:
+		if r.pos+4 > len(r.buf) {
+			return errProtoTruncated
+		}
+		r.pos += 4
+		return nil
+	}
+	return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+}
+
+// protoWriter appends fields to a message in the order they are written.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) key(field int, wireType int) {
+	w.buf = appendVarint(w.buf, uint64(field<<3|wireType))
+}
+
+func (w *protoWriter) varint(field int, value uint64) {
+	w.key(field, protoVarint)
+	w.buf = appendVarint(w.buf, value)
+}
+
+func (w *protoWriter) double(field int, value float64) {
+	w.key(field, protoFixed64)
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], math.Float64bits(value))
+	w.buf = append(w.buf, encoded[:]...)
+}
+
+func (w *protoWriter) bytes(field int, value []byte) {
+	w.key(field, protoBytes)
+	w.buf = appendVarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *protoWriter) message(field int, message *protoWriter) {
+	w.bytes(field, message.buf)
+}
+
+func appendVarint(buf []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buf = append(buf, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buf, byte(value))
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayConfig is the time range of the configured topics to write again. The
+// points go to Database and RetentionPolicy when given, instead of the
+// destinations configured globally and per topic.
+type ReplayConfig struct {
+	From            time.Time
+	To              time.Time
+	Database        string
+	RetentionPolicy string
+	Progress        ProgressConfig
+}
+
+func parseReplayArgs(args []string, output io.Writer) (*ReplayConfig, error) {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(output)
+	from := flags.String("from", "", "RFC3339 time of the first message to replay")
+	to := flags.String("to", "", "RFC3339 time the replay stops before")
+	database := flags.String("database", "", "database to write to instead of the configured ones")
+	retentionPolicy := flags.String("retention-policy", "", "retention policy to write to instead of the configured ones")
+	conf := &ReplayConfig{}
+	progressFlags(flags, &conf.Progress)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if *from == "" || *to == "" {
+		return nil, errors.New("-from and -to are required")
+	}
+	conf.Database = *database
+	conf.RetentionPolicy = *retentionPolicy
+	var err error
+	if conf.From, err = time.Parse(time.RFC3339, *from); err != nil {
+		return nil, err
+	}
+	if conf.To, err = time.Parse(time.RFC3339, *to); err != nil {
+		return nil, err
+	}
+	if !conf.From.Before(conf.To) {
+		return nil, errors.New("-from must be before -to")
+	}
+	if conf.Progress.MaxRate < 0 {
+		return nil, errors.New("-max-rate must not be negative")
+	}
+	if conf.Progress.MaxRetries < 0 {
+		return nil, errors.New("-max-retries must not be negative")
+	}
+	return conf, nil
+}
+
+// apply points every destination at the chosen database and retention policy.
+func (r *ReplayConfig) apply(conf *Config) {
+	if r.Database != "" {
+		conf.Influx.Database = r.Database
+	}
+	if r.RetentionPolicy != "" {
+		conf.Influx.RetentionPolicy = r.RetentionPolicy
+	}
+	for _, topic := range conf.Kafka.TopicConfigs {
+		if r.Database != "" {
+			topic.Database = ""
+		}
+		if r.RetentionPolicy != "" {
+			topic.RetentionPolicy = ""
+		}
+	}
+}
+
+type replayRange struct {
+	start int64
+	end   int64
+}
+
+// replayRanges resolves, per partition of the consumed topics, the offsets of
+// the first messages stamped at or after from and to. A partition with no
+// message after either time ends at its newest offset.
+func replayRanges(client offsetClient, userConfig *KafkaConfig, from time.Time, to time.Time) (map[topicPartition]replayRange, error) {
+	topics, err := consumedTopics(client, userConfig)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[topicPartition]replayRange)
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range partitions {
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+			start, err := client.GetOffset(topic, partition, from.UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				return nil, err
+			}
+			end, err := client.GetOffset(topic, partition, to.UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				return nil, err
+			}
+			if start < 0 {
+				start = newest
+			}
+			if end < 0 {
+				end = newest
+			}
+			ranges[topicPartition{topic, partition}] = replayRange{start, end}
+		}
+	}
+	return ranges, nil
+}
+
+// ReplayConsumer reads a range of offsets from partitions assigned to it
+// directly, outside of any consumer group, so the offsets of the group are
+// left alone. Marked offsets are only recorded in the checkpoint, if any.
+type ReplayConsumer struct {
+	client     sarama.Client
+	consumer   sarama.Consumer
+	checkpoint *backfillCheckpoint
+	progress   *backfillProgress
+	idle       time.Duration
+	messages   chan *sarama.ConsumerMessage
+	errors     chan error
+	closing    chan bool
+	wait       sync.WaitGroup
+	// remaining reports whether the log of a partition holds a message to
+	// pass on from the offset next on and before end.
+	remaining func(key topicPartition, next int64, end int64) (bool, error)
+}
+
+// NewReplayConsumer leaves the client open when it fails. The progress learns
+// of partitions whose range ended before its last offset, which may be missing
+// from the log after compaction or be a transaction marker.
+func NewReplayConsumer(client sarama.Client, ranges map[topicPartition]replayRange, progress *backfillProgress) (*ReplayConsumer, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	c := &ReplayConsumer{
+		client:   client,
+		consumer: consumer,
+		progress: progress,
+		// Fetches return at least every MaxWaitTime while caught up.
+		idle:     10 * client.Config().Consumer.MaxWaitTime,
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan error),
+		closing:  make(chan bool),
+	}
+	c.remaining = c.fetchRemaining
+	for key, offsets := range ranges {
+		if offsets.start >= offsets.end {
+			continue
+		}
+		partition, err := consumer.ConsumePartition(key.topic, key.partition, offsets.start)
+		if err != nil {
+			close(c.closing)
+			c.wait.Wait()
+			consumer.Close()
+			return nil, err
+		}
+		c.wait.Add(1)
+		go c.forward(key, partition, offsets)
+	}
+	return c, nil
+}
+
+// forward passes on the messages of a partition until the end of its range.
+// Offsets missing from the end of the range are never delivered, so once
+// nothing arrived for a while the log is checked for messages still to come,
+// and the partition ends when none are left before the end of its range.
+func (c *ReplayConsumer) forward(key topicPartition, partition sarama.PartitionConsumer, offsets replayRange) {
+	defer c.wait.Done()
+	defer partition.Close()
+	last := offsets.start - 1
+	received := false
+	ticker := time.NewTicker(c.idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-partition.Messages():
+			if !ok || message.Offset >= offsets.end {
+				c.exhausted(key, last)
+				return
+			}
+			select {
+			case c.messages <- message:
+			case <-c.closing:
+				return
+			}
+			last = message.Offset
+			received = true
+			if message.Offset >= offsets.end-1 {
+				return
+			}
+		case err, ok := <-partition.Errors():
+			if ok {
+				select {
+				case c.errors <- err:
+				case <-c.closing:
+					return
+				}
+			}
+		case <-ticker.C:
+			if received {
+				received = false
+				continue
+			}
+			remaining, err := c.remaining(key, last+1, offsets.end)
+			if err != nil {
+				log.WithError(err).WithField("partition", key).Warn("Unable to look for the end of a replayed partition")
+				continue
+			}
+			if !remaining {
+				c.exhausted(key, last)
+				return
+			}
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// fetchRemaining reads the log of a partition from the leader, from the offset
+// next on, until it finds a message or reaches end.
+func (c *ReplayConsumer) fetchRemaining(key topicPartition, next int64, end int64) (bool, error) {
+	config := c.client.Config()
+	for next < end {
+		broker, err := c.client.Leader(key.topic, key.partition)
+		if err != nil {
+			return false, err
+		}
+		// Replays need the 0.10.1 protocol, record batches come with 0.11.
+		request := &sarama.FetchRequest{Version: 3, MinBytes: 1, MaxBytes: sarama.MaxResponseSize}
+		if config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			request.Version = 4
+			request.Isolation = config.Consumer.IsolationLevel
+		}
+		request.AddBlock(key.topic, key.partition, next, config.Consumer.Fetch.Default)
+		response, err := broker.Fetch(request)
+		if err != nil {
+			return false, err
+		}
+		block := response.GetBlock(key.topic, key.partition)
+		if block == nil {
+			return false, sarama.ErrIncompleteResponse
+		}
+		if block.Err != sarama.ErrNoError {
+			return false, block.Err
+		}
+		var remaining bool
+		if remaining, next = remainingMessages(block, next, end); remaining {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// remainingMessages reports whether a fetched block holds a message from the
+// offset next on and before end, and otherwise returns the offset to fetch
+// from next, which is end once the log is known to hold nothing before it.
+// Transaction markers are skipped like the partition consumer does.
+func remainingMessages(block *sarama.FetchResponseBlock, next int64, end int64) (bool, int64) {
+	first := int64(-1)
+	resume := next
+	found := func(offset int64) {
+		if offset >= next && (first < 0 || offset < first) {
+			first = offset
+		}
+	}
+	for _, records := range block.RecordsSet {
+		if batch := records.RecordBatch; batch != nil {
+			if batch.LastOffset() >= resume {
+				resume = batch.LastOffset() + 1
+			}
+			if batch.Control {
+				continue
+			}
+			for _, record := range batch.Records {
+				found(batch.FirstOffset + record.OffsetDelta)
+			}
+		}
+		if set := records.MsgSet; set != nil {
+			for _, message := range set.Messages {
+				if message.Offset >= resume {
+					resume = message.Offset + 1
+				}
+				// Compressed messages of version 1 number their inner
+				// messages relative to the offset of the last one.
+				inner := message.Messages()
+				base := int64(0)
+				if message.Msg.Version >= 1 && message.Msg.Set != nil {
+					base = message.Offset - inner[len(inner)-1].Offset
+				}
+				for _, innerMessage := range inner {
+					found(base + innerMessage.Offset)
+				}
+			}
+		}
+	}
+	switch {
+	case first >= 0:
+		return first < end, end
+	case resume > next:
+		return false, resume
+	case block.HighWaterMarkOffset <= next:
+		// The log ends at next.
+		return false, end
+	}
+	// Nothing came back although the log goes on, so look again later.
+	return true, next
+}
+
+// exhausted ends the progress of a partition at the last offset passed on.
+func (c *ReplayConsumer) exhausted(key topicPartition, last int64) {
+	if c.progress != nil {
+		c.progress.exhaust(key, last)
+	}
+}
+
+// ConsumeMessage returns nil when no message arrives shortly, so that the
+// last batch of the range is written without waiting for more, or once the
+// consumer was closed.
+func (c *ReplayConsumer) ConsumeMessage() (*sarama.ConsumerMessage, error) {
+	select {
+	case message := <-c.messages:
+		return message, nil
+	case err := <-c.errors:
+		return nil, err
+	case <-c.closing:
+	case <-time.After(100 * time.Millisecond):
+	}
+	return nil, nil
+}
+
+func (c *ReplayConsumer) MarkOffset(messages []*sarama.ConsumerMessage) {
+	if c.checkpoint == nil {
+		return
+	}
+	if err := c.checkpoint.mark(messages); err != nil {
+		log.WithError(err).WithField("path", c.checkpoint.path).Error("Unable to save backfill checkpoint")
+	}
+}
+
+func (c *ReplayConsumer) Close() {
+	log.Debug("Closing replay consumer")
+	close(c.closing)
+	c.wait.Wait()
+	c.consumer.Close()
+	c.client.Close()
+}
+
+// replay writes the messages of the configured topics stamped within a time
+// range again, then returns.
+func replay(args []string) error {
+	replayConf, err := parseReplayArgs(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	conf := NewConfig()
+	replayConf.apply(conf)
+	// Looking offsets up by timestamp needs the 0.10.1 protocol.
+	if !conf.Kafka.Cluster.Version.IsAtLeast(sarama.V0_10_1_0) {
+		conf.Kafka.Cluster.Version = sarama.V0_10_1_0
+	}
+
+	client, err := sarama.NewClient(strings.Split(conf.Kafka.Brokers, ","), &conf.Kafka.Cluster.Config)
+	if err != nil {
+		return err
+	}
+	ranges, err := replayRanges(client, conf.Kafka, replayConf.From, replayConf.To)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	progress := newBackfillProgress(rangeOffsets(ranges))
+	if progress.Done() {
+		client.Close()
+		log.WithFields(log.Fields{"from": replayConf.From, "to": replayConf.To}).Info("Nothing to replay")
+		return nil
+	}
+	consumer, err := NewReplayConsumer(client, ranges, progress)
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	kandi := NewKandi(conf)
+	kandi.Consumer = consumer
+	kandi.PostProcessors = []func(processedMessages []*sarama.ConsumerMessage) bool{progress.Observe}
+	kandi.MaxRetries = replayConf.Progress.MaxRetries
+	log.WithFields(log.Fields{"from": replayConf.From, "to": replayConf.To, "partitions": len(ranges)}).Info("Starting Kandi Replay")
+	progress.start(replayConf.Progress)
+	publishProgress(progress)
+	kandi.Start()
+	log.Info("Stopping Kandi Replay")
+	return kandi.Err()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/bsm/sarama-cluster"
+	"testing"
+	"time"
+)
+
+var ReplayArgsTestCases = []struct {
+	label    string
+	args     []string
+	expected *ReplayConfig
+	err      bool
+}{
+	{"time range", []string{"--from", "2018-06-01T00:00:00Z", "--to", "2018-06-01T06:00:00Z"}, &ReplayConfig{From: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2018, 6, 1, 6, 0, 0, 0, time.UTC), Progress: ProgressConfig{ReportInterval: 30 * time.Second, MaxRetries: 10}}, false},
+	{"destination", []string{"-from", "2018-06-01T00:00:00Z", "-to", "2018-06-01T06:00:00Z", "-database", "restore", "-retention-policy", "raw"}, &ReplayConfig{From: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2018, 6, 1, 6, 0, 0, 0, time.UTC), Database: "restore", RetentionPolicy: "raw", Progress: ProgressConfig{ReportInterval: 30 * time.Second, MaxRetries: 10}}, false},
+	{"throttled", []string{"-from", "2018-06-01T00:00:00Z", "-to", "2018-06-01T06:00:00Z", "-max-rate", "5000", "-report-interval", "1m"}, &ReplayConfig{From: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2018, 6, 1, 6, 0, 0, 0, time.UTC), Progress: ProgressConfig{MaxRate: 5000, ReportInterval: time.Minute, MaxRetries: 10}}, false},
+	{"missing to", []string{"-from", "2018-06-01T00:00:00Z"}, nil, true},
+	{"invalid time", []string{"-from", "yesterday", "-to", "2018-06-01T06:00:00Z"}, nil, true},
+	{"empty range", []string{"-from", "2018-06-01T06:00:00Z", "-to", "2018-06-01T06:00:00Z"}, nil, true},
+}
+
+func Test_Replay_Args(t *testing.T) {
+	for _, testCase := range ReplayArgsTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := parseReplayArgs(testCase.args, &bytes.Buffer{})
+
+			if testCase.err {
+				if err == nil {
+					t.Error(fmt.Sprintf("Expected an error but got %+v", actual))
+				}
+				return
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if *actual != *testCase.expected {
+				t.Error(fmt.Sprintf("Unexpected replay configuration.\n\texpected: %+v\n\tactual: %+v", testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Replay_Overrides_Every_Destination(t *testing.T) {
+	conf := &Config{
+		Influx: &InfluxConfig{Database: "metrics", RetentionPolicy: "autogen"},
+		Kafka:  &KafkaConfig{TopicConfigs: []*TopicConfig{{Name: "events", Database: "events", RetentionPolicy: "week"}}},
+	}
+
+	(&ReplayConfig{Database: "restore"}).apply(conf)
+
+	if conf.Influx.Database != "restore" || conf.Influx.RetentionPolicy != "autogen" {
+		t.Error(fmt.Sprintf("Unexpected global destination %s.%s", conf.Influx.Database, conf.Influx.RetentionPolicy))
+	}
+	if topic := conf.Kafka.TopicConfigs[0]; topic.Database != "" || topic.RetentionPolicy != "week" {
+		t.Error(fmt.Sprintf("Unexpected topic destination %s.%s", topic.Database, topic.RetentionPolicy))
+	}
+}
+
+func Test_Replay_Ranges_Are_Resolved_By_Timestamp(t *testing.T) {
+	from := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	fromMs := from.UnixNano() / int64(time.Millisecond)
+	toMs := to.UnixNano() / int64(time.Millisecond)
+	client := &mockOffsetClient{
+		offsets: map[topicPartition][2]int64{
+			{"metrics", 0}: {0, 100},
+			{"metrics", 1}: {0, 50},
+			{"metrics", 2}: {0, 20},
+		},
+		byTime: map[topicPartition]map[int64]int64{
+			{"metrics", 0}: {fromMs: 10, toMs: 40},
+			{"metrics", 1}: {fromMs: 30},
+		},
+	}
+
+	actual, err := replayRanges(client, &KafkaConfig{Topics: "metrics", Cluster: cluster.NewConfig()}, from, to)
+
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+		return
+	}
+	expected := map[topicPartition]replayRange{
+		{"metrics", 0}: {10, 40},
+		{"metrics", 1}: {30, 50},
+		{"metrics", 2}: {20, 20},
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected ranges.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
+
+func Test_Replay_Ends_Partitions_Missing_Their_Last_Offset(t *testing.T) {
+	key := topicPartition{"metrics", 0}
+	// The mock numbers messages from 1, offset 3 is a transaction marker.
+	consumer := mocks.NewConsumer(t, sarama.NewConfig())
+	expected := consumer.ExpectConsumePartition(key.topic, key.partition, 1)
+	expected.YieldMessage(&sarama.ConsumerMessage{Topic: key.topic, Partition: key.partition})
+	expected.YieldMessage(&sarama.ConsumerMessage{Topic: key.topic, Partition: key.partition})
+	partition, _ := consumer.ConsumePartition(key.topic, key.partition, 1)
+	progress := newBackfillProgress(map[topicPartition]Offset{key: {false, 4}})
+	sut := &ReplayConsumer{progress: progress, idle: 10 * time.Millisecond, messages: make(chan *sarama.ConsumerMessage), errors: make(chan error), closing: make(chan bool)}
+	sut.remaining = func(key topicPartition, next int64, end int64) (bool, error) {
+		return next < 3, nil
+	}
+	sut.wait.Add(1)
+	go sut.forward(key, partition, replayRange{1, 4})
+
+	for offset := int64(1); offset <= 2; offset++ {
+		message, err := sut.ConsumeMessage()
+		if err != nil || message == nil || message.Offset != offset {
+			t.Fatal(fmt.Sprintf("Expected offset %d but found %v %v", offset, message, err))
+		}
+		if progress.Observe([]*sarama.ConsumerMessage{message}) {
+			t.Error(fmt.Sprintf("Expected replay to wait after offset %d", offset))
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		sut.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the partition to end without its last offset")
+	}
+	if !progress.Observe(nil) {
+		t.Error("Expected replay to finish at the last offset read")
+	}
+}
+
+func Test_Replay_Waits_For_Messages_Left_In_The_Range(t *testing.T) {
+	key := topicPartition{"metrics", 0}
+	consumer := mocks.NewConsumer(t, sarama.NewConfig())
+	expected := consumer.ExpectConsumePartition(key.topic, key.partition, 1)
+	expected.YieldMessage(&sarama.ConsumerMessage{Topic: key.topic, Partition: key.partition})
+	partition, _ := consumer.ConsumePartition(key.topic, key.partition, 1)
+	checks := make(chan int64, 100)
+	sut := &ReplayConsumer{idle: 10 * time.Millisecond, messages: make(chan *sarama.ConsumerMessage), errors: make(chan error), closing: make(chan bool)}
+	sut.remaining = func(key topicPartition, next int64, end int64) (bool, error) {
+		checks <- next
+		return true, nil
+	}
+	sut.wait.Add(1)
+	go sut.forward(key, partition, replayRange{1, 3})
+
+	if message, _ := sut.ConsumeMessage(); message == nil || message.Offset != 1 {
+		t.Fatal(fmt.Sprintf("Expected offset 1 but found %v", message))
+	}
+	// A slow broker leaves the partition quiet while offset 2 is still due.
+	for i := 0; i < 3; i++ {
+		if next := <-checks; next != 2 {
+			t.Error(fmt.Sprintf("Expected the log to be checked from offset 2 but was from %d", next))
+		}
+	}
+	expected.YieldMessage(&sarama.ConsumerMessage{Topic: key.topic, Partition: key.partition})
+	if message, _ := sut.ConsumeMessage(); message == nil || message.Offset != 2 {
+		t.Fatal(fmt.Sprintf("Expected offset 2 but found %v", message))
+	}
+	sut.wait.Wait()
+}
+
+func fetchedBlock(build func(response *sarama.FetchResponse)) *sarama.FetchResponseBlock {
+	response := &sarama.FetchResponse{Version: 4}
+	build(response)
+	block := response.GetBlock("metrics", 0)
+	if block == nil {
+		response.AddError("metrics", 0, sarama.ErrNoError)
+		block = response.GetBlock("metrics", 0)
+	}
+	return block
+}
+
+var RemainingMessagesTestCases = []struct {
+	label         string
+	block         *sarama.FetchResponseBlock
+	highWaterMark int64
+	remaining     bool
+	resume        int64
+}{
+	{"message in range", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddRecord("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 3)
+	}), 10, true, 6},
+	{"message after a compacted offset", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddRecord("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 5)
+	}), 10, true, 6},
+	{"message beyond the range", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddRecord("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 6)
+	}), 10, false, 6},
+	{"message before next", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddRecord("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 2)
+		r.SetLastOffsetDelta("metrics", 0, 3)
+	}), 10, false, 4},
+	{"transaction marker", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddControlRecord("metrics", 0, 3, 7, sarama.ControlRecordCommit)
+		r.AddRecordBatch("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 6, 7, true)
+	}), 10, false, 6},
+	{"transaction marker at the end of the log", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddControlRecord("metrics", 0, 3, 7, sarama.ControlRecordCommit)
+	}), 10, false, 4},
+	{"legacy message in range", fetchedBlock(func(r *sarama.FetchResponse) {
+		r.AddMessage("metrics", 0, nil, sarama.StringEncoder("cpu value=1"), 4)
+	}), 10, true, 6},
+	{"end of the log", fetchedBlock(func(r *sarama.FetchResponse) {}), 3, false, 6},
+}
+
+func Test_Remaining_Messages_Of_A_Fetched_Partition(t *testing.T) {
+	for _, testCase := range RemainingMessagesTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			testCase.block.HighWaterMarkOffset = testCase.highWaterMark
+
+			remaining, resume := remainingMessages(testCase.block, 3, 6)
+
+			if remaining != testCase.remaining || resume != testCase.resume {
+				t.Error(fmt.Sprintf("Expected %v from %d but found %v from %d", testCase.remaining, testCase.resume, remaining, resume))
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// RepublishConfig produces the points written to the sink to Topic as well,
+// as line protocol (default) or json. Brokers default to the brokers consumed
+// from.
+type RepublishConfig struct {
+	Topic   string
+	Format  string
+	Brokers string
+}
+
+func NewRepublishConfig(entry map[string]interface{}) *RepublishConfig {
+	conf := &RepublishConfig{Format: "line"}
+	if value, ok := entry["topic"].(string); ok {
+		conf.Topic = value
+	}
+	if value, ok := entry["format"].(string); ok {
+		conf.Format = strings.ToLower(value)
+	}
+	if value, ok := entry["brokers"].(string); ok {
+		conf.Brokers = value
+	}
+	return conf
+}
+
+// KafkaSink produces every point as its own record keyed by its series, so
+// the points of a series keep their order within a partition. A write only
+// succeeds once all in sync replicas acknowledged every record, and offsets
+// are only committed after that. The producer is idempotent, so records it
+// retries are written once, and a failed batch written again only produces
+// the records that were not acknowledged.
+type KafkaSink struct {
+	config     *RepublishConfig
+	userConfig *KafkaConfig
+	lock       sync.Mutex
+	producer   sarama.SyncProducer
+	failed     influx.BatchPoints
+	unsent     []*sarama.ProducerMessage
+	writeStatus
+}
+
+func NewKafkaSink(config *RepublishConfig, userConfig *KafkaConfig) (*KafkaSink, error) {
+	if config.Topic == "" {
+		return nil, fmt.Errorf("kafka sink requires a topic")
+	}
+	if config.Format != "line" && config.Format != "json" {
+		return nil, fmt.Errorf("unknown kafka sink format %s", config.Format)
+	}
+	if config.Brokers == "" {
+		config.Brokers = userConfig.Brokers
+	}
+	return &KafkaSink{config: config, userConfig: userConfig}, nil
+}
+
+// producerConfig derives the configuration of the idempotent producer from
+// the consumer's.
+func (s *KafkaSink) producerConfig() *sarama.Config {
+	config := s.userConfig.Cluster.Config
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Idempotent = true
+	// Idempotent producers need a single request in flight, which also keeps
+	// retries from reordering the records of a series.
+	config.Net.MaxOpenRequests = 1
+	// Producer ids were introduced by the 0.11 protocol.
+	if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		config.Version = sarama.V0_11_0_0
+	}
+	return &config
+}
+
+func (s *KafkaSink) connect() (sarama.SyncProducer, error) {
+	if s.producer != nil {
+		return s.producer, nil
+	}
+	producer, err := sarama.NewSyncProducer(strings.Split(s.config.Brokers, ","), s.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	s.producer = producer
+	return producer, nil
+}
+
+// republishedPoint is the json form of a point, with the time in
+// nanoseconds.
+type republishedPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        int64                  `json:"time"`
+}
+
+func (s *KafkaSink) encode(point *influx.Point) ([]byte, error) {
+	if s.config.Format == "line" {
+		return []byte(point.String()), nil
+	}
+	fields, err := point.Fields()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&republishedPoint{point.Name(), point.Tags(), fields, point.UnixNano()})
+}
+
+func (s *KafkaSink) messages(points []*influx.Point) ([]*sarama.ProducerMessage, error) {
+	messages := make([]*sarama.ProducerMessage, 0, len(points))
+	for _, point := range points {
+		value, err := s.encode(point)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic: s.config.Topic,
+			Key:   sarama.StringEncoder(SeriesKey(point.Name(), point.Tags())),
+			Value: sarama.ByteEncoder(value),
+		})
+	}
+	return messages, nil
+}
+
+func (s *KafkaSink) Write(batch influx.BatchPoints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	messages := s.unsent
+	if batch != s.failed {
+		var err error
+		if messages, err = s.messages(batch.Points()); err != nil {
+			return s.record(err)
+		}
+	}
+	if len(messages) == 0 {
+		s.failed, s.unsent = nil, nil
+		return nil
+	}
+	producer, err := s.connect()
+	if err != nil {
+		log.WithError(err).Error("Unable to create republish producer")
+		MetricsRepublishFailure.Add(1)
+		return s.record(err)
+	}
+	if err := producer.SendMessages(messages); err != nil {
+		log.WithError(err).WithField("topic", s.config.Topic).Error("Failed to republish batch")
+		MetricsRepublishFailure.Add(1)
+		s.failed, s.unsent = batch, unsent(messages, err)
+		return s.record(err)
+	}
+	s.failed, s.unsent = nil, nil
+	MetricsRepublishPointsSent.Add(int64(len(messages)))
+	return s.record(nil)
+}
+
+// unsent returns fresh copies of the records a failed send did not produce,
+// every record unless the producer told which failed.
+func unsent(messages []*sarama.ProducerMessage, err error) []*sarama.ProducerMessage {
+	if errs, ok := err.(sarama.ProducerErrors); ok {
+		messages = make([]*sarama.ProducerMessage, 0, len(errs))
+		for _, failed := range errs {
+			messages = append(messages, failed.Msg)
+		}
+	}
+	copies := make([]*sarama.ProducerMessage, 0, len(messages))
+	for _, message := range messages {
+		copies = append(copies, &sarama.ProducerMessage{Topic: message.Topic, Key: message.Key, Value: message.Value})
+	}
+	return copies
+}
+
+func (s *KafkaSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.producer == nil {
+		return nil
+	}
+	err := s.producer.Close()
+	s.producer = nil
+	return err
+}
+
+// teeSink writes every batch to each of its sinks in turn. A batch that
+// failed is retried on all of them.
+type teeSink []Sink
+
+func (t teeSink) Write(batch influx.BatchPoints) error {
+	for _, sink := range t {
+		if err := sink.Write(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t teeSink) Close() error {
+	var closeErr error
+	for _, sink := range t {
+		if err := sink.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+func (t teeSink) Health() error {
+	for _, sink := range t {
+		if err := sink.Health(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
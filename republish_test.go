@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+type mockSyncProducer struct {
+	messages []*sarama.ProducerMessage
+	err      error
+	// rejectLast fails the last record of the next send only.
+	rejectLast bool
+	// results are returned by the next sends, which produce nothing when
+	// their result is an error.
+	results []error
+	closed  bool
+}
+
+func (p *mockSyncProducer) SendMessage(message *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, p.SendMessages([]*sarama.ProducerMessage{message})
+}
+
+func (p *mockSyncProducer) SendMessages(messages []*sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.results) > 0 {
+		result := p.results[0]
+		p.results = p.results[1:]
+		if result != nil {
+			return result
+		}
+	}
+	if p.rejectLast {
+		p.rejectLast = false
+		last := len(messages) - 1
+		p.messages = append(p.messages, messages[:last]...)
+		return sarama.ProducerErrors{{Msg: messages[last], Err: sarama.ErrNotEnoughReplicas}}
+	}
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *mockSyncProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func produced(messages []*sarama.ProducerMessage) []string {
+	records := []string{}
+	for _, message := range messages {
+		key, _ := message.Key.Encode()
+		value, _ := message.Value.Encode()
+		records = append(records, fmt.Sprintf("%s %s: %s", message.Topic, key, value))
+	}
+	return records
+}
+
+var KafkaSinkTestCases = []struct {
+	label    string
+	format   string
+	expected []string
+}{
+	{
+		"line",
+		"line",
+		[]string{
+			"normalized cpu,host=web\\ 1,region=us-west: cpu,host=web\\ 1,region=us-west state=\"ok\",usage_idle=91.5,value=3i 1527847200500000000",
+			"normalized up: up value=true 1527847200500000000",
+		},
+	},
+	{
+		"json",
+		"json",
+		[]string{
+			`normalized cpu,host=web\ 1,region=us-west: {"measurement":"cpu","tags":{"host":"web 1","region":"us-west"},"fields":{"state":"ok","usage_idle":91.5,"value":3},"time":1527847200500000000}`,
+			`normalized up: {"measurement":"up","tags":{},"fields":{"value":true},"time":1527847200500000000}`,
+		},
+	},
+}
+
+func Test_Kafka_Sink_Produces_Points_Keyed_By_Series(t *testing.T) {
+	for _, testCase := range KafkaSinkTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			producer := &mockSyncProducer{}
+			sut, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: testCase.format}, &KafkaConfig{Brokers: "localhost:9092"})
+			sut.producer = producer
+
+			err := sut.Write(sinkBatch())
+
+			actual := produced(producer.messages)
+			if err != nil {
+				t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+			} else if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("Unexpected records.\n\texpected: %v\n\tactual: %v", testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Kafka_Sink_Failure(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	producer := &mockSyncProducer{err: errors.New("not enough in sync replicas")}
+	sut, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: "line"}, &KafkaConfig{Brokers: "localhost:9092"})
+	sut.producer = producer
+
+	if sut.Write(sinkBatch()) == nil {
+		t.Error("Expected unacknowledged batch to fail")
+	}
+	if sut.Health() == nil {
+		t.Error("Expected kafka sink to be unhealthy")
+	}
+	producer.err = nil
+	if sut.Write(sinkBatch()) != nil || sut.Health() != nil {
+		t.Error("Expected kafka sink to recover")
+	}
+	sut.Close()
+	if !producer.closed || sut.producer != nil {
+		t.Error("Expected producer to be closed")
+	}
+}
+
+func Test_Kafka_Sink_Retries_Only_Unacknowledged_Records(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	producer := &mockSyncProducer{rejectLast: true}
+	sut, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: "line"}, &KafkaConfig{Brokers: "localhost:9092"})
+	sut.producer = producer
+	batch := sinkBatch()
+
+	if sut.Write(batch) == nil {
+		t.Error("Expected partially acknowledged batch to fail")
+	}
+	if err := sut.Write(batch); err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	}
+	expected := []string{
+		"normalized cpu,host=web\\ 1,region=us-west: cpu,host=web\\ 1,region=us-west state=\"ok\",usage_idle=91.5,value=3i 1527847200500000000",
+		"normalized up: up value=true 1527847200500000000",
+	}
+	if actual := produced(producer.messages); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Expected every record to be produced once.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
+
+func Test_Retried_Delivery_Republishes_Only_Its_Failed_Batch(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	producer := &mockSyncProducer{results: []error{nil, errors.New("unavailable")}}
+	sink, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: "line"}, &KafkaConfig{Brokers: "localhost:9092"})
+	sink.producer = producer
+	sut := &Kandi{Sink: sink}
+	memory, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Database: "other"})
+	used, _ := influx.NewPoint("mem", map[string]string{}, map[string]interface{}{"used": int64(7)}, time.Unix(1527847200, 0))
+	memory.AddPoint(used)
+	prepared := &delivery{batches: []influx.BatchPoints{sinkBatch(), memory}}
+
+	if sut.write(prepared) == nil {
+		t.Error("Expected the delivery to fail with its second batch")
+	}
+	if err := sut.write(prepared); err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	}
+	expected := []string{
+		"normalized cpu,host=web\\ 1,region=us-west: cpu,host=web\\ 1,region=us-west state=\"ok\",usage_idle=91.5,value=3i 1527847200500000000",
+		"normalized up: up value=true 1527847200500000000",
+		"normalized mem: mem used=7i 1527847200000000000",
+	}
+	if actual := produced(producer.messages); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Expected every record to be produced once.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+}
+
+func Test_Kafka_Sink_Producer_Is_Idempotent(t *testing.T) {
+	userConfig := &KafkaConfig{Brokers: "localhost:9092", Cluster: cluster.NewConfig()}
+	sut, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: "line"}, userConfig)
+
+	actual := sut.producerConfig()
+
+	if !actual.Producer.Idempotent || !actual.Version.IsAtLeast(sarama.V0_11_0_0) {
+		t.Error(fmt.Sprintf("Expected an idempotent producer of version 0.11 or later but found %v %s", actual.Producer.Idempotent, actual.Version))
+	}
+	if err := actual.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Unexpected invalid producer configuration %s", err.Error()))
+	}
+}
+
+type failingSink struct {
+	writes int
+}
+
+func (s *failingSink) Write(batch influx.BatchPoints) error {
+	s.writes++
+	return errors.New("unavailable")
+}
+
+func (s *failingSink) Close() error  { return nil }
+func (s *failingSink) Health() error { return errors.New("unavailable") }
+
+func Test_Points_Are_Republished_After_The_Sink_Wrote_Them(t *testing.T) {
+	producer := &mockSyncProducer{}
+	republish, _ := NewKafkaSink(&RepublishConfig{Topic: "normalized", Format: "line"}, &KafkaConfig{Brokers: "localhost:9092"})
+	republish.producer = producer
+	primary := &failingSink{}
+	sut := teeSink{primary, republish}
+
+	if sut.Write(sinkBatch()) == nil || sut.Health() == nil {
+		t.Error("Expected failure of the sink to fail the batch")
+	}
+	if primary.writes != 1 || len(producer.messages) != 0 {
+		t.Error(fmt.Sprintf("Expected batch not to be republished but produced %d records", len(producer.messages)))
+	}
+}
+
+var RepublishSelectionTestCases = []struct {
+	label    string
+	config   map[string]interface{}
+	expected string
+}{
+	{"without topic", map[string]interface{}{"republish": map[string]interface{}{"format": "json"}}, "*main.Influx"},
+	{"with topic", map[string]interface{}{"republish": map[string]interface{}{"topic": "normalized"}}, "main.teeSink"},
+	{"unknown format", map[string]interface{}{"republish": map[string]interface{}{"topic": "normalized", "format": "avro"}}, ""},
+}
+
+func Test_Republish_Selection(t *testing.T) {
+	for _, testCase := range RepublishSelectionTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			conf := &Config{Kafka: &KafkaConfig{Brokers: "localhost:9092"}, Sink: NewSinkConfig(testCase.config)}
+
+			actual, err := NewSink(conf, &Influx{})
+
+			if testCase.expected == "" {
+				if err == nil {
+					t.Error(fmt.Sprintf("Expected an error but got %T", actual))
+				}
+			} else if err != nil || fmt.Sprintf("%T", actual) != testCase.expected {
+				t.Error(fmt.Sprintf("Expected %s but got %T %v", testCase.expected, actual, err))
+			}
+			if tee, ok := actual.(teeSink); ok && tee[1].(*KafkaSink).config.Brokers != "localhost:9092" {
+				t.Error("Expected republish brokers to default to the consumed brokers")
+			}
+		})
+	}
+}
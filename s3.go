@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config uploads to Bucket of an S3 compatible API at Endpoint, under
+// Prefix, with path style URLs. Requests are signed for Region with
+// AccessKey and SecretKey, which default to AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY. Temporary credentials carry a SessionToken as well,
+// defaulting to AWS_SESSION_TOKEN.
+type S3Config struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+func NewS3Config(entry map[string]interface{}) *S3Config {
+	conf := &S3Config{Endpoint: "https://s3.amazonaws.com", Region: "us-east-1", AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"), SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+	if value, ok := entry["endpoint"].(string); ok {
+		conf.Endpoint = strings.TrimSuffix(value, "/")
+	}
+	if value, ok := entry["region"].(string); ok {
+		conf.Region = value
+	}
+	if value, ok := entry["bucket"].(string); ok {
+		conf.Bucket = value
+	}
+	if value, ok := entry["prefix"].(string); ok {
+		conf.Prefix = strings.Trim(value, "/")
+	}
+	if value, ok := entry["accesskey"].(string); ok {
+		conf.AccessKey = value
+	}
+	if value, ok := entry["secretkey"].(string); ok {
+		conf.SecretKey = value
+	}
+	if value, ok := entry["sessiontoken"].(string); ok {
+		conf.SessionToken = value
+	}
+	return conf
+}
+
+type S3Store struct {
+	config *S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3Store(config *S3Config) *S3Store {
+	return &S3Store{config: config, client: &http.Client{Timeout: 5 * time.Minute}, now: time.Now}
+}
+
+// Put uploads the content as the object key, under the prefix.
+func (s *S3Store) Put(key string, content []byte) error {
+	if s.config.Prefix != "" {
+		key = s.config.Prefix + "/" + key
+	}
+	request, err := http.NewRequest("PUT", s.config.Endpoint+"/"+s.config.Bucket+"/"+awsEscape(key, false), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(content)
+	request.Header.Set("x-amz-content-sha256", hex.EncodeToString(hash[:]))
+	if s.config.SessionToken != "" {
+		request.Header.Set("x-amz-security-token", s.config.SessionToken)
+	}
+	signV4(request, s.config.AccessKey, s.config.SecretKey, s.config.Region, "s3", s.now())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("unable to put %s: %s %s", key, response.Status, body)
+	}
+	return nil
+}
+
+// signV4 signs the request, whose x-amz-content-sha256 header must be set,
+// with AWS Signature Version 4 covering every header it carries.
+func signV4(request *http.Request, accessKey string, secretKey string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("x-amz-date", amzDate)
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		trimmed := []string{}
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parameters := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parameters = append(parameters, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	path := request.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{request.Method, awsEscape(path, false), strings.Join(parameters, "&"), canonicalHeaders, signedHeaders, request.Header.Get("x-amz-content-sha256")}, "\n")
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSha256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSha256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and slashes
+// unless escaping a query component.
+func awsEscape(value string, escapeSlash bool) string {
+	escaped := &bytes.Buffer{}
+	for _, c := range []byte(value) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			escaped.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScriptConfig names a script given inline as Source or read from File. A
+// run exceeding Timeout fails. OnError keeps (default) or drops the point a
+// failed run was given.
+type ScriptConfig struct {
+	Name    string
+	Source  string
+	File    string
+	Timeout time.Duration
+	OnError string
+}
+
+func NewScriptConfig(entry map[string]interface{}) *ScriptConfig {
+	conf := &ScriptConfig{Timeout: 10 * time.Millisecond, OnError: "keep"}
+	if value, ok := entry["name"].(string); ok {
+		conf.Name = value
+	}
+	if value, ok := entry["source"].(string); ok {
+		conf.Source = value
+	}
+	if value, ok := entry["file"].(string); ok {
+		conf.File = value
+	}
+	if value, ok := entry["timeout"].(int); ok {
+		conf.Timeout = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := entry["onerror"].(string); ok {
+		conf.OnError = strings.ToLower(value)
+	}
+	return conf
+}
+
+// scriptPoint is the mutable point a script works on.
+type scriptPoint struct {
+	name    string
+	tags    map[string]string
+	fields  map[string]interface{}
+	time    time.Time
+	dropped bool
+}
+
+type scriptAssignment struct {
+	name  string
+	value scriptExpr
+}
+
+// scriptStatement is a single line of a script, one of
+//
+//	drop
+//	set measurement|time = <expression>
+//	set field|tag <name> = <expression>
+//	delete field|tag <name>
+//	emit <measurement expression> <field> = <expression>[, <field> = <expression>]
+//
+// optionally followed by `if <expression>`.
+type scriptStatement struct {
+	action    string
+	target    string
+	name      string
+	value     scriptExpr
+	fields    []scriptAssignment
+	condition scriptExpr
+}
+
+// Script runs a list of statements against every point. It may modify or drop
+// the point and emit new points carrying the tags and time of the point. A
+// script cannot loop or reach anything but the point and its Kafka record.
+type Script struct {
+	config     *ScriptConfig
+	statements []*scriptStatement
+}
+
+func NewScript(config *ScriptConfig) (*Script, error) {
+	source := config.Source
+	if config.File != "" {
+		content, err := ioutil.ReadFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		source = string(content)
+	}
+	script := &Script{config: config}
+	for number, line := range strings.Split(source, "\n") {
+		tokens, err := lexScript(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", config.Name, number+1, err.Error())
+		}
+		if len(tokens) == 1 {
+			continue
+		}
+		statement, err := parseStatement(&scriptParser{tokens: tokens})
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", config.Name, number+1, err.Error())
+		}
+		script.statements = append(script.statements, statement)
+	}
+	return script, nil
+}
+
+func parseStatement(p *scriptParser) (*scriptStatement, error) {
+	statement := &scriptStatement{action: p.next().text}
+	var err error
+	switch statement.action {
+	case "drop":
+	case "set", "delete":
+		statement.target = p.next().text
+		switch {
+		case statement.action == "set" && (statement.target == "measurement" || statement.target == "time"):
+		case statement.target == "field" || statement.target == "tag":
+			if statement.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("cannot %s %s", statement.action, statement.target)
+		}
+		if statement.action == "set" {
+			if err = p.expect("="); err != nil {
+				return nil, err
+			}
+			if statement.value, err = p.expression(1); err != nil {
+				return nil, err
+			}
+		}
+	case "emit":
+		if statement.value, err = p.expression(1); err != nil {
+			return nil, err
+		}
+		for len(statement.fields) == 0 || p.accept(",") {
+			assignment := scriptAssignment{}
+			if assignment.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err = p.expect("="); err != nil {
+				return nil, err
+			}
+			if assignment.value, err = p.expression(1); err != nil {
+				return nil, err
+			}
+			statement.fields = append(statement.fields, assignment)
+		}
+	default:
+		return nil, fmt.Errorf("unknown statement %s", statement.action)
+	}
+	if p.accept("if") {
+		if statement.condition, err = p.expression(1); err != nil {
+			return nil, err
+		}
+	}
+	if token := p.peek(); token.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+	return statement, nil
+}
+
+// Run applies the script to a point and returns the point, unless dropped,
+// followed by the points emitted.
+func (s *Script) Run(point *influx.Point, message *sarama.ConsumerMessage) ([]*influx.Point, error) {
+	fields, err := point.Fields()
+	if err != nil {
+		return nil, err
+	}
+	env := &scriptEnv{point: &scriptPoint{name: point.Name(), tags: point.Tags(), fields: fields, time: point.Time()}, deadline: time.Now().Add(s.config.Timeout)}
+	if message != nil {
+		env.message = scriptMessage{topic: message.Topic, partition: message.Partition, offset: message.Offset, key: string(message.Key), headers: make(map[string]string), present: true}
+		for _, header := range message.Headers {
+			if header != nil {
+				env.message.headers[string(header.Key)] = string(header.Value)
+			}
+		}
+	}
+	emitted := []*influx.Point{}
+	for _, statement := range s.statements {
+		// Statements are cheap to evaluate but not bounded in number.
+		if time.Now().After(env.deadline) {
+			return nil, errScriptTimeout
+		}
+		if statement.condition != nil {
+			condition, err := statement.condition.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(condition) {
+				continue
+			}
+		}
+		if statement.action == "drop" {
+			env.point.dropped = true
+			break
+		}
+		if statement.action == "emit" {
+			point, err := statement.emit(env)
+			if err != nil {
+				return nil, err
+			}
+			if point != nil {
+				emitted = append(emitted, point)
+			}
+			continue
+		}
+		if err := statement.apply(env); err != nil {
+			return nil, err
+		}
+	}
+	if env.point.dropped || len(env.point.fields) == 0 {
+		return emitted, nil
+	}
+	result, err := influx.NewPoint(env.point.name, env.point.tags, env.point.fields, env.point.time)
+	if err != nil {
+		return nil, err
+	}
+	return append([]*influx.Point{result}, emitted...), nil
+}
+
+// apply runs a set or delete statement. Setting nil leaves the point as is.
+func (statement *scriptStatement) apply(env *scriptEnv) error {
+	if statement.action == "delete" {
+		if statement.target == "field" {
+			delete(env.point.fields, statement.name)
+		} else {
+			delete(env.point.tags, statement.name)
+		}
+		return nil
+	}
+	value, err := statement.value.eval(env)
+	if err != nil || value == nil {
+		return err
+	}
+	switch statement.target {
+	case "measurement":
+		name, ok := value.(string)
+		if !ok || name == "" {
+			return fmt.Errorf("measurement must be a non empty string but got %v", value)
+		}
+		env.point.name = name
+	case "time":
+		nanoseconds, ok := toFloat(value)
+		if !ok {
+			return fmt.Errorf("time must be a number of nanoseconds but got %v", value)
+		}
+		if integer, ok := value.(int64); ok {
+			env.point.time = time.Unix(0, integer).UTC()
+		} else {
+			env.point.time = time.Unix(0, int64(nanoseconds)).UTC()
+		}
+	case "field":
+		env.point.fields[statement.name] = value
+	case "tag":
+		env.point.tags[statement.name] = fmt.Sprint(value)
+	}
+	return nil
+}
+
+func (statement *scriptStatement) emit(env *scriptEnv) (*influx.Point, error) {
+	measurement, err := statement.value.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := measurement.(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("emitted measurement must be a non empty string but got %v", measurement)
+	}
+	fields := make(map[string]interface{})
+	for _, assignment := range statement.fields {
+		value, err := assignment.value.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			fields[assignment.name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for key, value := range env.point.tags {
+		tags[key] = value
+	}
+	return influx.NewPoint(name, tags, fields, env.point.time)
+}
+
+func (s *Script) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	processed := []*influx.Point{}
+	for _, point := range points {
+		result, err := s.Run(point, message)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"script": s.config.Name, "measurement": point.Name()}).Debug("Script failed")
+			if err == errScriptTimeout {
+				MetricsScriptTimeout.Add(s.config.Name, 1)
+			} else {
+				MetricsScriptError.Add(s.config.Name, 1)
+			}
+			if s.config.OnError != "drop" {
+				processed = append(processed, point)
+			}
+			continue
+		}
+		processed = append(processed, result...)
+	}
+	return processed
+}
+
+// scriptHeaders collects the headers given to test-script as name=value.
+type scriptHeaders []*sarama.RecordHeader
+
+func (h *scriptHeaders) String() string {
+	pairs := []string{}
+	for _, header := range *h {
+		pairs = append(pairs, string(header.Key)+"="+string(header.Value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h *scriptHeaders) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return fmt.Errorf("header %s is not name=value", value)
+	}
+	*h = append(*h, &sarama.RecordHeader{Key: []byte(pair[0]), Value: []byte(pair[1])})
+	return nil
+}
+
+// testScript runs a script against sample messages, one per line of the
+// given file or of stdin, and prints the resulting points.
+func testScript(args []string, input io.Reader, output io.Writer) error {
+	flags := flag.NewFlagSet("test-script", flag.ContinueOnError)
+	flags.SetOutput(output)
+	file := flags.String("script", "", "path of the script to run")
+	format := flags.String("format", "line", "input format of the sample messages")
+	topic := flags.String("topic", "test", "topic the sample messages are read from")
+	timeout := flags.Duration("timeout", time.Second, "timeout of a single run")
+	key := flags.String("key", "", "key of the sample messages")
+	headers := &scriptHeaders{}
+	flags.Var(headers, "header", "header of the sample messages as name=value, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-script is required")
+	}
+	script, err := NewScript(&ScriptConfig{Name: *file, File: *file, Timeout: *timeout})
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		messages, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer messages.Close()
+		input = messages
+	}
+	conf := &Config{
+		Kandi:  &KandiConfig{Otlp: NewOtlpConfig(nil), Json: NewJsonConfig(nil), Graphite: NewGraphiteConfig(nil)},
+		Kafka:  &KafkaConfig{Format: strings.ToLower(*format)},
+		Influx: &InfluxConfig{},
+	}
+	parser, err := NewParser((&TopicConfig{Name: *topic}).resolve(conf))
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(input)
+	for offset := int64(0); scanner.Scan(); offset++ {
+		message := &sarama.ConsumerMessage{Topic: *topic, Offset: offset, Key: []byte(*key), Headers: *headers, Value: []byte(scanner.Text()), Timestamp: time.Now()}
+		points, err := parser.Parse(message, time.Now().UTC())
+		if err != nil {
+			fmt.Fprintf(output, "message %d: parse error: %s\n", offset, err.Error())
+			continue
+		}
+		for _, point := range points {
+			result, err := script.Run(point, message)
+			if err != nil {
+				fmt.Fprintf(output, "message %d: script error: %s\n", offset, err.Error())
+				continue
+			}
+			for _, processed := range result {
+				fmt.Fprintln(output, processed.String())
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ScriptTestCases = []struct {
+	label    string
+	source   string
+	expected []string
+}{
+	{
+		"Should Derive Field From Two Others",
+		"set field ratio = field.errors / field.requests if field.requests > 0",
+		[]string{"http,host=web01,region=us errors=5i,ratio=0.05,requests=100i 1501096898000000000"},
+	},
+	{
+		"Should Split Measurement By Tag",
+		`set measurement = measurement + "_" + tag.region`,
+		[]string{"http_us,host=web01,region=us errors=5i,requests=100i 1501096898000000000"},
+	},
+	{
+		"Should Set And Delete Tags And Fields",
+		"set tag topic = kafka.topic\nset tag partition = kafka.partition\ndelete tag host\ndelete field errors",
+		[]string{"http,partition=3,region=us,topic=metrics requests=100i 1501096898000000000"},
+	},
+	{
+		"Should Drop Point When Condition Holds",
+		`drop if header["x-env"] == "test" && field.errors >= 5`,
+		[]string{},
+	},
+	{
+		"Should Keep Point When Condition Fails",
+		`drop if tag.region != "us" || !has(field.errors)`,
+		[]string{"http,host=web01,region=us errors=5i,requests=100i 1501096898000000000"},
+	},
+	{
+		"Should Emit Additional Points",
+		`emit "http_errors" count = field.errors, rate = float(field.errors) * 2 # comment`,
+		[]string{
+			"http,host=web01,region=us errors=5i,requests=100i 1501096898000000000",
+			"http_errors,host=web01,region=us count=5i,rate=10 1501096898000000000",
+		},
+	},
+	{
+		"Should Compute Units",
+		"set field requests_k = round(field.requests / 1000 * 10) / 10\nset time = time - 1000000000",
+		[]string{"http,host=web01,region=us errors=5i,requests=100i,requests_k=0.1 1501096897000000000"},
+	},
+	{
+		"Should Ignore Missing Values",
+		"set field copy = field.missing\nset tag missing = tag.missing",
+		[]string{"http,host=web01,region=us errors=5i,requests=100i 1501096898000000000"},
+	},
+}
+
+func scriptTestPoint() *influx.Point {
+	point, _ := influx.NewPoint("http", map[string]string{"host": "web01", "region": "us"}, map[string]interface{}{"requests": int64(100), "errors": int64(5)}, time.Unix(1501096898, 0))
+	return point
+}
+
+var scriptTestMessage = &sarama.ConsumerMessage{Topic: "metrics", Partition: 3, Headers: []*sarama.RecordHeader{{Key: []byte("x-env"), Value: []byte("test")}}}
+
+func Test_Script(t *testing.T) {
+	for _, testCase := range ScriptTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewScript(&ScriptConfig{Name: "test", Source: testCase.source, Timeout: time.Second})
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected compile error %s", testCase.label, err.Error()))
+				return
+			}
+			points, err := sut.Run(scriptTestPoint(), scriptTestMessage)
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected run error %s", testCase.label, err.Error()))
+				return
+			}
+			actual := pointStrings(points)
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Script_Rejects_Invalid_Source(t *testing.T) {
+	for _, source := range []string{"set field = 1", "explode", "drop if (1", "set tag x = unknown(1)", `set tag x = "open`, "set field x = kafka.value", "emit \"m\""} {
+		if _, err := NewScript(&ScriptConfig{Name: "invalid", Source: source}); err == nil {
+			t.Error(fmt.Sprintf("Expected %q to be rejected", source))
+		}
+	}
+}
+
+func Test_Script_Errors_Keep_Or_Drop_Point(t *testing.T) {
+	keep, _ := NewScript(&ScriptConfig{Name: "keep-on-error", Source: `set field x = tag.host + 1`, Timeout: time.Second, OnError: "keep"})
+	if actual := keep.Apply([]*influx.Point{scriptTestPoint()}, scriptTestMessage); len(actual) != 1 {
+		t.Error(fmt.Sprintf("Expected point to be kept on error but found %d points", len(actual)))
+	}
+	drop, _ := NewScript(&ScriptConfig{Name: "drop-on-error", Source: `set field x = field.errors / 0`, Timeout: time.Second, OnError: "drop"})
+	if actual := drop.Apply([]*influx.Point{scriptTestPoint()}, scriptTestMessage); len(actual) != 0 {
+		t.Error(fmt.Sprintf("Expected point to be dropped on error but found %d points", len(actual)))
+	}
+	if MetricsScriptError.Get("keep-on-error").String() != "1" || MetricsScriptError.Get("drop-on-error").String() != "1" {
+		t.Error("Expected script errors to be counted per script")
+	}
+}
+
+func Test_Script_Times_Out(t *testing.T) {
+	source := strings.Repeat("set field x = 1 + 1 + 1 + 1 + 1 + 1 + 1 + 1\n", 100)
+	sut, _ := NewScript(&ScriptConfig{Name: "slow", Source: source, Timeout: -time.Second})
+	if actual := sut.Apply([]*influx.Point{scriptTestPoint()}, scriptTestMessage); len(actual) != 1 {
+		t.Error("Expected point to be kept when the script times out")
+	}
+	if MetricsScriptTimeout.Get("slow").String() != "1" {
+		t.Error("Expected script timeout to be counted")
+	}
+}
+
+func Test_Script_Caps_String_Growth(t *testing.T) {
+	source := strings.Repeat("set tag host = tag.host + tag.host\n", 64)
+	sut, _ := NewScript(&ScriptConfig{Name: "doubling", Source: source, Timeout: time.Second})
+	started := time.Now()
+
+	_, err := sut.Run(scriptTestPoint(), scriptTestMessage)
+
+	if err == nil || err.Error() != "string longer than 65536 bytes" {
+		t.Error(fmt.Sprintf("Expected the script to fail on a string too long but found %v", err))
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the script to fail quickly but it took %s", elapsed))
+	}
+}
+
+func Test_Test_Script_Command(t *testing.T) {
+	file, _ := ioutil.TempFile("", "kandi-script")
+	defer os.Remove(file.Name())
+	file.WriteString("set tag topic = kafka.topic\nset tag key = kafka.key\nset tag env = header[\"x-env\"]\ndrop if field.value > 10\n")
+	file.Close()
+
+	output := &bytes.Buffer{}
+	input := strings.NewReader("cpu value=1 1501096898000000000\ncpu value=11 1501096898000000000\nnot line protocol")
+	err := testScript([]string{"-script", file.Name(), "-topic", "metrics", "-key", "web01", "-header", "x-env=test"}, input, output)
+
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || lines[0] != "cpu,env=test,key=web01,topic=metrics value=1 1501096898000000000" || !strings.HasPrefix(lines[1], "message 2: parse error") {
+		t.Error(fmt.Sprintf("Unexpected output %q", output.String()))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is where batches of points are written. Batches keep the database and
+// retention policy of their destination, which sinks other than Influx
+// ignore.
+type Sink interface {
+	Write(batch influx.BatchPoints) error
+	Close() error
+	// Health returns an error when the sink cannot be written to.
+	Health() error
+}
+
+// SinkConfig selects the sink by Type, one of influx (default), prometheus,
+// graphite or opentsdb, along with the settings of the other sinks. Points are
+// republished to Kafka as well when Republish names a topic.
+type SinkConfig struct {
+	Type       string
+	Prometheus *PrometheusConfig
+	Graphite   *CarbonConfig
+	OpenTsdb   *OpenTsdbConfig
+	Republish  *RepublishConfig
+}
+
+func NewSinkConfig(entry map[string]interface{}) *SinkConfig {
+	conf := &SinkConfig{Type: "influx"}
+	if value, ok := entry["type"].(string); ok {
+		conf.Type = strings.ToLower(value)
+	}
+	conf.Prometheus = NewPrometheusConfig(lowerKeys(entry["prometheus"]))
+	conf.Graphite = NewCarbonConfig(lowerKeys(entry["graphite"]))
+	conf.OpenTsdb = NewOpenTsdbConfig(lowerKeys(entry["opentsdb"]))
+	conf.Republish = NewRepublishConfig(lowerKeys(entry["republish"]))
+	return conf
+}
+
+func NewSink(conf *Config, influxSink *Influx) (Sink, error) {
+	if conf.Sink == nil {
+		return influxSink, nil
+	}
+	sink, err := newPrimarySink(conf.Sink, influxSink)
+	if err != nil || conf.Sink.Republish == nil || conf.Sink.Republish.Topic == "" {
+		return sink, err
+	}
+	republish, err := NewKafkaSink(conf.Sink.Republish, conf.Kafka)
+	if err != nil {
+		return nil, err
+	}
+	return teeSink{sink, republish}, nil
+}
+
+func newPrimarySink(conf *SinkConfig, influxSink *Influx) (Sink, error) {
+	switch conf.Type {
+	case "", "influx":
+		return influxSink, nil
+	case "prometheus":
+		return NewPrometheusSink(conf.Prometheus)
+	case "graphite":
+		return NewCarbonSink(conf.Graphite)
+	case "opentsdb":
+		return NewOpenTsdbSink(conf.OpenTsdb)
+	}
+	return nil, fmt.Errorf("unknown sink %s", conf.Type)
+}
+
+// sinkMetric is a single numeric value of a point, named after its measurement
+// and field. Fields named value are named after the measurement alone.
+type sinkMetric struct {
+	name  string
+	field string
+	tags  map[string]string
+	value float64
+	time  time.Time
+}
+
+// sinkMetrics splits the points into their numeric values. String fields have
+// no numeric counterpart and are left out.
+func sinkMetrics(points []*influx.Point) []sinkMetric {
+	metrics := []sinkMetric{}
+	for _, point := range points {
+		fields, err := point.Fields()
+		if err != nil {
+			continue
+		}
+		names := []string{}
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := toFloat(fields[name])
+			if !ok {
+				MetricsSinkSkippedFields.Add(1)
+				continue
+			}
+			metrics = append(metrics, sinkMetric{point.Name(), name, point.Tags(), value, point.Time()})
+		}
+	}
+	return metrics
+}
+
+func (m *sinkMetric) fullName(separator string) string {
+	if m.field == "value" {
+		return m.name
+	}
+	return m.name + separator + m.field
+}
+
+func (m *sinkMetric) sortedTagKeys() []string {
+	keys := []string{}
+	for key := range m.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sanitize replaces the characters not allowed by a sink with underscores.
+func sanitize(value string, allowed func(c rune) bool) string {
+	return strings.Map(func(c rune) rune {
+		if allowed(c) {
+			return c
+		}
+		return '_'
+	}, value)
+}
+
+// writeStatus remembers the outcome of the last write, for sinks that cannot
+// be checked otherwise.
+type writeStatus struct {
+	lock sync.Mutex
+	err  error
+}
+
+func (s *writeStatus) record(err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+	return err
+}
+
+func (s *writeStatus) Health() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// sinkHealth serves the health of the sink of the running kandi on /health.
+var sinkHealth = &healthHandler{}
+
+type healthHandler struct {
+	lock sync.RWMutex
+	sink Sink
+}
+
+func init() {
+	http.Handle("/health", sinkHealth)
+}
+
+func (h *healthHandler) set(sink Sink) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sink = sink
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	sink := h.sink
+	h.lock.RUnlock()
+	if sink != nil {
+		if err := sink.Health(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/snappy"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sinkBatch() influx.BatchPoints {
+	batch, _ := influx.NewBatchPoints(influx.BatchPointsConfig{Database: "testdb"})
+	at := time.Unix(1527847200, 500000000)
+	cpu, _ := influx.NewPoint("cpu", map[string]string{"host": "web 1", "region": "us-west"}, map[string]interface{}{"usage_idle": 91.5, "value": int64(3), "state": "ok"}, at)
+	up, _ := influx.NewPoint("up", map[string]string{}, map[string]interface{}{"value": true}, at)
+	batch.AddPoints([]*influx.Point{cpu, up})
+	return batch
+}
+
+// decodeWriteRequest returns the series of a remote write request as
+// name{label="value",...} value timestamp.
+func decodeWriteRequest(body []byte) ([]string, error) {
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	series := []string{}
+	request := newProtoReader(decoded)
+	for request.more() {
+		if _, _, err = request.next(); err != nil {
+			return nil, err
+		}
+		timeseries, err := request.message()
+		if err != nil {
+			return nil, err
+		}
+		labels := []string{}
+		var sample string
+		for timeseries.more() {
+			field, _, _ := timeseries.next()
+			message, err := timeseries.message()
+			if err != nil {
+				return nil, err
+			}
+			if field == 1 {
+				message.next()
+				name, _ := message.bytes()
+				message.next()
+				value, _ := message.bytes()
+				labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+			} else {
+				message.next()
+				value, _ := message.double()
+				message.next()
+				timestamp, _ := message.varint()
+				sample = fmt.Sprintf("%v %d", value, timestamp)
+			}
+		}
+		series = append(series, "{"+strings.Join(labels, ",")+"} "+sample)
+	}
+	return series, nil
+}
+
+func Test_Prometheus_Sink_Writes_Remote_Write_Requests(t *testing.T) {
+	var actual []string
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		headers = r.Header
+		actual, _ = decodeWriteRequest(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	sut, _ := NewPrometheusSink(&PrometheusConfig{Url: server.URL, Timeout: time.Second})
+
+	err := sut.Write(sinkBatch())
+
+	expected := []string{
+		`{__name__="cpu_usage_idle",host="web 1",region="us-west"} 91.5 1527847200500`,
+		`{__name__="cpu",host="web 1",region="us-west"} 3 1527847200500`,
+		`{__name__="up"} 1 1527847200500`,
+	}
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	} else if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected series.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+	if headers.Get("Content-Encoding") != "snappy" || headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Error(fmt.Sprintf("Unexpected headers %v", headers))
+	}
+	if sut.Health() != nil {
+		t.Error("Expected prometheus sink to be healthy")
+	}
+}
+
+var PrometheusStatusTestCases = []struct {
+	label   string
+	status  int
+	err     bool
+	healthy bool
+}{
+	{"rejected batches are dropped", http.StatusBadRequest, false, true},
+	{"failed batches are retried", http.StatusServiceUnavailable, true, false},
+	{"throttled batches are retried", http.StatusTooManyRequests, true, false},
+	{"timed out batches are retried", http.StatusRequestTimeout, true, false},
+}
+
+func Test_Prometheus_Sink_Failures(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	for _, testCase := range PrometheusStatusTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(testCase.status)
+			}))
+			defer server.Close()
+			sut, _ := NewPrometheusSink(&PrometheusConfig{Url: server.URL, Timeout: time.Second})
+
+			err := sut.Write(sinkBatch())
+
+			if (err != nil) != testCase.err || (sut.Health() == nil) != testCase.healthy {
+				t.Error(fmt.Sprintf("Unexpected outcome %v, healthy: %v", err, sut.Health() == nil))
+			}
+		})
+	}
+}
+
+func Test_Prometheus_Names(t *testing.T) {
+	for input, expected := range map[string]string{"cpu.usage-idle": "cpu_usage_idle", "1m_load": "_1m_load", "rate:5m": "rate:5m"} {
+		if actual := prometheusName(input, true); actual != expected {
+			t.Error(fmt.Sprintf("Expected %s to be named %s but got %s", input, expected, actual))
+		}
+	}
+	if actual := prometheusName("rate:5m", false); actual != "rate_5m" {
+		t.Error(fmt.Sprintf("Expected label name rate_5m but got %s", actual))
+	}
+}
+
+var CarbonSinkTestCases = []struct {
+	label    string
+	config   *CarbonConfig
+	expected []string
+}{
+	{
+		"tagged",
+		&CarbonConfig{Format: "tagged", Timeout: time.Second},
+		[]string{"cpu.usage_idle;host=web_1;region=us-west 91.5 1527847200", "cpu;host=web_1;region=us-west 3 1527847200", "up 1 1527847200"},
+	},
+	{
+		"path",
+		&CarbonConfig{Prefix: "kandi", Format: "path", Timeout: time.Second},
+		[]string{"kandi.web_1.us-west.cpu.usage_idle 91.5 1527847200", "kandi.web_1.us-west.cpu 3 1527847200", "kandi.up 1 1527847200"},
+	},
+}
+
+func Test_Carbon_Sink(t *testing.T) {
+	for _, testCase := range CarbonSinkTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			received := make(chan []string)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				lines := []string{}
+				scanner := bufio.NewScanner(conn)
+				for len(lines) < len(testCase.expected) && scanner.Scan() {
+					lines = append(lines, scanner.Text())
+				}
+				received <- lines
+			}()
+			testCase.config.Address = listener.Addr().String()
+			sut, _ := NewCarbonSink(testCase.config)
+			defer sut.Close()
+
+			if err = sut.Write(sinkBatch()); err != nil {
+				t.Fatal(err)
+			}
+
+			if actual := <-received; fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("Unexpected lines.\n\texpected: %v\n\tactual: %v", testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Carbon_Sink_Health(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+	sut, _ := NewCarbonSink(&CarbonConfig{Address: address, Format: "tagged", Timeout: 100 * time.Millisecond})
+
+	if sut.Health() == nil {
+		t.Error("Expected graphite sink without listener to be unhealthy")
+	}
+	if sut.Write(sinkBatch()) == nil {
+		t.Error("Expected write without listener to fail")
+	}
+}
+
+func Test_OpenTsdb_Sink(t *testing.T) {
+	var actual []openTsdbPoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/version" {
+			w.Write([]byte(`{"version":"2.3.0"}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &actual)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	sut, _ := NewOpenTsdbSink(&OpenTsdbConfig{Url: server.URL + "/", Timeout: time.Second})
+
+	err := sut.Write(sinkBatch())
+
+	expected := []openTsdbPoint{
+		{"cpu.usage_idle", 1527847200500, 91.5, map[string]string{"host": "web_1", "region": "us-west"}},
+		{"cpu", 1527847200500, 3, map[string]string{"host": "web_1", "region": "us-west"}},
+		{"up", 1527847200500, 1, map[string]string{"measurement": "up"}},
+	}
+	if err != nil {
+		t.Error(fmt.Sprintf("Unexpected error %s", err.Error()))
+	} else if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unexpected data points.\n\texpected: %v\n\tactual: %v", expected, actual))
+	}
+	if err = sut.Health(); err != nil {
+		t.Error(fmt.Sprintf("Expected opentsdb sink to be healthy but got %s", err.Error()))
+	}
+}
+
+func Test_OpenTsdb_Sink_Failures(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"success":2,"failed":1}`))
+	}))
+	defer server.Close()
+	sut, _ := NewOpenTsdbSink(&OpenTsdbConfig{Url: server.URL, Timeout: time.Second})
+
+	if err := sut.Write(sinkBatch()); err != nil {
+		t.Error(fmt.Sprintf("Expected rejected data points to be dropped but got %s", err.Error()))
+	}
+	status = http.StatusInternalServerError
+	if sut.Write(sinkBatch()) == nil {
+		t.Error("Expected failed put to be retried")
+	}
+	if sut.Health() == nil {
+		t.Error("Expected opentsdb sink to be unhealthy")
+	}
+}
+
+var SinkSelectionTestCases = []struct {
+	label    string
+	config   *SinkConfig
+	expected string
+}{
+	{"default", nil, "*main.Influx"},
+	{"influx", NewSinkConfig(map[string]interface{}{"type": "Influx"}), "*main.Influx"},
+	{"prometheus", NewSinkConfig(map[string]interface{}{"type": "prometheus", "prometheus": map[string]interface{}{"url": "http://localhost:9090/api/v1/write"}}), "*main.PrometheusSink"},
+	{"graphite", NewSinkConfig(map[string]interface{}{"type": "graphite", "graphite": map[string]interface{}{"address": "localhost:2003"}}), "*main.CarbonSink"},
+	{"opentsdb", NewSinkConfig(map[string]interface{}{"type": "opentsdb", "opentsdb": map[string]interface{}{"url": "http://localhost:4242"}}), "*main.OpenTsdbSink"},
+	{"unknown", NewSinkConfig(map[string]interface{}{"type": "statsd"}), ""},
+	{"missing url", NewSinkConfig(map[string]interface{}{"type": "prometheus"}), ""},
+}
+
+func Test_Sink_Selection(t *testing.T) {
+	for _, testCase := range SinkSelectionTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := NewSink(&Config{Sink: testCase.config}, &Influx{})
+
+			if testCase.expected == "" {
+				if err == nil {
+					t.Error(fmt.Sprintf("Expected an error but got %T", actual))
+				}
+			} else if err != nil || fmt.Sprintf("%T", actual) != testCase.expected {
+				t.Error(fmt.Sprintf("Expected %s but got %T %v", testCase.expected, actual, err))
+			}
+		})
+	}
+}
+
+func Test_Health_Handler(t *testing.T) {
+	sut := &healthHandler{}
+	sut.set(&OpenTsdbSink{config: &OpenTsdbConfig{Url: "http://127.0.0.1:1"}, client: &http.Client{Timeout: 100 * time.Millisecond}})
+	recorder := httptest.NewRecorder()
+
+	sut.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Error(fmt.Sprintf("Expected status 503 but got %d", recorder.Code))
+	}
+}
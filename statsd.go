@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsdConfig sets the window samples are aggregated over. A gauge not
+// updated for GaugeExpiry windows in a row is no longer written, unless 0.
+type StatsdConfig struct {
+	FlushInterval time.Duration
+	Percentiles   []float64
+	GaugeExpiry   int
+}
+
+type StatsdSample struct {
+	Name       string
+	Tags       map[string]string
+	Type       string
+	Value      float64
+	SetMember  string
+	SampleRate float64
+	Relative   bool
+}
+
+type statsdTimer struct {
+	name   string
+	tags   map[string]string
+	values []float64
+}
+
+type statsdValue struct {
+	name  string
+	tags  map[string]string
+	value float64
+	idle  int
+}
+
+type statsdSet struct {
+	name    string
+	tags    map[string]string
+	members map[string]bool
+}
+
+// Statsd accumulates StatsD samples over a flush interval. Messages handed to
+// Add are returned from Flush together with the points of the window that
+// contains them so their offsets are only marked once the window is written.
+type Statsd struct {
+	config      *StatsdConfig
+	lock        sync.Mutex
+	windowStart time.Time
+	counters    map[string]*statsdValue
+	gauges      map[string]*statsdValue
+	timers      map[string]*statsdTimer
+	sets        map[string]*statsdSet
+	messages    []*sarama.ConsumerMessage
+}
+
+func NewStatsd(config *StatsdConfig) *Statsd {
+	s := &Statsd{config: config, gauges: make(map[string]*statsdValue)}
+	s.reset(time.Now())
+	return s
+}
+
+// reset starts a new window. Gauges keep their value across windows, as relative
+// gauges adjust the last value, and are written with every window until they
+// expire.
+func (s *Statsd) reset(now time.Time) {
+	s.windowStart = now
+	s.counters = make(map[string]*statsdValue)
+	s.timers = make(map[string]*statsdTimer)
+	s.sets = make(map[string]*statsdSet)
+	s.messages = []*sarama.ConsumerMessage{}
+}
+
+// Add parses every line of the message into the current window. It returns
+// false when nothing in the message could be parsed, in which case the message
+// is not held by the window.
+func (s *Statsd) Add(message *sarama.ConsumerMessage) bool {
+	if message == nil || len(message.Value) == 0 {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	added := false
+	for _, line := range strings.Split(string(message.Value), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sample, err := ParseStatsdLine(line)
+		if err != nil {
+			log.WithError(err).WithField("line", line).Debug("Failed to parse statsd line")
+			MetricsStatsdParseFailure.Add(1)
+			continue
+		}
+		s.add(sample)
+		added = true
+	}
+	if added {
+		s.messages = append(s.messages, message)
+	}
+	return added
+}
+
+func (s *Statsd) add(sample *StatsdSample) {
+	MetricsStatsdSamples.Add(1)
+	key := SeriesKey(sample.Name, sample.Tags)
+	switch sample.Type {
+	case "c":
+		counter, ok := s.counters[key]
+		if !ok {
+			counter = &statsdValue{name: sample.Name, tags: sample.Tags}
+			s.counters[key] = counter
+		}
+		counter.value += sample.Value / sample.SampleRate
+	case "g":
+		gauge, ok := s.gauges[key]
+		if !ok {
+			gauge = &statsdValue{name: sample.Name, tags: sample.Tags}
+			s.gauges[key] = gauge
+		}
+		gauge.idle = 0
+		if sample.Relative {
+			gauge.value += sample.Value
+		} else {
+			gauge.value = sample.Value
+		}
+	case "ms", "h":
+		timer, ok := s.timers[key]
+		if !ok {
+			timer = &statsdTimer{name: sample.Name, tags: sample.Tags}
+			s.timers[key] = timer
+		}
+		timer.values = append(timer.values, sample.Value)
+	case "s":
+		set, ok := s.sets[key]
+		if !ok {
+			set = &statsdSet{name: sample.Name, tags: sample.Tags, members: make(map[string]bool)}
+			s.sets[key] = set
+		}
+		set.members[sample.SetMember] = true
+	}
+}
+
+// Flush closes the current window once its interval has elapsed, or
+// immediately when forced, returning the aggregated points and the messages
+// they were built from.
+func (s *Statsd) Flush(now time.Time, force bool) ([]*influx.Point, []*sarama.ConsumerMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !force && now.Before(s.windowStart.Add(s.config.FlushInterval)) {
+		return nil, nil
+	}
+
+	points := []*influx.Point{}
+	for _, counter := range s.counters {
+		points = appendStatsdPoint(points, counter.name, counter.tags, "counter", map[string]interface{}{"value": counter.value}, now)
+	}
+	for key, gauge := range s.gauges {
+		if s.config.GaugeExpiry > 0 && gauge.idle >= s.config.GaugeExpiry {
+			delete(s.gauges, key)
+			continue
+		}
+		points = appendStatsdPoint(points, gauge.name, gauge.tags, "gauge", map[string]interface{}{"value": gauge.value}, now)
+		gauge.idle++
+	}
+	for _, timer := range s.timers {
+		points = appendStatsdPoint(points, timer.name, timer.tags, "timing", s.timerFields(timer.values), now)
+	}
+	for _, set := range s.sets {
+		points = appendStatsdPoint(points, set.name, set.tags, "set", map[string]interface{}{"value": int64(len(set.members))}, now)
+	}
+	messages := s.messages
+	s.reset(now)
+
+	MetricsStatsdPointsFlushed.Add(int64(len(points)))
+	log.WithFields(log.Fields{"points": len(points), "messages": len(messages)}).Debug("Flushed statsd window")
+	return points, messages
+}
+
+func (s *Statsd) timerFields(values []float64) map[string]interface{} {
+	sort.Float64s(values)
+	count := float64(len(values))
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / count
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+
+	fields := map[string]interface{}{
+		"count":  int64(len(values)),
+		"sum":    sum,
+		"mean":   mean,
+		"lower":  values[0],
+		"upper":  values[len(values)-1],
+		"stddev": math.Sqrt(variance / count),
+	}
+	for _, percentile := range s.config.Percentiles {
+		rank := int(math.Ceil(percentile/100*count)) - 1
+		if rank < 0 {
+			rank = 0
+		} else if rank >= len(values) {
+			rank = len(values) - 1
+		}
+		fields[percentileField(percentile)] = values[rank]
+	}
+	return fields
+}
+
+func percentileField(percentile float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+func appendStatsdPoint(points []*influx.Point, name string, tags map[string]string, metricType string, fields map[string]interface{}, now time.Time) []*influx.Point {
+	pointTags := map[string]string{"metric_type": metricType}
+	for key, value := range tags {
+		pointTags[key] = value
+	}
+	point, err := influx.NewPoint(name, pointTags, fields, now)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Debug("Failed to create statsd point")
+		MetricsStatsdParseFailure.Add(1)
+		return points
+	}
+	return append(points, point)
+}
+
+// ParseStatsdLine parses a single line of the form
+// name[,tag=value]:value|type[|@rate][|#tag:value,...]
+func ParseStatsdLine(line string) (*StatsdSample, error) {
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return nil, errors.New("statsd line is missing a metric type")
+	}
+	separator := strings.LastIndex(line[:pipe], ":")
+	if separator <= 0 {
+		return nil, errors.New("statsd line is missing a value")
+	}
+
+	sample := &StatsdSample{Tags: make(map[string]string), SampleRate: 1}
+	bucket := line[:separator]
+	sections := strings.Split(line[separator+1:], "|")
+	rawValue := sections[0]
+	sample.Type = sections[1]
+
+	if comma := strings.Index(bucket, ","); comma >= 0 {
+		for _, tag := range strings.Split(bucket[comma+1:], ",") {
+			pair := strings.SplitN(tag, "=", 2)
+			if len(pair) != 2 || pair[0] == "" {
+				return nil, fmt.Errorf("invalid statsd tag %q", tag)
+			}
+			sample.Tags[pair[0]] = pair[1]
+		}
+		bucket = bucket[:comma]
+	}
+	sample.Name = bucket
+
+	for _, section := range sections[2:] {
+		if strings.HasPrefix(section, "@") {
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid statsd sample rate %q", section)
+			}
+			sample.SampleRate = rate
+		} else if strings.HasPrefix(section, "#") {
+			for _, tag := range strings.Split(section[1:], ",") {
+				pair := strings.SplitN(tag, ":", 2)
+				if pair[0] == "" {
+					continue
+				}
+				if len(pair) == 2 {
+					sample.Tags[pair[0]] = pair[1]
+				} else {
+					sample.Tags[pair[0]] = "true"
+				}
+			}
+		}
+	}
+
+	switch sample.Type {
+	case "s":
+		sample.SetMember = rawValue
+		return sample, nil
+	case "c", "g", "ms", "h":
+	default:
+		return nil, fmt.Errorf("unsupported statsd metric type %q", sample.Type)
+	}
+
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd value %q", rawValue)
+	}
+	sample.Value = value
+	if sample.Type == "g" && (strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-")) {
+		sample.Relative = true
+	}
+	return sample, nil
+}
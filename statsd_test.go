@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+var StatsdParseTestCases = []struct {
+	label         string
+	line          string
+	expected      StatsdSample
+	expectedError bool
+}{
+	{
+		"Should Parse Counter",
+		"requests:1|c",
+		StatsdSample{Name: "requests", Tags: map[string]string{}, Type: "c", Value: 1, SampleRate: 1},
+		false,
+	},
+	{
+		"Should Parse Sample Rate And DogStatsD Tags",
+		"requests:2|c|@0.5|#env:prod,region:us",
+		StatsdSample{Name: "requests", Tags: map[string]string{"env": "prod", "region": "us"}, Type: "c", Value: 2, SampleRate: 0.5},
+		false,
+	},
+	{
+		"Should Parse Influx Style Tags In Bucket",
+		"latency,host=a:12.5|ms",
+		StatsdSample{Name: "latency", Tags: map[string]string{"host": "a"}, Type: "ms", Value: 12.5, SampleRate: 1},
+		false,
+	},
+	{
+		"Should Parse Relative Gauge",
+		"queue:-3|g",
+		StatsdSample{Name: "queue", Tags: map[string]string{}, Type: "g", Value: -3, SampleRate: 1, Relative: true},
+		false,
+	},
+	{
+		"Should Parse Set Member",
+		"users:alice|s",
+		StatsdSample{Name: "users", Tags: map[string]string{}, Type: "s", SetMember: "alice", SampleRate: 1},
+		false,
+	},
+	{
+		"Should Reject Missing Type",
+		"requests:1",
+		StatsdSample{},
+		true,
+	},
+	{
+		"Should Reject Unknown Type",
+		"requests:1|x",
+		StatsdSample{},
+		true,
+	},
+	{
+		"Should Reject Invalid Value",
+		"requests:abc|c",
+		StatsdSample{},
+		true,
+	},
+}
+
+func Test_Statsd_Parse_Line(t *testing.T) {
+	for _, testCase := range StatsdParseTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual, err := ParseStatsdLine(testCase.line)
+			if testCase.expectedError {
+				if err == nil {
+					t.Error(fmt.Sprintf("%s: expected error parsing %s", testCase.label, testCase.line))
+				}
+				return
+			}
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			if fmt.Sprint(*actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: parsed sample did not match.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, *actual))
+			}
+		})
+	}
+}
+
+func statsdFields(points []*influx.Point, name string, metricType string) map[string]interface{} {
+	for _, point := range points {
+		if point.Name() == name && point.Tags()["metric_type"] == metricType {
+			fields, _ := point.Fields()
+			return fields
+		}
+	}
+	return nil
+}
+
+func Test_Statsd_Aggregates_Window(t *testing.T) {
+	sut := NewStatsd(&StatsdConfig{FlushInterval: time.Minute, Percentiles: []float64{50, 90}})
+	messages := []*sarama.ConsumerMessage{
+		{Value: []byte("requests:1|c\nrequests:1|c|@0.5\nqueue:10|g\nqueue:+5|g"), Offset: 0},
+		{Value: []byte("latency:10|ms\nlatency:20|ms\nlatency:30|ms\nusers:a|s\nusers:b|s\nusers:a|s"), Offset: 1},
+		{Value: []byte("not statsd"), Offset: 2},
+	}
+	held := []bool{}
+	for _, message := range messages {
+		held = append(held, sut.Add(message))
+	}
+	if !held[0] || !held[1] || held[2] {
+		t.Error(fmt.Sprintf("Only parsable messages should be held by the window, held: %v", held))
+	}
+
+	points, released := sut.Flush(time.Now(), false)
+	if points != nil || released != nil {
+		t.Error("Window should not flush before its interval has elapsed")
+	}
+
+	points, released = sut.Flush(time.Now(), true)
+	if len(released) != 2 {
+		t.Error(fmt.Sprintf("Expected 2 messages released with the window but found %d", len(released)))
+	}
+	if fields := statsdFields(points, "requests", "counter"); fields == nil || fields["value"] != 3.0 {
+		t.Error(fmt.Sprintf("Expected counter to be 3 but found %v", fields))
+	}
+	if fields := statsdFields(points, "queue", "gauge"); fields == nil || fields["value"] != 15.0 {
+		t.Error(fmt.Sprintf("Expected gauge to be 15 but found %v", fields))
+	}
+	if fields := statsdFields(points, "users", "set"); fields == nil || fields["value"] != int64(2) {
+		t.Error(fmt.Sprintf("Expected set to count 2 unique members but found %v", fields))
+	}
+	fields := statsdFields(points, "latency", "timing")
+	if fields == nil || fields["count"] != int64(3) || fields["mean"] != 20.0 || fields["lower"] != 10.0 || fields["upper"] != 30.0 || fields["p50"] != 20.0 || fields["p90"] != 30.0 {
+		t.Error(fmt.Sprintf("Unexpected timer fields %v", fields))
+	}
+
+	sut.Add(&sarama.ConsumerMessage{Value: []byte("queue:-3|g"), Offset: 3})
+	points, released = sut.Flush(time.Now(), true)
+	if len(points) != 1 || len(released) != 1 {
+		t.Error(fmt.Sprintf("Flushing should reset the window but kept %d points", len(points)))
+	}
+	if fields := statsdFields(points, "queue", "gauge"); fields == nil || fields["value"] != 12.0 {
+		t.Error(fmt.Sprintf("Expected relative gauge to adjust the last value to 12 but found %v", fields))
+	}
+
+	points, _ = sut.Flush(time.Now(), true)
+	if fields := statsdFields(points, "queue", "gauge"); len(points) != 1 || fields["value"] != 12.0 {
+		t.Error(fmt.Sprintf("Expected gauge to be written with every window but found %v", points))
+	}
+}
+
+func Test_Statsd_Idle_Gauges_Expire(t *testing.T) {
+	sut := NewStatsd(&StatsdConfig{FlushInterval: time.Minute, GaugeExpiry: 2})
+	sut.Add(&sarama.ConsumerMessage{Value: []byte("queue,host=a:10|g\nqueue,host=b:20|g")})
+	sut.Flush(time.Now(), true)
+
+	sut.Add(&sarama.ConsumerMessage{Value: []byte("queue,host=b:21|g")})
+	points, _ := sut.Flush(time.Now(), true)
+	if len(points) != 2 {
+		t.Error(fmt.Sprintf("Expected both gauges to be written within their expiry but found %v", points))
+	}
+
+	sut.Add(&sarama.ConsumerMessage{Value: []byte("queue,host=b:22|g")})
+	points, _ = sut.Flush(time.Now(), true)
+	if len(points) != 1 || points[0].Tags()["host"] != "b" {
+		t.Error(fmt.Sprintf("Expected the idle gauge to stop being written but found %v", points))
+	}
+}
+
+func Test_Statsd_Offsets_Held_Until_Window_Written(t *testing.T) {
+	conf := NewKandiTestConfig("localhost:8086", 2)
+	conf.Kafka.Format = "statsd"
+	conf.Kandi.Statsd = &StatsdConfig{FlushInterval: time.Hour}
+	sut := NewKandi(conf)
+	consumer := NewMockConsumer([]string{})
+	sut.Consumer = consumer
+
+	input := []*sarama.ConsumerMessage{{Value: []byte("requests:1|c"), Offset: 0}, {Value: []byte("requests:1|c"), Offset: 1}}
+	prepared, _ := sut.prepare(input)
+	if len(prepared.commit) != 0 || len(prepared.batches[0].Points()) != 0 {
+		t.Error("Messages in an open statsd window should not be committed or written")
+	}
+
+	points, released := sut.statsd[sut.fallback].Flush(time.Now(), true)
+	for _, message := range released {
+		sut.offsets.Done(message)
+	}
+	if len(points) != 1 || len(sut.offsets.Ready()) != 2 {
+		t.Error("Messages should be released once their window is flushed")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// subscriptions holds the partitions claimed by the consumer per topic as of
+// the last rebalance. With a topic pattern this is the only place telling
+// which topics are consumed.
+type subscriptions struct {
+	lock    sync.RWMutex
+	pattern string
+	current map[string][]int32
+}
+
+var subscribedTopics = &subscriptions{current: map[string][]int32{}}
+
+func init() {
+	expvar.Publish("subscribedTopics", expvar.Func(func() interface{} { return subscribedTopics.topics() }))
+	http.HandleFunc("/topics", subscribedTopics.ServeHTTP)
+}
+
+func (s *subscriptions) set(pattern string, current map[string][]int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pattern = pattern
+	s.current = current
+	MetricsSubscribedTopicCount.Set(int64(len(current)))
+}
+
+// topics returns the sorted names of the subscribed topics.
+func (s *subscriptions) topics() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	topics := make([]string, 0, len(s.current))
+	for topic := range s.current {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (s *subscriptions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Pattern    string             `json:"pattern,omitempty"`
+		Partitions map[string][]int32 `json:"partitions"`
+	}{s.pattern, s.current})
+}
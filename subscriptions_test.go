@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Subscribed_Topics_Are_Served(t *testing.T) {
+	sut := &subscriptions{current: map[string][]int32{}}
+	sut.set("^metrics-.*", map[string][]int32{"metrics-web": {0, 1}, "metrics-billing": {2}})
+
+	recorder := httptest.NewRecorder()
+	sut.ServeHTTP(recorder, httptest.NewRequest("GET", "/topics", nil))
+
+	expected := `{"pattern":"^metrics-.*","partitions":{"metrics-billing":[2],"metrics-web":[0,1]}}`
+	if actual := strings.TrimSpace(recorder.Body.String()); actual != expected {
+		t.Error(fmt.Sprintf("Unexpected response.\n\texpected: %s\n\tactual: %s", expected, actual))
+	}
+	if fmt.Sprint(sut.topics()) != "[metrics-billing metrics-web]" || MetricsSubscribedTopicCount.Value() != 2 {
+		t.Error(fmt.Sprintf("Unexpected topics %v", sut.topics()))
+	}
+}
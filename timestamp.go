@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// TimestampConfig selects the time given to points that carry no timestamp of
+// their own. The source is wallclock (default), createTime for the record
+// timestamp set by the producer, logAppendTime for the outer message set
+// timestamp falling back to the record timestamp, which the broker sets for
+// topics with message.timestamp.type=LogAppendTime, or header to parse the
+// named record header with HeaderFormat.
+type TimestampConfig struct {
+	Source       string
+	Header       string
+	HeaderFormat string
+}
+
+func NewTimestampConfig(entry map[string]interface{}) *TimestampConfig {
+	conf := &TimestampConfig{Source: "wallclock", HeaderFormat: "unix_ms"}
+	if value, ok := entry["source"].(string); ok {
+		conf.Source = strings.ToLower(value)
+	}
+	if value, ok := entry["header"].(string); ok {
+		conf.Header = value
+	}
+	if value, ok := entry["headerformat"].(string); ok {
+		conf.HeaderFormat = value
+	}
+	return conf
+}
+
+// defaultTime returns the time configured for the message, or now when the
+// message does not carry it.
+func (conf *TimestampConfig) defaultTime(message *sarama.ConsumerMessage, now time.Time) time.Time {
+	if conf == nil {
+		return now
+	}
+	switch conf.Source {
+	case "createtime":
+		if !message.Timestamp.IsZero() {
+			return message.Timestamp.UTC()
+		}
+	case "logappendtime":
+		if !message.BlockTimestamp.IsZero() {
+			return message.BlockTimestamp.UTC()
+		}
+		if !message.Timestamp.IsZero() {
+			return message.Timestamp.UTC()
+		}
+	case "header":
+		for _, header := range message.Headers {
+			if header != nil && string(header.Key) == conf.Header {
+				parsed, err := parseTimeValue(string(header.Value), conf.HeaderFormat)
+				if err == nil {
+					return parsed.UTC()
+				}
+				log.WithError(err).WithField("header", conf.Header).Debug("Failed to parse timestamp header")
+				break
+			}
+		}
+	default:
+		return now
+	}
+	MetricsDefaultTimeFallback.Add(1)
+	return now
+}
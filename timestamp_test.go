@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+func Test_Timestamp_Default_Time_Source(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	created := time.Unix(1500000000, 0).UTC()
+	appended := time.Unix(1500000001, 0).UTC()
+	message := &sarama.ConsumerMessage{
+		Timestamp:      created,
+		BlockTimestamp: appended,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("produced-at"), Value: []byte("1400000000000")},
+			{Key: []byte("bad"), Value: []byte("yesterday")},
+		},
+	}
+	testCases := []struct {
+		label    string
+		config   *TimestampConfig
+		message  *sarama.ConsumerMessage
+		expected time.Time
+	}{
+		{"Should Use Wall Clock By Default", &TimestampConfig{Source: "wallclock"}, message, now},
+		{"Should Use Wall Clock Without Configuration", nil, message, now},
+		{"Should Use Record Create Time", &TimestampConfig{Source: "createtime"}, message, created},
+		{"Should Use Log Append Time", &TimestampConfig{Source: "logappendtime"}, message, appended},
+		{"Should Fall Back To Record Timestamp For Log Append Time", &TimestampConfig{Source: "logappendtime"}, &sarama.ConsumerMessage{Timestamp: created}, created},
+		{"Should Fall Back To Wall Clock Without Record Timestamp", &TimestampConfig{Source: "createtime"}, &sarama.ConsumerMessage{}, now},
+		{"Should Use Header", &TimestampConfig{Source: "header", Header: "produced-at", HeaderFormat: "unix_ms"}, message, time.Unix(1400000000, 0).UTC()},
+		{"Should Fall Back To Wall Clock For Missing Header", &TimestampConfig{Source: "header", Header: "missing", HeaderFormat: "unix_ms"}, message, now},
+		{"Should Fall Back To Wall Clock For Invalid Header", &TimestampConfig{Source: "header", Header: "bad", HeaderFormat: "unix_ms"}, message, now},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			actual := testCase.config.defaultTime(testCase.message, now)
+			if !actual.Equal(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: expected %s but found %s", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cast"
+	"strings"
+)
+
+// TopicConfig describes how the messages of a single topic are parsed and
+// where their points are written. Empty settings fall back to the global
+// kafka, kandi and influx configuration.
+type TopicConfig struct {
+	Name               string
+	Format             string
+	Precision          string
+	Tags               map[string]string
+	Timestamp          *TimestampConfig
+	Database           string
+	RetentionPolicy    string
+	Otlp               *OtlpConfig
+	Json               *JsonConfig
+	Graphite           *GraphiteConfig
+	Downsample         *DownsampleConfig
+	PayloadCompression string
+	MaxPayloadSize     int64
+}
+
+// lowerKeys normalises a map read from a yaml list, whose keys viper leaves in
+// their original case.
+func lowerKeys(value interface{}) map[string]interface{} {
+	lowered := make(map[string]interface{})
+	for key, entry := range cast.ToStringMap(value) {
+		lowered[strings.ToLower(key)] = entry
+	}
+	return lowered
+}
+
+func NewTopicConfig(value interface{}) *TopicConfig {
+	entry := lowerKeys(value)
+	conf := &TopicConfig{Tags: map[string]string{}}
+	if value, ok := entry["name"].(string); ok {
+		conf.Name = value
+	}
+	if value, ok := entry["format"].(string); ok {
+		conf.Format = strings.ToLower(value)
+	}
+	if value, ok := entry["precision"].(string); ok {
+		conf.Precision = value
+	}
+	if value, ok := entry["tags"]; ok {
+		conf.Tags = cast.ToStringMapString(value)
+	}
+	if value, ok := entry["timestamp"]; ok {
+		conf.Timestamp = NewTimestampConfig(lowerKeys(value))
+	}
+	if value, ok := entry["database"].(string); ok {
+		conf.Database = value
+	}
+	if value, ok := entry["retentionpolicy"].(string); ok {
+		conf.RetentionPolicy = value
+	}
+	if value, ok := entry["otlp"]; ok {
+		conf.Otlp = NewOtlpConfig(lowerKeys(value))
+	}
+	if value, ok := entry["json"]; ok {
+		conf.Json = NewJsonConfig(lowerKeys(value))
+	}
+	if value, ok := entry["graphite"]; ok {
+		conf.Graphite = NewGraphiteConfig(lowerKeys(value))
+	}
+	if value, ok := entry["payloadcompression"].(string); ok {
+		conf.PayloadCompression = strings.ToLower(value)
+	}
+	if value, ok := entry["maxpayloadsize"].(int); ok {
+		conf.MaxPayloadSize = int64(value)
+	}
+	if value, ok := entry["downsample"]; ok {
+		conf.Downsample = NewDownsampleConfig(lowerKeys(value))
+	}
+	return conf
+}
+
+func NewOtlpConfig(entry map[string]interface{}) *OtlpConfig {
+	conf := &OtlpConfig{Encoding: "auto"}
+	if value, ok := entry["encoding"].(string); ok {
+		conf.Encoding = strings.ToLower(value)
+	}
+	return conf
+}
+
+func NewJsonConfig(entry map[string]interface{}) *JsonConfig {
+	conf := &JsonConfig{TimeFormat: "unix_ns"}
+	if value, ok := entry["measurement"].(string); ok {
+		conf.Measurement = value
+	}
+	if value, ok := entry["measurementkey"].(string); ok {
+		conf.MeasurementKey = value
+	}
+	if value, ok := entry["timekey"].(string); ok {
+		conf.TimeKey = value
+	}
+	if value, ok := entry["timeformat"].(string); ok {
+		conf.TimeFormat = value
+	}
+	if value, ok := entry["tagkeys"]; ok {
+		conf.TagKeys = cast.ToStringSlice(value)
+	}
+	if value, ok := entry["stringfields"]; ok {
+		conf.StringFields = cast.ToStringSlice(value)
+	}
+	return conf
+}
+
+func NewGraphiteConfig(entry map[string]interface{}) *GraphiteConfig {
+	conf := &GraphiteConfig{Separator: "."}
+	if value, ok := entry["separator"].(string); ok {
+		conf.Separator = value
+	}
+	if value, ok := entry["templates"]; ok {
+		conf.Templates = cast.ToStringSlice(value)
+	}
+	return conf
+}
+
+// resolve fills unset settings of the topic from the global configuration.
+func (topic *TopicConfig) resolve(conf *Config) *TopicConfig {
+	resolved := *topic
+	if resolved.Format == "" {
+		resolved.Format = conf.Kafka.Format
+	}
+	if resolved.Precision == "" {
+		resolved.Precision = conf.Influx.Precision
+	}
+	if resolved.Timestamp == nil {
+		resolved.Timestamp = conf.Kandi.Timestamp
+	}
+	if resolved.Database == "" {
+		resolved.Database = conf.Influx.Database
+	}
+	if resolved.RetentionPolicy == "" {
+		resolved.RetentionPolicy = conf.Influx.RetentionPolicy
+	}
+	if resolved.Otlp == nil {
+		resolved.Otlp = conf.Kandi.Otlp
+	}
+	if resolved.Json == nil {
+		resolved.Json = conf.Kandi.Json
+	}
+	if resolved.Graphite == nil {
+		resolved.Graphite = conf.Kandi.Graphite
+	}
+	if resolved.PayloadCompression == "" {
+		resolved.PayloadCompression = conf.Kafka.PayloadCompression
+	}
+	if resolved.MaxPayloadSize == 0 {
+		resolved.MaxPayloadSize = conf.Kafka.MaxPayloadSize
+	}
+	if resolved.MaxPayloadSize == 0 {
+		resolved.MaxPayloadSize = defaultMaxPayloadSize
+	}
+	if resolved.Downsample == nil {
+		resolved.Downsample = conf.Kandi.Downsample
+	}
+	return &resolved
+}
+
+type destination struct {
+	database        string
+	retentionPolicy string
+}
+
+// topicHandler holds what the processing path needs for messages of a topic.
+// Topics using the statsd format have no parser, their messages go to a
+// statsd window of their own instead.
+type topicHandler struct {
+	config      *TopicConfig
+	parser      Parser
+	destination destination
+}
+
+func newTopicHandler(topic *TopicConfig, conf *Config) (*topicHandler, error) {
+	resolved := topic.resolve(conf)
+	handler := &topicHandler{config: resolved, destination: destination{resolved.Database, resolved.RetentionPolicy}}
+	switch resolved.PayloadCompression {
+	case "", "none", "auto", "gzip", "snappy", "lz4", "zstd":
+	default:
+		return nil, fmt.Errorf("unsupported payload compression %s", resolved.PayloadCompression)
+	}
+	if resolved.Format != "statsd" {
+		parser, err := NewParser(resolved)
+		if err != nil {
+			return nil, err
+		}
+		handler.parser = parser
+	}
+	return handler, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"regexp"
+)
+
+// TransformConfig is a single rule of the transform chain. A rule applies to
+// the points whose measurement matches Measurement, or to all points when it
+// is empty. Measurement is an exact name, a glob or a /regular expression/,
+// like the patterns of filters. Its operations run in the order of the fields
+// below, so tags are dropped and mapped under their renamed names.
+type TransformConfig struct {
+	Measurement       string
+	RenameMeasurement map[string]string
+	RenameTags        map[string]string
+	DropTags          []string
+	DropTagsMatching  []string
+	MapTags           map[string]map[string]string
+	AddTags           map[string]string
+	TopicTag          string
+	RenameFields      map[string]string
+}
+
+func NewTransformConfig(entry map[string]interface{}) *TransformConfig {
+	conf := &TransformConfig{}
+	if value, ok := entry["measurement"].(string); ok {
+		conf.Measurement = value
+	}
+	if value, ok := entry["renamemeasurement"]; ok {
+		conf.RenameMeasurement = cast.ToStringMapString(value)
+	}
+	if value, ok := entry["renametags"]; ok {
+		conf.RenameTags = cast.ToStringMapString(value)
+	}
+	if value, ok := entry["droptags"]; ok {
+		conf.DropTags = cast.ToStringSlice(value)
+	}
+	if value, ok := entry["droptagsmatching"]; ok {
+		conf.DropTagsMatching = cast.ToStringSlice(value)
+	}
+	if value, ok := entry["maptags"]; ok {
+		conf.MapTags = make(map[string]map[string]string)
+		for tag, values := range cast.ToStringMap(value) {
+			conf.MapTags[tag] = cast.ToStringMapString(values)
+		}
+	}
+	if value, ok := entry["addtags"]; ok {
+		conf.AddTags = cast.ToStringMapString(value)
+	}
+	if value, ok := entry["topictag"].(string); ok {
+		conf.TopicTag = value
+	}
+	if value, ok := entry["renamefields"]; ok {
+		conf.RenameFields = cast.ToStringMapString(value)
+	}
+	return conf
+}
+
+type transformRule struct {
+	config           *TransformConfig
+	measurement      matcher
+	dropTagsMatching []*regexp.Regexp
+}
+
+// Transform rewrites the measurement, tags and fields of every point through
+// a chain of rules.
+type Transform struct {
+	rules []*transformRule
+}
+
+func NewTransform(configs []*TransformConfig) (*Transform, error) {
+	transform := &Transform{}
+	for _, config := range configs {
+		rule := &transformRule{config: config}
+		if config.Measurement != "" {
+			measurement, err := newMatcher(config.Measurement)
+			if err != nil {
+				return nil, err
+			}
+			rule.measurement = measurement
+		}
+		for _, pattern := range config.DropTagsMatching {
+			expression, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			rule.dropTagsMatching = append(rule.dropTagsMatching, expression)
+		}
+		transform.rules = append(transform.rules, rule)
+	}
+	return transform, nil
+}
+
+func (t *Transform) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	transformed := points[:0]
+	for _, point := range points {
+		fields, err := point.Fields()
+		if err != nil {
+			log.WithError(err).WithField("measurement", point.Name()).Debug("Unable to read fields of point to transform")
+			transformed = append(transformed, point)
+			continue
+		}
+		name, tags := point.Name(), point.Tags()
+		for _, rule := range t.rules {
+			if rule.measurement == nil || rule.measurement(name) {
+				name = rule.apply(name, tags, fields, message)
+			}
+		}
+		rewritten, err := influx.NewPoint(name, tags, fields, point.Time())
+		if err != nil {
+			log.WithError(err).WithField("measurement", name).Debug("Dropping point left invalid by transform")
+			MetricsTransformFailure.Add(1)
+			continue
+		}
+		transformed = append(transformed, rewritten)
+	}
+	return transformed
+}
+
+// apply rewrites tags and fields in place and returns the new measurement.
+func (r *transformRule) apply(name string, tags map[string]string, fields map[string]interface{}, message *sarama.ConsumerMessage) string {
+	if renamed, ok := r.config.RenameMeasurement[name]; ok {
+		name = renamed
+	}
+	for from, to := range r.config.RenameTags {
+		if value, ok := tags[from]; ok {
+			delete(tags, from)
+			tags[to] = value
+		}
+	}
+	for _, tag := range r.config.DropTags {
+		delete(tags, tag)
+	}
+	for tag := range tags {
+		for _, expression := range r.dropTagsMatching {
+			if expression.MatchString(tag) {
+				delete(tags, tag)
+				break
+			}
+		}
+	}
+	for tag, values := range r.config.MapTags {
+		if value, ok := tags[tag]; ok {
+			if mapped, ok := values[value]; ok {
+				tags[tag] = mapped
+			}
+		}
+	}
+	for tag, value := range r.config.AddTags {
+		tags[tag] = value
+	}
+	if r.config.TopicTag != "" && message != nil {
+		tags[r.config.TopicTag] = message.Topic
+	}
+	for from, to := range r.config.RenameFields {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+	return name
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+var TransformTestCases = []struct {
+	label    string
+	rules    []*TransformConfig
+	expected []string
+}{
+	{
+		"Should Leave Point Untouched Without Rules",
+		nil,
+		[]string{"cpu_load,host=web01,region=us-west-2,tmp_id=7 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Rename Measurement Tags And Fields",
+		[]*TransformConfig{{RenameMeasurement: map[string]string{"cpu_load": "cpu"}, RenameTags: map[string]string{"host": "hostname"}, RenameFields: map[string]string{"value": "load"}}},
+		[]string{"cpu,hostname=web01,region=us-west-2,tmp_id=7 load=0.5 1501096898000000000"},
+	},
+	{
+		"Should Drop Tags By Name And Pattern",
+		[]*TransformConfig{{DropTags: []string{"region"}, DropTagsMatching: []string{"^tmp_"}}},
+		[]string{"cpu_load,host=web01 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Map Tag Values And Add Static And Topic Tags",
+		[]*TransformConfig{{MapTags: map[string]map[string]string{"region": {"us-west-2": "usw2"}}, AddTags: map[string]string{"kandi_instance": "k1"}, TopicTag: "source_topic"}},
+		[]string{"cpu_load,host=web01,kandi_instance=k1,region=usw2,source_topic=metrics,tmp_id=7 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Only Apply Rule To Matching Measurements",
+		[]*TransformConfig{{Measurement: "mem*", DropTags: []string{"host"}}},
+		[]string{"cpu_load,host=web01,region=us-west-2,tmp_id=7 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Match Measurement Names Exactly",
+		[]*TransformConfig{{Measurement: "cpu", DropTags: []string{"host"}}},
+		[]string{"cpu_load,host=web01,region=us-west-2,tmp_id=7 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Match Measurements By Glob Or Regular Expression",
+		[]*TransformConfig{{Measurement: "cpu_*", DropTags: []string{"host"}}, {Measurement: "/^cpu_(load|idle)$/", DropTags: []string{"region"}}},
+		[]string{"cpu_load,tmp_id=7 value=0.5 1501096898000000000"},
+	},
+	{
+		"Should Chain Rules In Order",
+		[]*TransformConfig{{RenameMeasurement: map[string]string{"cpu_load": "cpu"}}, {Measurement: "cpu", RenameTags: map[string]string{"tmp_id": "id"}}},
+		[]string{"cpu,host=web01,id=7,region=us-west-2 value=0.5 1501096898000000000"},
+	},
+}
+
+func Test_Transform(t *testing.T) {
+	for _, testCase := range TransformTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut, err := NewTransform(testCase.rules)
+			if err != nil {
+				t.Error(fmt.Sprintf("%s: unexpected error %s", testCase.label, err.Error()))
+				return
+			}
+			point, _ := influx.NewPoint("cpu_load", map[string]string{"host": "web01", "region": "us-west-2", "tmp_id": "7"}, map[string]interface{}{"value": 0.5}, time.Unix(1501096898, 0))
+			actual := pointStrings(sut.Apply([]*influx.Point{point}, &sarama.ConsumerMessage{Topic: "metrics"}))
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+		})
+	}
+}
+
+func Test_Transform_Rejects_Invalid_Pattern(t *testing.T) {
+	if _, err := NewTransform([]*TransformConfig{{DropTagsMatching: []string{"("}}}); err == nil {
+		t.Error("Expected invalid tag pattern to be rejected")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+type ValidationConfig struct {
+	MaxPast          time.Duration
+	MaxFuture        time.Duration
+	CorrectPrecision bool
+}
+
+// precisionCorrections are the factors by which a timestamp written in
+// seconds, milliseconds or microseconds falls short of nanoseconds.
+var precisionCorrections = []int64{int64(time.Second), int64(time.Millisecond), int64(time.Microsecond)}
+
+// TimestampValidation rejects points outside of the window [now - MaxPast,
+// now + MaxFuture]. With CorrectPrecision a point whose timestamp lands in the
+// window once read as seconds, milliseconds or microseconds is rewritten
+// instead of being rejected.
+type TimestampValidation struct {
+	config     *ValidationConfig
+	deadLetter DeadLetter
+	now        func() time.Time
+}
+
+func NewTimestampValidation(config *ValidationConfig, deadLetter DeadLetter) *TimestampValidation {
+	return &TimestampValidation{config: config, deadLetter: deadLetter, now: time.Now}
+}
+
+func (v *TimestampValidation) inWindow(timestamp int64, now time.Time) bool {
+	if v.config.MaxPast > 0 && timestamp < now.Add(-v.config.MaxPast).UnixNano() {
+		return false
+	}
+	if v.config.MaxFuture > 0 && timestamp > now.Add(v.config.MaxFuture).UnixNano() {
+		return false
+	}
+	return true
+}
+
+func (v *TimestampValidation) Apply(points []*influx.Point, message *sarama.ConsumerMessage) []*influx.Point {
+	now := v.now()
+	valid := points[:0]
+	for _, point := range points {
+		timestamp := point.UnixNano()
+		if v.inWindow(timestamp, now) {
+			valid = append(valid, point)
+			continue
+		}
+		if corrected := v.correct(point, timestamp, now); corrected != nil {
+			MetricsTimestampCorrected.Add(point.Name(), 1)
+			valid = append(valid, corrected)
+			continue
+		}
+		log.WithFields(log.Fields{"measurement": point.Name(), "time": point.Time()}).Debug("Rejecting point with timestamp outside of the accepted window")
+		MetricsTimestampRejected.Add(point.Name(), 1)
+		if v.deadLetter != nil {
+			v.deadLetter.Send(point, message, "timestamp outside of accepted window")
+		}
+	}
+	return valid
+}
+
+func (v *TimestampValidation) correct(point *influx.Point, timestamp int64, now time.Time) *influx.Point {
+	if !v.config.CorrectPrecision || timestamp <= 0 {
+		return nil
+	}
+	for _, factor := range precisionCorrections {
+		if timestamp > math.MaxInt64/factor {
+			continue
+		}
+		if corrected := timestamp * factor; v.inWindow(corrected, now) {
+			fields, err := point.Fields()
+			if err != nil {
+				return nil
+			}
+			rewritten, err := influx.NewPoint(point.Name(), point.Tags(), fields, time.Unix(0, corrected).UTC())
+			if err != nil {
+				return nil
+			}
+			return rewritten
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"testing"
+	"time"
+)
+
+type mockDeadLetter struct {
+	points  []*influx.Point
+	reasons []string
+}
+
+func (m *mockDeadLetter) Send(point *influx.Point, message *sarama.ConsumerMessage, reason string) {
+	m.points = append(m.points, point)
+	m.reasons = append(m.reasons, reason)
+}
+
+var validationNow = time.Unix(1501096898, 0)
+
+var TimestampValidationTestCases = []struct {
+	label            string
+	correctPrecision bool
+	timestamp        time.Time
+	expected         []string
+	expectedRejected int
+}{
+	{
+		"Should Keep Point Within Window",
+		false,
+		validationNow.Add(-time.Hour),
+		[]string{"test value=1 1501093298000000000"},
+		0,
+	},
+	{
+		"Should Reject Point Too Far In The Past",
+		false,
+		validationNow.Add(-48 * time.Hour),
+		[]string{},
+		1,
+	},
+	{
+		"Should Reject Point Too Far In The Future",
+		false,
+		validationNow.Add(time.Hour),
+		[]string{},
+		1,
+	},
+	{
+		"Should Reject Point Written In Seconds Without Correction",
+		false,
+		time.Unix(0, 1501096898),
+		[]string{},
+		1,
+	},
+	{
+		"Should Correct Point Written In Seconds",
+		true,
+		time.Unix(0, 1501096898),
+		[]string{"test value=1 1501096898000000000"},
+		0,
+	},
+	{
+		"Should Correct Point Written In Milliseconds",
+		true,
+		time.Unix(0, 1501096898123),
+		[]string{"test value=1 1501096898123000000"},
+		0,
+	},
+	{
+		"Should Reject Point That No Precision Brings Into Window",
+		true,
+		time.Unix(0, 42),
+		[]string{},
+		1,
+	},
+}
+
+func Test_Timestamp_Validation(t *testing.T) {
+	for _, testCase := range TimestampValidationTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			deadLetter := &mockDeadLetter{}
+			sut := NewTimestampValidation(&ValidationConfig{MaxPast: 24 * time.Hour, MaxFuture: time.Minute, CorrectPrecision: testCase.correctPrecision}, deadLetter)
+			sut.now = func() time.Time { return validationNow }
+			point, _ := influx.NewPoint("test", nil, map[string]interface{}{"value": 1.0}, testCase.timestamp)
+
+			actual := pointStrings(sut.Apply([]*influx.Point{point}, &sarama.ConsumerMessage{}))
+			if fmt.Sprint(actual) != fmt.Sprint(testCase.expected) {
+				t.Error(fmt.Sprintf("%s: unexpected points.\n\texpected: %v\n\tactual: %v", testCase.label, testCase.expected, actual))
+			}
+			if len(deadLetter.points) != testCase.expectedRejected {
+				t.Error(fmt.Sprintf("%s: expected %d dead lettered points but found %d", testCase.label, testCase.expectedRejected, len(deadLetter.points)))
+			}
+		})
+	}
+}